@@ -3,14 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -18,6 +23,12 @@ import (
 	vmclient "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned"
 	vminformers "github.com/openshift/ci-vm-operator/pkg/client/informers/externalversions"
 	"github.com/openshift/ci-vm-operator/pkg/controller"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/aws"
+	"github.com/openshift/ci-vm-operator/pkg/provider/docker"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce"
+	"github.com/openshift/ci-vm-operator/pkg/provider/kubevirt"
+	"github.com/openshift/ci-vm-operator/pkg/provider/libvirt"
 )
 
 const (
@@ -28,6 +39,8 @@ type options struct {
 	configLocation string
 	numWorkers     int
 	logLevel       string
+	metricsAddress string
+	gceEndpoint    string
 }
 
 func main() {
@@ -36,6 +49,8 @@ func main() {
 	flag.StringVar(&o.configLocation, "config-file", "", "Path to the controller configuration.")
 	flag.IntVar(&o.numWorkers, "num-workers", 10, "Number of worker threads.")
 	flag.StringVar(&o.logLevel, "log-level", logrus.DebugLevel.String(), "Logging level.")
+	flag.StringVar(&o.metricsAddress, "metrics-address", ":8080", "Address on which to serve Prometheus metrics.")
+	flag.StringVar(&o.gceEndpoint, "gce-endpoint", "", "Root URL of the GCE compute API to use instead of Google's, such as that of fake-gce-api. No credentials are sent to it.")
 	flag.Parse()
 
 	level, err := logrus.ParseLevel(o.logLevel)
@@ -72,12 +87,21 @@ func main() {
 
 	vmInformerFactory := vminformers.NewSharedInformerFactory(vmClient, resync)
 
-	gceClient, err := controller.NewGCEClient()
+	// objects that VirtualMachines are bound to may be of any kind,
+	// so they are looked up with a dynamic client
+	mapper := discovery.NewDeferredDiscoveryRESTMapper(cached.NewMemCacheClient(kubeClient.Discovery()), dynamic.VersionInterfaces)
+	dynamicClients := dynamic.NewClientPool(clusterConfig, mapper, dynamic.LegacyAPIPathResolverFunc)
+
+	cloud, err := loadProvider(config, clusterConfig, kubeClient, o.gceEndpoint)
 	if err != nil {
-		logrus.WithError(err).Fatal("failed to initialize GCE client")
+		logrus.WithError(err).Fatal("failed to initialize provider")
+	}
+	config.Default(cloud.Zones())
+	if err := config.Validate(cloud.Zones()); err != nil {
+		logrus.WithError(err).Fatal("invalid configuration")
 	}
 
-	vmController := controller.New(config, vmInformerFactory.Ci().V1alpha1().VirtualMachines(), vmClient.CiV1alpha1(), kubeClient, gceClient)
+	vmController := controller.New(config, vmInformerFactory.Ci().V1alpha1().VirtualMachines(), vmClient.CiV1alpha1(), kubeClient, dynamicClients, mapper, cloud)
 	stop := make(chan struct{})
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -90,6 +114,10 @@ func main() {
 	defer close(stop)
 	go vmInformerFactory.Start(stop)
 	go vmController.Run(o.numWorkers, stop)
+	go func() {
+		http.Handle("/metrics", prometheus.Handler())
+		logrus.WithError(http.ListenAndServe(o.metricsAddress, nil)).Fatal("failed to serve metrics")
+	}()
 
 	// Wait forever
 	select {}
@@ -116,3 +144,34 @@ func loadClusterConfig() (*rest.Config, error) {
 	}
 	return clusterConfig, nil
 }
+
+// loadProvider initializes the provider virtual
+// machines are launched with.
+func loadProvider(config controller.Configuration, clusterConfig *rest.Config, kubeClient kubernetes.Interface, gceEndpoint string) (provider.Provider, error) {
+	switch config.Provider {
+	case "", gce.Name:
+		client, err := gce.NewClient(gceEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize GCE client: %v", err)
+		}
+		return gce.New(config.Project, client), nil
+	case docker.Name:
+		return docker.New(config.Docker), nil
+	case libvirt.Name:
+		return libvirt.New(config.Libvirt), nil
+	case kubevirt.Name:
+		client, err := kubevirt.NewClient(clusterConfig, config.Kubevirt)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize KubeVirt client: %v", err)
+		}
+		return kubevirt.New(config.Kubevirt, client, kubeClient), nil
+	case aws.Name:
+		credentials, err := aws.CredentialsFromEnvironment()
+		if err != nil {
+			return nil, fmt.Errorf("could not load AWS credentials: %v", err)
+		}
+		return aws.New(config.AWS, aws.NewClient(credentials, config.AWS.Endpoint)), nil
+	default:
+		return nil, fmt.Errorf("unknown provider %q", config.Provider)
+	}
+}
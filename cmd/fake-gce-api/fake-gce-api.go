@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+type options struct {
+	address            string
+	logLevel           string
+	quotaExceededZones string
+	exhaustedZones     string
+	config             fake.Config
+}
+
+func main() {
+	logrus.SetFormatter(&logrus.JSONFormatter{})
+	o := options{}
+	flag.StringVar(&o.address, "address", ":8081", "Address on which to serve the compute API.")
+	flag.StringVar(&o.logLevel, "log-level", logrus.InfoLevel.String(), "Logging level.")
+	flag.DurationVar(&o.config.Latency, "latency", 0, "Delay before every response.")
+	flag.DurationVar(&o.config.OperationDuration, "operation-duration", 5*time.Second, "Time operations take to complete.")
+	flag.Float64Var(&o.config.FailureRate, "failure-rate", 0, "Fraction of requests that fail with a transient error.")
+	flag.StringVar(&o.quotaExceededZones, "quota-exceeded-zones", "", "Comma-separated zones in which inserting instances is rejected for lack of quota.")
+	flag.StringVar(&o.exhaustedZones, "exhausted-zones", "", "Comma-separated zones in which inserting instances fails for lack of resources.")
+	flag.DurationVar(&o.config.PreemptAfter, "preempt-after", 0, "Time after which preemptible instances are preempted, if set.")
+	flag.Int64Var(&o.config.Seed, "seed", time.Now().UnixNano(), "Seed for the choice of failing requests.")
+	flag.Parse()
+
+	level, err := logrus.ParseLevel(o.logLevel)
+	if err != nil {
+		logrus.WithError(err).Fatal("failed to parse log level")
+	}
+	logrus.SetLevel(level)
+
+	o.config.QuotaExceededZones = splitZones(o.quotaExceededZones)
+	o.config.ExhaustedZones = splitZones(o.exhaustedZones)
+
+	logrus.WithField("address", o.address).Info("serving fake compute API")
+	logrus.WithError(http.ListenAndServe(o.address, fake.NewServer(o.config))).Fatal("failed to serve fake compute API")
+}
+
+// splitZones parses a comma-separated list of zones.
+func splitZones(zones string) []string {
+	var split []string
+	for _, zone := range strings.Split(zones, ",") {
+		if zone = strings.TrimSpace(zone); zone != "" {
+			split = append(split, zone)
+		}
+	}
+	return split
+}
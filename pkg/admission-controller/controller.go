@@ -16,20 +16,28 @@ import (
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 
 	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/validation"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce"
 )
 
 type Configuration struct {
 	CertFile string
 	KeyFile  string
 	LogLevel string
+	// Provider is the provider the operator launches virtual
+	// machines with, which determines the zones specs may request
+	Provider string
 }
 
 func (c *Configuration) AddFlags() {
 	flag.StringVar(&c.CertFile, "tls-cert-file", c.CertFile, "File containing the default x509 Certificate for HTTPS. (CA cert, if any, concatenated after server cert).")
 	flag.StringVar(&c.KeyFile, "tls-private-key-file", c.KeyFile, "File containing the default x509 private key matching --tls-cert-file.")
 	flag.StringVar(&c.LogLevel, "log-level", logrus.DebugLevel.String(), "Logging level.")
+	flag.StringVar(&c.Provider, "provider", gce.Name, "Provider the operator launches virtual machines with. Zones and regions are only validated for the gce provider; those of other providers depend on the operator configuration.")
 }
 
 func (c *Configuration) Run() error {
@@ -46,7 +54,10 @@ func (c *Configuration) Run() error {
 		logrus.WithError(err).Fatal("failed to load x509 key pair")
 	}
 
-	http.HandleFunc("/validate", handle(validate))
+	zones := c.zones()
+	http.HandleFunc("/validate", handle(func(ar admissionapi.AdmissionReview) *admissionapi.AdmissionResponse {
+		return validate(ar, zones)
+	}))
 	http.HandleFunc("/mutate", handle(mutate))
 	server := &http.Server{
 		Addr: ":8443",
@@ -103,13 +114,26 @@ func handle(worker func(admissionapi.AdmissionReview) (*admissionapi.AdmissionRe
 	}
 }
 
-func validate(ar admissionapi.AdmissionReview) (*admissionapi.AdmissionResponse) {
+// zones lists the zones specs may request, or none if the
+// zones of the provider are not known statically.
+func (c *Configuration) zones() []provider.Zone {
+	if c.Provider == gce.Name {
+		return gce.Zones()
+	}
+	return nil
+}
+
+func validate(ar admissionapi.AdmissionReview, zones []provider.Zone) (*admissionapi.AdmissionResponse) {
+	if ar.Request.Operation == admissionapi.Create {
+		return validateCreate(ar, zones)
+	}
+
 	logger := newLogger(ar)
 	logger.Info("validating VirtualMachine to ensure only Status is updated")
 	// we know we are configured for the VirtualMachine CRD only
-	// and for the UPDATE operation only, so we need to check simply
-	// that the UPDATE is to the /status subresource or that spec
-	// was unchanged in the UPDATE and allow only those requests
+	// and for the CREATE and UPDATE operations only, so we need to
+	// check simply that the UPDATE is to the /status subresource or
+	// that spec was unchanged in the UPDATE and allow only those requests
 	valid := true
 	if ar.Request.SubResource != "status" {
 		newVm, err := deserialize(ar.Request.Object.Raw)
@@ -138,6 +162,32 @@ func validate(ar admissionapi.AdmissionReview) (*admissionapi.AdmissionResponse)
 	}
 }
 
+func validateCreate(ar admissionapi.AdmissionReview, zones []provider.Zone) (*admissionapi.AdmissionResponse) {
+	logger := newLogger(ar)
+	logger.Info("validating VirtualMachine spec")
+	vm, response := deserialize(ar.Request.Object.Raw)
+	if response != nil {
+		return response
+	}
+
+	errs := validation.ValidateVirtualMachineSpec(&vm.Spec, field.NewPath("spec"))
+	if zones != nil {
+		errs = append(errs, validation.ValidateZone(&vm.Spec, zones, field.NewPath("spec"))...)
+	}
+	if len(errs) > 0 {
+		logger.WithError(errs.ToAggregate()).Info("VirtualMachine was invalid")
+		return &admissionapi.AdmissionResponse{
+			Allowed: false,
+			Result: &meta.Status{
+				Reason:  meta.StatusReasonInvalid,
+				Message: errs.ToAggregate().Error(),
+			},
+		}
+	}
+	logger.Info("VirtualMachine was valid")
+	return &admissionapi.AdmissionResponse{Allowed: true}
+}
+
 func mutate(ar admissionapi.AdmissionReview) (*admissionapi.AdmissionResponse) {
 	logger := newLogger(ar)
 	logger.Info("mutating VitualMachine to ensure finalizer is present")
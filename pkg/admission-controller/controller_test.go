@@ -0,0 +1,97 @@
+package admission_controller
+
+import (
+	"encoding/json"
+	"testing"
+
+	admissionapi "k8s.io/api/admission/v1beta1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+func rawVM(t *testing.T, spec vmapi.VirtualMachineSpec) runtime.RawExtension {
+	raw, err := json.Marshal(&vmapi.VirtualMachine{
+		TypeMeta:   meta.TypeMeta{APIVersion: vmapi.SchemeGroupVersion.String(), Kind: "VirtualMachine"},
+		ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: "ci"},
+		Spec:       spec,
+	})
+	if err != nil {
+		t.Fatalf("could not encode VM: %v", err)
+	}
+	return runtime.RawExtension{Raw: raw}
+}
+
+func TestValidate(t *testing.T) {
+	zones := []provider.Zone{{Name: "us-east1-b", Region: "us-east1"}}
+
+	var testCases = []struct {
+		name        string
+		operation   admissionapi.Operation
+		subResource string
+		spec        vmapi.VirtualMachineSpec
+		oldSpec     vmapi.VirtualMachineSpec
+		zones       []provider.Zone
+		allowed     bool
+	}{
+		{
+			name:      "creating a VM in a known zone",
+			operation: admissionapi.Create,
+			spec:      vmapi.VirtualMachineSpec{Zone: "us-east1-b"},
+			zones:     zones,
+			allowed:   true,
+		},
+		{
+			name:      "creating a VM in an unknown zone",
+			operation: admissionapi.Create,
+			spec:      vmapi.VirtualMachineSpec{Zone: "us-west1-a"},
+			zones:     zones,
+		},
+		{
+			name:      "creating a VM in any zone when the zones are not known",
+			operation: admissionapi.Create,
+			spec:      vmapi.VirtualMachineSpec{Zone: "us-west1-a"},
+			allowed:   true,
+		},
+		{
+			name:      "creating an invalid VM when the zones are not known",
+			operation: admissionapi.Create,
+			spec:      vmapi.VirtualMachineSpec{Metadata: map[string]string{"ssh-keys": "root:ssh-rsa AAAA"}},
+		},
+		{
+			name:      "updating the spec",
+			operation: admissionapi.Update,
+			spec:      vmapi.VirtualMachineSpec{Zone: "us-east1-b"},
+			oldSpec:   vmapi.VirtualMachineSpec{Zone: "us-east1-c"},
+			zones:     zones,
+		},
+		{
+			name:        "updating the status",
+			operation:   admissionapi.Update,
+			subResource: "status",
+			spec:        vmapi.VirtualMachineSpec{Zone: "us-east1-b"},
+			zones:       zones,
+			allowed:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			review := admissionapi.AdmissionReview{Request: &admissionapi.AdmissionRequest{
+				Operation:   testCase.operation,
+				SubResource: testCase.subResource,
+				Object:      rawVM(t, testCase.spec),
+			}}
+			if testCase.operation == admissionapi.Update {
+				review.Request.OldObject = rawVM(t, testCase.oldSpec)
+			}
+
+			response := validate(review, testCase.zones)
+			if response.Allowed != testCase.allowed {
+				t.Errorf("expected the request to be allowed: %v, got %#v", testCase.allowed, response.Result)
+			}
+		})
+	}
+}
@@ -3,10 +3,15 @@ package v1alpha1
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
 	VirtualMachineFinalizer = "virtualmachines.ci.openshift.io"
+
+	// LeaseRenewTimeAnnotation holds the RFC3339 time at which the
+	// consumer of a VirtualMachine with a lease last renewed it
+	LeaseRenewTimeAnnotation = "virtualmachines.ci.openshift.io/lease-renew-time"
 )
 
 // +genclient
@@ -45,6 +50,181 @@ type VirtualMachineSpec struct {
 	BootDisk VirtualMachineBootDiskSpec `json:"bootDisk"`
 	// Disks are additional disks to attach to the virtual machine
 	Disks []VirtualMachineDiskSpec `json:"disks,omitempty"`
+	// Zone is the zone to provision the virtual machine in. If
+	// unset, the zone is chosen from the Region or defaults to
+	// the zone the operator is configured with.
+	Zone string `json:"zone,omitempty"`
+	// Region is the region to provision the virtual machine in,
+	// letting the operator choose a zone in that region. It is
+	// ignored if Zone is set.
+	Region string `json:"region,omitempty"`
+	// TTL is how long after its creation the virtual machine
+	// is deleted
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// ExpiresAt is when the virtual machine is deleted
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Lease requires consumers of the virtual machine to renew
+	// their claim on it periodically, or have it deleted
+	Lease *VirtualMachineLeaseSpec `json:"lease,omitempty"`
+	// BoundTo is an object whose lifetime bounds that of the
+	// virtual machine
+	BoundTo *VirtualMachineBinding `json:"boundTo,omitempty"`
+	// Scheduling configures how the instance is scheduled and
+	// what happens when it is preempted
+	Scheduling *VirtualMachineScheduling `json:"scheduling,omitempty"`
+	// StartupScript is run by the guest environment every time
+	// the virtual machine boots. See:
+	// https://cloud.google.com/compute/docs/startupscript
+	StartupScript *VirtualMachineScriptSource `json:"startupScript,omitempty"`
+	// UserData is passed to cloud-init when the virtual machine
+	// first boots
+	UserData *VirtualMachineScriptSource `json:"userData,omitempty"`
+	// Metadata are additional instance metadata items. The keys
+	// the operator manages, ssh-keys, startup-script and
+	// user-data, may not be set. See:
+	// https://cloud.google.com/compute/docs/storing-retrieving-metadata
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Labels are GCE labels to set on the instance and its disks.
+	// Keys and values must follow GCE label syntax. See:
+	// https://cloud.google.com/compute/docs/labeling-resources
+	Labels map[string]string `json:"labels,omitempty"`
+	// NetworkTags are network tags to set on the instance, which
+	// firewall rules and routes may apply to. See:
+	// https://cloud.google.com/vpc/docs/add-remove-network-tags
+	NetworkTags []string `json:"networkTags,omitempty"`
+	// Network configures the network interface of the instance
+	Network *VirtualMachineNetworkSpec `json:"network,omitempty"`
+}
+
+// VirtualMachineNetworkSpec configures the network the instance is
+// attached to and how it may be reached
+type VirtualMachineNetworkSpec struct {
+	// Network is the name or URL of the network to attach to,
+	// the default network if unset
+	Network string `json:"network,omitempty"`
+	// Subnetwork is the name or URL of the subnetwork to attach
+	// to, which custom-mode networks require. Names refer to a
+	// subnetwork in the region of the instance.
+	Subnetwork string `json:"subnetwork,omitempty"`
+	// ExternalAccess determines whether, and with which address,
+	// the instance is reachable from outside of its network
+	ExternalAccess VirtualMachineExternalAccess `json:"externalAccess,omitempty"`
+	// StaticAddress is a reserved external IP address in the
+	// region of the instance, used when ExternalAccess is Static
+	StaticAddress string `json:"staticAddress,omitempty"`
+	// SSHAddress determines which address of the instance the
+	// connection details in the Secret use
+	SSHAddress VirtualMachineAddressType `json:"sshAddress,omitempty"`
+}
+
+// VirtualMachineExternalAccess identifies how an instance is
+// reachable from outside of its network
+type VirtualMachineExternalAccess string
+
+const (
+	// VirtualMachineExternalAccessEphemeral gives the instance an
+	// ephemeral external IP address, and is the default
+	VirtualMachineExternalAccessEphemeral VirtualMachineExternalAccess = "Ephemeral"
+	// VirtualMachineExternalAccessStatic gives the instance the
+	// reserved StaticAddress as its external IP address
+	VirtualMachineExternalAccessStatic VirtualMachineExternalAccess = "Static"
+	// VirtualMachineExternalAccessNone gives the instance no
+	// external IP address, so it is reachable only internally
+	VirtualMachineExternalAccessNone VirtualMachineExternalAccess = "None"
+)
+
+// VirtualMachineAddressType identifies an address of an instance
+type VirtualMachineAddressType string
+
+const (
+	// VirtualMachineAddressExternal is the external IP address of
+	// the instance, and is the default unless it has none
+	VirtualMachineAddressExternal VirtualMachineAddressType = "External"
+	// VirtualMachineAddressInternal is the IP address of the
+	// instance in its network
+	VirtualMachineAddressInternal VirtualMachineAddressType = "Internal"
+)
+
+// VirtualMachineScriptSource provides content for the virtual machine,
+// either inline or from a key of a ConfigMap or Secret in the namespace
+// of the virtual machine. Exactly one source must be set.
+type VirtualMachineScriptSource struct {
+	// Inline is the content itself
+	Inline string `json:"inline,omitempty"`
+	// ConfigMapKeyRef selects a key of a ConfigMap holding the content
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+	// SecretKeyRef selects a key of a Secret holding the content
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// VirtualMachineScheduling configures how the instance is scheduled. See:
+// https://cloud.google.com/compute/docs/instances/preemptible
+type VirtualMachineScheduling struct {
+	// Preemptible instances are cheaper, but may be stopped by
+	// GCE at any time and live for at most 24 hours
+	Preemptible bool `json:"preemptible,omitempty"`
+	// OnHostMaintenance determines whether the instance is
+	// migrated or terminated when its host undergoes maintenance.
+	// Preemptible instances are always terminated.
+	OnHostMaintenance VirtualMachineMaintenancePolicy `json:"onHostMaintenance,omitempty"`
+	// AutomaticRestart determines whether GCE restarts the
+	// instance when it is terminated for reasons other than
+	// preemption. Preemptible instances are never restarted.
+	AutomaticRestart *bool `json:"automaticRestart,omitempty"`
+	// RestartPolicy determines what the controller does when
+	// a preemptible instance is preempted
+	RestartPolicy VirtualMachineRestartPolicy `json:"restartPolicy,omitempty"`
+}
+
+// VirtualMachineMaintenancePolicy identifies the GCE behavior
+// when the host of an instance undergoes maintenance
+type VirtualMachineMaintenancePolicy string
+
+const (
+	VirtualMachineMaintenancePolicyMigrate   VirtualMachineMaintenancePolicy = "MIGRATE"
+	VirtualMachineMaintenancePolicyTerminate VirtualMachineMaintenancePolicy = "TERMINATE"
+)
+
+// VirtualMachineRestartPolicy identifies what the controller does
+// when the instance of a virtual machine is preempted
+type VirtualMachineRestartPolicy string
+
+const (
+	// VirtualMachineRestartPolicyNever marks the virtual machine
+	// as failed when its instance is preempted
+	VirtualMachineRestartPolicyNever VirtualMachineRestartPolicy = "Never"
+	// VirtualMachineRestartPolicyRecreate replaces a preempted
+	// instance with a new one, and publishes a new Secret for it
+	VirtualMachineRestartPolicyRecreate VirtualMachineRestartPolicy = "Recreate"
+)
+
+// VirtualMachineBinding identifies an object in the namespace of the
+// virtual machine. The virtual machine is deleted when the object is
+// deleted or, for Pods, when the Pod has run to completion. An object
+// that has not been observed yet, and is not identified by UID, may not
+// have been created yet, so its absence does not delete the virtual
+// machine.
+type VirtualMachineBinding struct {
+	// APIVersion is the group and version of the object
+	APIVersion string `json:"apiVersion"`
+	// Kind is the kind of the object
+	Kind string `json:"kind"`
+	// Name is the name of the object
+	Name string `json:"name"`
+	// UID optionally pins the binding to one incarnation of the
+	// object, so that the virtual machine is deleted even if an
+	// object with the same name is created in its place
+	UID types.UID `json:"uid,omitempty"`
+}
+
+// VirtualMachineLeaseSpec describes the lease consumers must hold
+// on a virtual machine to keep it alive. The lease is renewed by
+// setting the LeaseRenewTimeAnnotation to the current time.
+type VirtualMachineLeaseSpec struct {
+	// DurationSeconds is how long after the lease was last
+	// renewed, or after creation if it never was, that the
+	// virtual machine is deleted
+	DurationSeconds int64 `json:"durationSeconds"`
 }
 
 type VirtualMachineBootDiskSpec struct {
@@ -75,11 +255,128 @@ type VirtualMachineDiskSpec struct {
 
 // VirtualMachineStatus is the status for a VirtualMachine resource
 type VirtualMachineStatus struct {
+	// ObservedGeneration is the most recent generation of the
+	// VirtualMachine that the controller has acted upon
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions describe the progress of the VirtualMachine
+	// through its lifecycle
+	Conditions []VirtualMachineCondition `json:"conditions,omitempty"`
+	// InstanceName is the name of the instance backing the
+	// virtual machine in the cloud provider
+	InstanceName string `json:"instanceName,omitempty"`
+	// Zone is the zone the virtual machine was provisioned in
+	Zone string `json:"zone,omitempty"`
+	// ExpiresAt is when the virtual machine will be deleted,
+	// considering the requested TTL, expiry and lease as well
+	// as the maximum lifetime the operator allows
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// Preemptions counts the times the instance was preempted
+	Preemptions int32 `json:"preemptions,omitempty"`
+	// SSHRecreations counts the times the instance was replaced
+	// because it could not be reached over SSH
+	SSHRecreations int32 `json:"sshRecreations,omitempty"`
+	// BoundUID is the UID of the object the virtual machine is
+	// bound to, once the controller has observed it
+	BoundUID types.UID `json:"boundUid,omitempty"`
+	// ZoneAttempts records the zones in which provisioning failed
+	// for lack of capacity, in the order they were attempted
+	ZoneAttempts []ZoneAttempt `json:"zoneAttempts,omitempty"`
+	// InstanceID is the unique identifier the cloud provider
+	// assigned to the instance
+	InstanceID string `json:"instanceId,omitempty"`
+	// InternalIP is the address of the instance in its network
+	InternalIP string `json:"internalIP,omitempty"`
+	// ExternalIP is the address of the instance outside of its
+	// network, if it has one
+	ExternalIP string `json:"externalIP,omitempty"`
+	// MachineType is the machine type of the instance, as
+	// resolved by the cloud provider
+	MachineType string `json:"machineType,omitempty"`
+	// Image is the image the boot disk of the instance was
+	// created from, as resolved by the cloud provider
+	Image string `json:"image,omitempty"`
+	// InstanceCreationTimestamp is when the cloud provider
+	// created the instance
+	InstanceCreationTimestamp *metav1.Time `json:"instanceCreationTimestamp,omitempty"`
+	// Operation is the cloud provider operation that is in
+	// progress for the virtual machine, if any
+	Operation *VirtualMachineOperation `json:"operation,omitempty"`
+
 	State     ProcessingState        `json:"state"`
 	SelfLink  string                 `json:"selfLink"`
 	SecretRef corev1.ObjectReference `json:"secretRef"`
 }
 
+// VirtualMachineOperation identifies an operation that is running
+// in the cloud provider on behalf of the VirtualMachine
+type VirtualMachineOperation struct {
+	// Name identifies the operation in the cloud provider
+	Name string `json:"name"`
+	// Zone is the zone the operation runs in
+	Zone string `json:"zone"`
+	// Type is the kind of operation, such as insert or delete
+	Type string `json:"type"`
+	// StartTime is when the operation was started
+	StartTime metav1.Time `json:"startTime"`
+}
+
+// VirtualMachineConditionType identifies an aspect of the
+// VirtualMachine lifecycle
+type VirtualMachineConditionType string
+
+const (
+	// VirtualMachineInstanceCreated is true when the instance
+	// exists in the cloud provider
+	VirtualMachineInstanceCreated VirtualMachineConditionType = "InstanceCreated"
+	// VirtualMachineSSHReachable is true when the controller
+	// has connected to the instance over SSH
+	VirtualMachineSSHReachable VirtualMachineConditionType = "SSHReachable"
+	// VirtualMachineSecretPublished is true when the Secret
+	// holding connection details has been created
+	VirtualMachineSecretPublished VirtualMachineConditionType = "SecretPublished"
+	// VirtualMachineReady is true when the instance can be
+	// used by consumers of the connection Secret
+	VirtualMachineReady VirtualMachineConditionType = "Ready"
+	// VirtualMachineDeleting is true while the instance is
+	// being torn down
+	VirtualMachineDeleting VirtualMachineConditionType = "Deleting"
+	// VirtualMachineExpiring is true when the virtual machine
+	// is about to be deleted as it reaches its expiry
+	VirtualMachineExpiring VirtualMachineConditionType = "Expiring"
+)
+
+// VirtualMachineCondition describes the state of one aspect of
+// the VirtualMachine at a point in time
+type VirtualMachineCondition struct {
+	// Type is the aspect of the VirtualMachine described
+	Type VirtualMachineConditionType `json:"type"`
+	// Status is one of True, False or Unknown
+	Status corev1.ConditionStatus `json:"status"`
+	// ObservedGeneration is the generation of the VirtualMachine
+	// that the condition was determined from
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LastTransitionTime is the last time the condition changed
+	// from one status to another
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Reason is a machine-readable explanation for the status
+	Reason string `json:"reason,omitempty"`
+	// Message is a human-readable explanation for the status
+	Message string `json:"message,omitempty"`
+}
+
+// ZoneAttempt records a failed attempt to provision the virtual
+// machine in a zone
+type ZoneAttempt struct {
+	// Zone is the zone that was attempted
+	Zone string `json:"zone"`
+	// Time is when the attempt failed
+	Time metav1.Time `json:"time"`
+	// Reason is the error code returned by the cloud provider
+	Reason string `json:"reason,omitempty"`
+	// Message is the error message returned by the cloud provider
+	Message string `json:"message,omitempty"`
+}
+
 type ProcessingPhase string
 
 const (
@@ -21,6 +21,8 @@ limitations under the License.
 package v1alpha1
 
 import (
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -46,7 +48,7 @@ func (in *VirtualMachine) DeepCopyInto(out *VirtualMachine) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 	return
 }
 
@@ -68,6 +70,22 @@ func (in *VirtualMachine) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineBinding) DeepCopyInto(out *VirtualMachineBinding) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineBinding.
+func (in *VirtualMachineBinding) DeepCopy() *VirtualMachineBinding {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineBinding)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineBootDiskSpec) DeepCopyInto(out *VirtualMachineBootDiskSpec) {
 	*out = *in
@@ -85,6 +103,23 @@ func (in *VirtualMachineBootDiskSpec) DeepCopy() *VirtualMachineBootDiskSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineCondition) DeepCopyInto(out *VirtualMachineCondition) {
+	*out = *in
+	in.LastTransitionTime.DeepCopyInto(&out.LastTransitionTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineCondition.
+func (in *VirtualMachineCondition) DeepCopy() *VirtualMachineCondition {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineCondition)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineDiskSpec) DeepCopyInto(out *VirtualMachineDiskSpec) {
 	*out = *in
@@ -101,6 +136,22 @@ func (in *VirtualMachineDiskSpec) DeepCopy() *VirtualMachineDiskSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineLeaseSpec) DeepCopyInto(out *VirtualMachineLeaseSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineLeaseSpec.
+func (in *VirtualMachineLeaseSpec) DeepCopy() *VirtualMachineLeaseSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineLeaseSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineList) DeepCopyInto(out *VirtualMachineList) {
 	*out = *in
@@ -134,6 +185,86 @@ func (in *VirtualMachineList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineNetworkSpec) DeepCopyInto(out *VirtualMachineNetworkSpec) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineNetworkSpec.
+func (in *VirtualMachineNetworkSpec) DeepCopy() *VirtualMachineNetworkSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineNetworkSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineOperation) DeepCopyInto(out *VirtualMachineOperation) {
+	*out = *in
+	in.StartTime.DeepCopyInto(&out.StartTime)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineOperation.
+func (in *VirtualMachineOperation) DeepCopy() *VirtualMachineOperation {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineOperation)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScheduling) DeepCopyInto(out *VirtualMachineScheduling) {
+	*out = *in
+	if in.AutomaticRestart != nil {
+		in, out := &in.AutomaticRestart, &out.AutomaticRestart
+		*out = new(bool)
+		**out = **in
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScheduling.
+func (in *VirtualMachineScheduling) DeepCopy() *VirtualMachineScheduling {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScheduling)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VirtualMachineScriptSource) DeepCopyInto(out *VirtualMachineScriptSource) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(v1.ConfigMapKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(v1.SecretKeySelector)
+		(*in).DeepCopyInto(*out)
+	}
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VirtualMachineScriptSource.
+func (in *VirtualMachineScriptSource) DeepCopy() *VirtualMachineScriptSource {
+	if in == nil {
+		return nil
+	}
+	out := new(VirtualMachineScriptSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 	*out = *in
@@ -143,6 +274,64 @@ func (in *VirtualMachineSpec) DeepCopyInto(out *VirtualMachineSpec) {
 		*out = make([]VirtualMachineDiskSpec, len(*in))
 		copy(*out, *in)
 	}
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(meta_v1.Duration)
+		**out = **in
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.Lease != nil {
+		in, out := &in.Lease, &out.Lease
+		*out = new(VirtualMachineLeaseSpec)
+		**out = **in
+	}
+	if in.BoundTo != nil {
+		in, out := &in.BoundTo, &out.BoundTo
+		*out = new(VirtualMachineBinding)
+		**out = **in
+	}
+	if in.Scheduling != nil {
+		in, out := &in.Scheduling, &out.Scheduling
+		*out = new(VirtualMachineScheduling)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.StartupScript != nil {
+		in, out := &in.StartupScript, &out.StartupScript
+		*out = new(VirtualMachineScriptSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.UserData != nil {
+		in, out := &in.UserData, &out.UserData
+		*out = new(VirtualMachineScriptSource)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Metadata != nil {
+		in, out := &in.Metadata, &out.Metadata
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.NetworkTags != nil {
+		in, out := &in.NetworkTags, &out.NetworkTags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Network != nil {
+		in, out := &in.Network, &out.Network
+		*out = new(VirtualMachineNetworkSpec)
+		**out = **in
+	}
 	return
 }
 
@@ -159,6 +348,33 @@ func (in *VirtualMachineSpec) DeepCopy() *VirtualMachineSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VirtualMachineStatus) DeepCopyInto(out *VirtualMachineStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]VirtualMachineCondition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ExpiresAt != nil {
+		in, out := &in.ExpiresAt, &out.ExpiresAt
+		*out = (*in).DeepCopy()
+	}
+	if in.ZoneAttempts != nil {
+		in, out := &in.ZoneAttempts, &out.ZoneAttempts
+		*out = make([]ZoneAttempt, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.InstanceCreationTimestamp != nil {
+		in, out := &in.InstanceCreationTimestamp, &out.InstanceCreationTimestamp
+		*out = (*in).DeepCopy()
+	}
+	if in.Operation != nil {
+		in, out := &in.Operation, &out.Operation
+		*out = new(VirtualMachineOperation)
+		(*in).DeepCopyInto(*out)
+	}
 	out.State = in.State
 	out.SecretRef = in.SecretRef
 	return
@@ -173,3 +389,20 @@ func (in *VirtualMachineStatus) DeepCopy() *VirtualMachineStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ZoneAttempt) DeepCopyInto(out *ZoneAttempt) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ZoneAttempt.
+func (in *ZoneAttempt) DeepCopy() *ZoneAttempt {
+	if in == nil {
+		return nil
+	}
+	out := new(ZoneAttempt)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,270 @@
+package validation
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// MaxMetadataValueBytes is the largest value GCE accepts
+	// for a single instance metadata item
+	MaxMetadataValueBytes = 256 * 1024
+	// MaxMetadataBytes is the largest total size GCE accepts
+	// for all instance metadata
+	MaxMetadataBytes = 512 * 1024
+	// MaxLabels is the most labels GCE accepts on a resource
+	MaxLabels = 64
+	// MaxNetworkTags is the most network tags GCE accepts
+	// on an instance
+	MaxNetworkTags = 64
+)
+
+var (
+	// metadataKeyPattern matches the keys GCE accepts for
+	// instance metadata items
+	metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9-_]{1,128}$`)
+	// labelKeyPattern and labelValuePattern match the keys and
+	// values GCE accepts for labels
+	labelKeyPattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,62}$`)
+	labelValuePattern = regexp.MustCompile(`^[a-z0-9_-]{0,63}$`)
+	// networkTagPattern matches the network tags GCE accepts
+	networkTagPattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+	// reservedMetadataKeys are managed by the operator and may
+	// not be set through the metadata of the spec
+	reservedMetadataKeys = sets.NewString("ssh-keys", "startup-script", "user-data")
+)
+
+// ValidateVirtualMachineSpec validates the spec of a VirtualMachine
+// that is being created.
+func ValidateVirtualMachineSpec(spec *vmapi.VirtualMachineSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	metadataBytes := 0
+	for _, script := range []struct {
+		name   string
+		source *vmapi.VirtualMachineScriptSource
+	}{
+		{name: "startupScript", source: spec.StartupScript},
+		{name: "userData", source: spec.UserData},
+	} {
+		if script.source == nil {
+			continue
+		}
+		allErrs = append(allErrs, validateScriptSource(script.source, fldPath.Child(script.name))...)
+		metadataBytes += len(script.source.Inline)
+	}
+	for _, key := range sets.StringKeySet(spec.Metadata).List() {
+		value := spec.Metadata[key]
+		keyPath := fldPath.Child("metadata").Key(key)
+		if !metadataKeyPattern.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(keyPath, key, "must consist of at most 128 alphanumeric characters, dashes or underscores"))
+		}
+		if reservedMetadataKeys.Has(key) {
+			allErrs = append(allErrs, field.Forbidden(keyPath, "is managed by the operator"))
+		}
+		if len(value) > MaxMetadataValueBytes {
+			allErrs = append(allErrs, field.TooLong(keyPath, len(value), MaxMetadataValueBytes))
+		}
+		metadataBytes += len(key) + len(value)
+	}
+	if metadataBytes > MaxMetadataBytes {
+		allErrs = append(allErrs, field.TooLong(fldPath, metadataBytes, MaxMetadataBytes))
+	}
+
+	if len(spec.Labels) > MaxLabels {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("labels"), len(spec.Labels), fmt.Sprintf("must have at most %d items", MaxLabels)))
+	}
+	for _, key := range sets.StringKeySet(spec.Labels).List() {
+		keyPath := fldPath.Child("labels").Key(key)
+		if !labelKeyPattern.MatchString(key) {
+			allErrs = append(allErrs, field.Invalid(keyPath, key, "must start with a lowercase letter and consist of at most 63 lowercase letters, digits, dashes or underscores"))
+		}
+		if value := spec.Labels[key]; !labelValuePattern.MatchString(value) {
+			allErrs = append(allErrs, field.Invalid(keyPath, value, "must consist of at most 63 lowercase letters, digits, dashes or underscores"))
+		}
+	}
+
+	if len(spec.NetworkTags) > MaxNetworkTags {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("networkTags"), len(spec.NetworkTags), fmt.Sprintf("must have at most %d items", MaxNetworkTags)))
+	}
+	for i, tag := range spec.NetworkTags {
+		if !networkTagPattern.MatchString(tag) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("networkTags").Index(i), tag, "must be a lowercase RFC 1035 label of at most 63 characters"))
+		}
+	}
+
+	if spec.Network != nil {
+		allErrs = append(allErrs, validateNetwork(spec.Network, fldPath.Child("network"))...)
+	}
+
+	if spec.TTL != nil && spec.TTL.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("ttl"), spec.TTL.Duration.String(), "must be positive"))
+	}
+	if spec.ExpiresAt != nil && !spec.ExpiresAt.After(time.Now()) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("expiresAt"), spec.ExpiresAt.UTC().Format(time.RFC3339), "must be in the future"))
+	}
+	if spec.Lease != nil && spec.Lease.DurationSeconds <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("lease", "durationSeconds"), spec.Lease.DurationSeconds, "must be positive"))
+	}
+	if spec.BoundTo != nil {
+		allErrs = append(allErrs, validateBinding(spec.BoundTo, fldPath.Child("boundTo"))...)
+	}
+	if spec.Scheduling != nil {
+		allErrs = append(allErrs, validateScheduling(spec.Scheduling, fldPath.Child("scheduling"))...)
+	}
+	return allErrs
+}
+
+// ValidateZone ensures that the zone or region the spec requests is one
+// of the zones of the provider. Region is ignored when a zone is given,
+// so it is not validated in that case.
+func ValidateZone(spec *vmapi.VirtualMachineSpec, zones []provider.Zone, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	names, regions := sets.NewString(), sets.NewString()
+	for _, zone := range zones {
+		names.Insert(zone.Name)
+		regions.Insert(zone.Region)
+	}
+	switch {
+	case spec.Zone != "":
+		if !names.Has(spec.Zone) {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("zone"), spec.Zone, names.List()))
+		}
+	case spec.Region != "":
+		if !regions.Has(spec.Region) {
+			allErrs = append(allErrs, field.NotSupported(fldPath.Child("region"), spec.Region, regions.List()))
+		}
+	}
+	return allErrs
+}
+
+// validateBinding ensures that the bound object is fully identified.
+func validateBinding(binding *vmapi.VirtualMachineBinding, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if binding.APIVersion == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("apiVersion"), ""))
+	} else if _, err := schema.ParseGroupVersion(binding.APIVersion); err != nil {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("apiVersion"), binding.APIVersion, err.Error()))
+	}
+	if binding.Kind == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("kind"), ""))
+	}
+	if binding.Name == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("name"), ""))
+	}
+	return allErrs
+}
+
+// validateScheduling ensures that the policies are known and consistent
+// with the instance being preemptible, as GCE always terminates and never
+// restarts preemptible instances.
+func validateScheduling(scheduling *vmapi.VirtualMachineScheduling, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch scheduling.OnHostMaintenance {
+	case "", vmapi.VirtualMachineMaintenancePolicyTerminate:
+	case vmapi.VirtualMachineMaintenancePolicyMigrate:
+		if scheduling.Preemptible {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("onHostMaintenance"), scheduling.OnHostMaintenance, "preemptible instances cannot be migrated"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("onHostMaintenance"), scheduling.OnHostMaintenance, []string{
+			string(vmapi.VirtualMachineMaintenancePolicyMigrate),
+			string(vmapi.VirtualMachineMaintenancePolicyTerminate),
+		}))
+	}
+	if scheduling.Preemptible && scheduling.AutomaticRestart != nil && *scheduling.AutomaticRestart {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("automaticRestart"), true, "preemptible instances cannot be restarted automatically"))
+	}
+
+	switch scheduling.RestartPolicy {
+	case "", vmapi.VirtualMachineRestartPolicyNever, vmapi.VirtualMachineRestartPolicyRecreate:
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("restartPolicy"), scheduling.RestartPolicy, []string{
+			string(vmapi.VirtualMachineRestartPolicyNever),
+			string(vmapi.VirtualMachineRestartPolicyRecreate),
+		}))
+	}
+	return allErrs
+}
+
+// validateNetwork ensures that the external access and SSH address
+// of the network configuration are consistent.
+func validateNetwork(network *vmapi.VirtualMachineNetworkSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	switch network.ExternalAccess {
+	case "", vmapi.VirtualMachineExternalAccessEphemeral, vmapi.VirtualMachineExternalAccessNone:
+		if network.StaticAddress != "" {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("staticAddress"), "may only be set when externalAccess is Static"))
+		}
+	case vmapi.VirtualMachineExternalAccessStatic:
+		if network.StaticAddress == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("staticAddress"), "must be set when externalAccess is Static"))
+		} else if net.ParseIP(network.StaticAddress) == nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("staticAddress"), network.StaticAddress, "must be an IP address"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("externalAccess"), network.ExternalAccess, []string{
+			string(vmapi.VirtualMachineExternalAccessEphemeral),
+			string(vmapi.VirtualMachineExternalAccessStatic),
+			string(vmapi.VirtualMachineExternalAccessNone),
+		}))
+	}
+
+	switch network.SSHAddress {
+	case "", vmapi.VirtualMachineAddressInternal:
+	case vmapi.VirtualMachineAddressExternal:
+		if network.ExternalAccess == vmapi.VirtualMachineExternalAccessNone {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("sshAddress"), network.SSHAddress, "instances without external access have no external address"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("sshAddress"), network.SSHAddress, []string{
+			string(vmapi.VirtualMachineAddressExternal),
+			string(vmapi.VirtualMachineAddressInternal),
+		}))
+	}
+	return allErrs
+}
+
+// validateScriptSource ensures that exactly one source of content is
+// given and that inline content fits in a metadata item.
+func validateScriptSource(source *vmapi.VirtualMachineScriptSource, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	sources := 0
+	if source.Inline != "" {
+		sources++
+		if len(source.Inline) > MaxMetadataValueBytes {
+			allErrs = append(allErrs, field.TooLong(fldPath.Child("inline"), len(source.Inline), MaxMetadataValueBytes))
+		}
+	}
+	if ref := source.ConfigMapKeyRef; ref != nil {
+		sources++
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("configMapKeyRef", "name"), ""))
+		}
+		if ref.Key == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("configMapKeyRef", "key"), ""))
+		}
+	}
+	if ref := source.SecretKeyRef; ref != nil {
+		sources++
+		if ref.Name == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("secretKeyRef", "name"), ""))
+		}
+		if ref.Key == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("secretKeyRef", "key"), ""))
+		}
+	}
+	if sources != 1 {
+		allErrs = append(allErrs, field.Invalid(fldPath, source, "exactly one of inline, configMapKeyRef or secretKeyRef must be set"))
+	}
+	return allErrs
+}
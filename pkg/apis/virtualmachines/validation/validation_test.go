@@ -0,0 +1,192 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// fieldsOf lists the fields the errors are about.
+func fieldsOf(errs field.ErrorList) []string {
+	var fields []string
+	for _, err := range errs {
+		fields = append(fields, err.Field)
+	}
+	return fields
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func TestValidateZone(t *testing.T) {
+	zones := []provider.Zone{
+		{Name: "us-east1-b", Region: "us-east1"},
+		{Name: "us-east1-c", Region: "us-east1"},
+		{Name: "europe-west1-b", Region: "europe-west1"},
+	}
+
+	var testCases = []struct {
+		name     string
+		spec     vmapi.VirtualMachineSpec
+		expected []string
+	}{
+		{
+			name: "neither zone nor region",
+		},
+		{
+			name: "known zone",
+			spec: vmapi.VirtualMachineSpec{Zone: "us-east1-c"},
+		},
+		{
+			name: "known region",
+			spec: vmapi.VirtualMachineSpec{Region: "europe-west1"},
+		},
+		{
+			name:     "unknown zone",
+			spec:     vmapi.VirtualMachineSpec{Zone: "us-east1-z"},
+			expected: []string{"spec.zone"},
+		},
+		{
+			name:     "unknown region",
+			spec:     vmapi.VirtualMachineSpec{Region: "mars-north1"},
+			expected: []string{"spec.region"},
+		},
+		{
+			name: "region is ignored when a zone is given",
+			spec: vmapi.VirtualMachineSpec{Zone: "us-east1-b", Region: "mars-north1"},
+		},
+		{
+			name:     "unknown zone with a known region",
+			spec:     vmapi.VirtualMachineSpec{Zone: "europe-west1-z", Region: "europe-west1"},
+			expected: []string{"spec.zone"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			errs := ValidateZone(&testCase.spec, zones, field.NewPath("spec"))
+			if actual := fieldsOf(errs); !reflect.DeepEqual(actual, testCase.expected) {
+				t.Errorf("expected errors for %v, got %v", testCase.expected, errs)
+			}
+		})
+	}
+}
+
+func TestValidateVirtualMachineSpec(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		spec     vmapi.VirtualMachineSpec
+		expected []string
+	}{
+		{
+			name: "empty spec",
+		},
+		{
+			name: "positive ttl",
+			spec: vmapi.VirtualMachineSpec{TTL: &meta.Duration{Duration: time.Hour}},
+		},
+		{
+			name:     "zero ttl",
+			spec:     vmapi.VirtualMachineSpec{TTL: &meta.Duration{}},
+			expected: []string{"spec.ttl"},
+		},
+		{
+			name:     "negative ttl",
+			spec:     vmapi.VirtualMachineSpec{TTL: &meta.Duration{Duration: -time.Hour}},
+			expected: []string{"spec.ttl"},
+		},
+		{
+			name: "expiry in the future",
+			spec: vmapi.VirtualMachineSpec{ExpiresAt: &meta.Time{Time: time.Now().Add(time.Hour)}},
+		},
+		{
+			name:     "expiry in the past",
+			spec:     vmapi.VirtualMachineSpec{ExpiresAt: &meta.Time{Time: time.Now().Add(-time.Hour)}},
+			expected: []string{"spec.expiresAt"},
+		},
+		{
+			name: "lease with a duration",
+			spec: vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}},
+		},
+		{
+			name:     "lease without a duration",
+			spec:     vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{}},
+			expected: []string{"spec.lease.durationSeconds"},
+		},
+		{
+			name:     "lease with a negative duration",
+			spec:     vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: -60}},
+			expected: []string{"spec.lease.durationSeconds"},
+		},
+		{
+			name: "bound to a pod",
+			spec: vmapi.VirtualMachineSpec{BoundTo: &vmapi.VirtualMachineBinding{APIVersion: "v1", Kind: "Pod", Name: "test"}},
+		},
+		{
+			name: "bound to an object of a group",
+			spec: vmapi.VirtualMachineSpec{BoundTo: &vmapi.VirtualMachineBinding{APIVersion: "batch/v1", Kind: "Job", Name: "test", UID: "uid"}},
+		},
+		{
+			name:     "bound to an object that is not identified",
+			spec:     vmapi.VirtualMachineSpec{BoundTo: &vmapi.VirtualMachineBinding{}},
+			expected: []string{"spec.boundTo.apiVersion", "spec.boundTo.kind", "spec.boundTo.name"},
+		},
+		{
+			name:     "bound to an object with an invalid apiVersion",
+			spec:     vmapi.VirtualMachineSpec{BoundTo: &vmapi.VirtualMachineBinding{APIVersion: "batch/v1/beta", Kind: "Job", Name: "test"}},
+			expected: []string{"spec.boundTo.apiVersion"},
+		},
+		{
+			name: "preemptible and recreated",
+			spec: vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{
+				Preemptible:       true,
+				OnHostMaintenance: vmapi.VirtualMachineMaintenancePolicyTerminate,
+				AutomaticRestart:  boolPtr(false),
+				RestartPolicy:     vmapi.VirtualMachineRestartPolicyRecreate,
+			}},
+		},
+		{
+			name: "migrated and restarted",
+			spec: vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{
+				OnHostMaintenance: vmapi.VirtualMachineMaintenancePolicyMigrate,
+				AutomaticRestart:  boolPtr(true),
+			}},
+		},
+		{
+			name:     "preemptible and migrated",
+			spec:     vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{Preemptible: true, OnHostMaintenance: vmapi.VirtualMachineMaintenancePolicyMigrate}},
+			expected: []string{"spec.scheduling.onHostMaintenance"},
+		},
+		{
+			name:     "unknown maintenance policy",
+			spec:     vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{OnHostMaintenance: "Reboot"}},
+			expected: []string{"spec.scheduling.onHostMaintenance"},
+		},
+		{
+			name:     "preemptible and restarted",
+			spec:     vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{Preemptible: true, AutomaticRestart: boolPtr(true)}},
+			expected: []string{"spec.scheduling.automaticRestart"},
+		},
+		{
+			name:     "unknown restart policy",
+			spec:     vmapi.VirtualMachineSpec{Scheduling: &vmapi.VirtualMachineScheduling{Preemptible: true, RestartPolicy: "Always"}},
+			expected: []string{"spec.scheduling.restartPolicy"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			errs := ValidateVirtualMachineSpec(&testCase.spec, field.NewPath("spec"))
+			if actual := fieldsOf(errs); !reflect.DeepEqual(actual, testCase.expected) {
+				t.Errorf("expected errors for %v, got %v", testCase.expected, errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+const (
+	// boundObjectPollInterval is how often the object a VM is bound
+	// to is checked on, as bound objects are not watched
+	boundObjectPollInterval = 15 * time.Second
+)
+
+// reapIfUnbound deletes the VirtualMachine once the object it is bound
+// to has been deleted or, for Pods, has run to completion. Returns true
+// if the VirtualMachine was deleted.
+func (c *Controller) reapIfUnbound(vm *vmapi.VirtualMachine, logger *logrus.Entry) (bool, error) {
+	binding := vm.Spec.BoundTo
+	if binding == nil {
+		return false, nil
+	}
+	logger = logger.WithFields(logrus.Fields{
+		"bound-kind": binding.Kind,
+		"bound-name": binding.Name,
+	})
+
+	uid := binding.UID
+	if uid == "" {
+		uid = vm.Status.BoundUID
+	}
+	observed, reason, err := c.observeBound(vm.Namespace, binding, uid)
+	if err != nil {
+		logger.WithError(err).Error("could not determine if bound object exists")
+		return false, fmt.Errorf("could not determine if bound object exists: %v", err)
+	}
+	if reason == "" {
+		if observed == "" {
+			logger.Debug("bound object does not exist yet")
+		} else if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+			status.BoundUID = observed
+		}); err != nil {
+			return false, fmt.Errorf("could not update status: %v", err)
+		}
+		c.enqueueAfter(vm, boundObjectPollInterval)
+		return false, nil
+	}
+
+	logger.WithField("reason", reason).Info("deleting unbound virtual machine")
+	c.recorder.Eventf(vm, coreapi.EventTypeNormal, "Unbound", "Deleting VirtualMachine as %s %s %s", binding.Kind, binding.Name, reason)
+	if err := c.deleteVirtualMachine(vm); err != nil {
+		return false, fmt.Errorf("could not delete unbound virtual machine: %v", err)
+	}
+	return true, nil
+}
+
+// observeBound looks up the object the VM is bound to, expecting it to
+// have the given UID if one is known. The UID of the object is returned
+// if it is alive, and the reason why the binding no longer holds if not.
+// If neither is returned, the object has not been created yet.
+func (c *Controller) observeBound(namespace string, binding *vmapi.VirtualMachineBinding, uid types.UID) (types.UID, string, error) {
+	var object meta.Object
+	if binding.APIVersion == "v1" && binding.Kind == "Pod" {
+		pod, err := c.kubeClient.CoreV1().Pods(namespace).Get(binding.Name, meta.GetOptions{})
+		switch {
+		case kerrors.IsNotFound(err):
+		case err != nil:
+			return "", "", err
+		case uid != "" && pod.UID != uid:
+			return "", "was replaced", nil
+		case pod.Status.Phase == coreapi.PodSucceeded || pod.Status.Phase == coreapi.PodFailed:
+			return "", fmt.Sprintf("has %s", pod.Status.Phase), nil
+		default:
+			object = pod
+		}
+	} else {
+		bound, err := c.getObject(namespace, binding)
+		if err != nil && !kerrors.IsNotFound(err) {
+			return "", "", err
+		}
+		if err == nil {
+			object = bound
+		}
+	}
+
+	switch {
+	case object == nil && uid == "":
+		return "", "", nil
+	case object == nil:
+		return "", "was deleted", nil
+	case uid != "" && object.GetUID() != uid:
+		return "", "was replaced", nil
+	default:
+		return object.GetUID(), "", nil
+	}
+}
+
+// getObject fetches an arbitrary bound object, resolving the resource
+// that serves its kind through discovery.
+func (c *Controller) getObject(namespace string, binding *vmapi.VirtualMachineBinding) (meta.Object, error) {
+	gv, err := schema.ParseGroupVersion(binding.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apiVersion: %v", err)
+	}
+	gvk := gv.WithKind(binding.Kind)
+	mapping, err := c.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine the resource that serves %s: %v", gvk, err)
+	}
+	client, err := c.dynamicClients.ClientForGroupVersionKind(gvk)
+	if err != nil {
+		return nil, fmt.Errorf("could not create client for %s: %v", gvk, err)
+	}
+
+	resource := &meta.APIResource{
+		Name:       mapping.Resource,
+		Kind:       gvk.Kind,
+		Namespaced: mapping.Scope.Name() == apimeta.RESTScopeNameNamespace,
+	}
+	if !resource.Namespaced {
+		namespace = ""
+	}
+	object, err := client.Resource(resource, namespace).Get(binding.Name, meta.GetOptions{})
+	if kerrors.IsForbidden(err) {
+		return nil, fmt.Errorf("the operator may not get %s: %v", mapping.Resource, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clientgotesting "k8s.io/client-go/testing"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+func testPod(uid types.UID, phase coreapi.PodPhase) *coreapi.Pod {
+	return &coreapi.Pod{
+		ObjectMeta: meta.ObjectMeta{Name: "bound", Namespace: namespace, UID: uid},
+		Status:     coreapi.PodStatus{Phase: phase},
+	}
+}
+
+// serveJobs serves the Job with the UID through the dynamic clients, or
+// no Job if the UID is empty.
+func (f *fixture) serveJobs(uid types.UID) {
+	f.mapper.Add(schema.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"}, apimeta.RESTScopeNamespace)
+	f.dynamicClients.AddReactor("get", "jobs", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		name := action.(clientgotesting.GetAction).GetName()
+		if uid == "" {
+			return true, nil, kerrors.NewNotFound(schema.GroupResource{Group: "batch", Resource: "jobs"}, name)
+		}
+		job := &unstructured.Unstructured{}
+		job.SetAPIVersion("batch/v1")
+		job.SetKind("Job")
+		job.SetNamespace(action.GetNamespace())
+		job.SetName(name)
+		job.SetUID(uid)
+		return true, job, nil
+	})
+}
+
+func TestObserveBound(t *testing.T) {
+	pod := &vmapi.VirtualMachineBinding{APIVersion: "v1", Kind: "Pod", Name: "bound"}
+	job := &vmapi.VirtualMachineBinding{APIVersion: "batch/v1", Kind: "Job", Name: "bound"}
+
+	var testCases = []struct {
+		name        string
+		binding     *vmapi.VirtualMachineBinding
+		pod         *coreapi.Pod
+		jobUID      types.UID
+		uid         types.UID
+		observed    types.UID
+		reason      string
+		expectedErr bool
+	}{
+		{
+			name:     "running pod",
+			binding:  pod,
+			pod:      testPod("pod-uid", coreapi.PodRunning),
+			observed: "pod-uid",
+		},
+		{
+			name:     "pending pod with the expected UID",
+			binding:  pod,
+			pod:      testPod("pod-uid", coreapi.PodPending),
+			uid:      "pod-uid",
+			observed: "pod-uid",
+		},
+		{
+			name:    "succeeded pod",
+			binding: pod,
+			pod:     testPod("pod-uid", coreapi.PodSucceeded),
+			reason:  "has Succeeded",
+		},
+		{
+			name:    "failed pod",
+			binding: pod,
+			pod:     testPod("pod-uid", coreapi.PodFailed),
+			uid:     "pod-uid",
+			reason:  "has Failed",
+		},
+		{
+			name:    "replaced pod",
+			binding: pod,
+			pod:     testPod("new-uid", coreapi.PodRunning),
+			uid:     "pod-uid",
+			reason:  "was replaced",
+		},
+		{
+			name:    "pod not created yet",
+			binding: pod,
+		},
+		{
+			name:    "deleted pod",
+			binding: pod,
+			uid:     "pod-uid",
+			reason:  "was deleted",
+		},
+		{
+			name:     "job",
+			binding:  job,
+			jobUID:   "job-uid",
+			observed: "job-uid",
+		},
+		{
+			name:    "replaced job",
+			binding: job,
+			jobUID:  "new-uid",
+			uid:     "job-uid",
+			reason:  "was replaced",
+		},
+		{
+			name:    "deleted job",
+			binding: job,
+			uid:     "job-uid",
+			reason:  "was deleted",
+		},
+		{
+			name:        "kind that is not served",
+			binding:     &vmapi.VirtualMachineBinding{APIVersion: "example.com/v1", Kind: "Widget", Name: "bound"},
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := newFixture(t, testConfig(), fake.Config{})
+			defer f.close()
+			if testCase.pod != nil {
+				if _, err := f.kubeClient.CoreV1().Pods(namespace).Create(testCase.pod); err != nil {
+					t.Fatalf("could not create pod: %v", err)
+				}
+			}
+			f.serveJobs(testCase.jobUID)
+
+			observed, reason, err := f.controller.observeBound(namespace, testCase.binding, testCase.uid)
+			if testCase.expectedErr != (err != nil) {
+				t.Fatalf("expected an error: %v, got %v", testCase.expectedErr, err)
+			}
+			if observed != testCase.observed || reason != testCase.reason {
+				t.Errorf("expected %q, %q, got %q, %q", testCase.observed, testCase.reason, observed, reason)
+			}
+		})
+	}
+}
+
+func TestReapIfUnbound(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	pod, err := f.kubeClient.CoreV1().Pods(namespace).Create(testPod("pod-uid", coreapi.PodRunning))
+	if err != nil {
+		t.Fatalf("could not create pod: %v", err)
+	}
+	vm := testVM("vm")
+	vm.Spec.BoundTo = &vmapi.VirtualMachineBinding{APIVersion: "v1", Kind: "Pod", Name: pod.Name}
+	f.create(t, vm)
+
+	if reaped, err := f.controller.reapIfUnbound(f.get(t, "vm"), f.controller.logger); err != nil || reaped {
+		t.Fatalf("expected the VM to be kept while the pod runs, got %v, %v", reaped, err)
+	}
+	if vm = f.get(t, "vm"); vm.Status.BoundUID != pod.UID {
+		t.Errorf("expected the UID of the pod to be recorded, got %q", vm.Status.BoundUID)
+	}
+
+	pod.Status.Phase = coreapi.PodSucceeded
+	if _, err := f.kubeClient.CoreV1().Pods(namespace).Update(pod); err != nil {
+		t.Fatalf("could not update pod: %v", err)
+	}
+	if reaped, err := f.controller.reapIfUnbound(vm, f.controller.logger); err != nil || !reaped {
+		t.Fatalf("expected the VM to be deleted once the pod succeeded, got %v, %v", reaped, err)
+	}
+	if _, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Get("vm", meta.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the VM to be deleted, got %v", err)
+	}
+	if events := f.events(); len(events) != 1 || !strings.Contains(events[0], "Unbound") {
+		t.Errorf("expected an Unbound event, got %v", events)
+	}
+}
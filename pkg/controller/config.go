@@ -1,34 +1,214 @@
 package controller
 
-type GCPZone string
-
-const (
-	GCPZoneUSEast1b    GCPZone = "us-east1-b"
-	GCPZoneUSEast1c            = "us-east1-c"
-	GCPZoneUSEast1d            = "us-east1-d"
-	GCPZoneUSEast4c            = "us-east4-c"
-	GCPZoneUSEast4b            = "us-east4-b"
-	GCPZoneUSEast4a            = "us-east4-a"
-	GCPZoneUSCentral1c         = "us-central1-c"
-	GCPZoneUSCentral1a         = "us-central1-a"
-	GCPZoneUSCentral1f         = "us-central1-f"
-	GCPZoneUSCentral1b         = "us-central1-b"
-	GCPZoneUSWest1b            = "us-west1-b"
-	GCPZoneUSWest1c            = "us-west1-c"
-	GCPZoneUSWest1a            = "us-west1-a"
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/aws"
+	"github.com/openshift/ci-vm-operator/pkg/provider/docker"
+	"github.com/openshift/ci-vm-operator/pkg/provider/kubevirt"
+	"github.com/openshift/ci-vm-operator/pkg/provider/libvirt"
 )
 
 // Configuration holds global configuration for launching
-// virtual machines in GCE.
+// virtual machines.
 type Configuration struct {
-	Project string  `json:"project"`
-	Zone    GCPZone `json:"zone"`
+	// Provider is the name of the provider virtual machines
+	// are launched with; GCE is used if unset
+	Provider string `json:"provider,omitempty"`
+	Project  string `json:"project"`
+	// Docker configures the docker provider
+	Docker docker.Config `json:"docker"`
+	// Libvirt configures the libvirt provider
+	Libvirt libvirt.Config `json:"libvirt"`
+	// Kubevirt configures the kubevirt provider
+	Kubevirt kubevirt.Config `json:"kubevirt"`
+	// AWS configures the aws provider
+	AWS aws.Config `json:"aws"`
+	// OperatorID identifies the instances created by this
+	// operator, distinguishing them from those of other
+	// operators launching instances in the same project
+	OperatorID string `json:"operatorId,omitempty"`
+	// Zone is the default zone for virtual machines that
+	// do not request a zone or region
+	Zone string `json:"zone"`
+	// FallbackZones are the zones, in order of preference, to
+	// try when provisioning in the default zone fails for lack
+	// of capacity
+	FallbackZones []string `json:"fallbackZones,omitempty"`
 
 	SSHConnectionConfig SSHConnectionConfig `json:"sshConnectionConfig"`
+
+	// GarbageCollection configures the collection of instances
+	// that no VirtualMachine owns
+	GarbageCollection GarbageCollectionConfig `json:"garbageCollection"`
+
+	// LabelPropagation configures which details of a
+	// VirtualMachine are copied onto the labels of its instance
+	LabelPropagation LabelPropagationConfig `json:"labelPropagation"`
+
+	// MaxLifetimeSeconds is the longest a VirtualMachine may live
+	// before it is deleted; lifetimes are unbounded if unset
+	MaxLifetimeSeconds int `json:"maxLifetimeSeconds,omitempty"`
+	// ExpiryWarningSeconds is how long before a VirtualMachine
+	// expires that a warning is issued
+	ExpiryWarningSeconds int `json:"expiryWarningSeconds,omitempty"`
+}
+
+// LabelPropagationConfig configures which details of a VirtualMachine
+// are copied onto the GCE labels of its instance and disks, for instance
+// to attribute the cost of instances. Keys and values are sanitized to
+// GCE label syntax.
+type LabelPropagationConfig struct {
+	// Namespace copies the namespace of the VirtualMachine
+	// onto the namespace label
+	Namespace bool `json:"namespace"`
+	// Labels are the keys of labels of the VirtualMachine to copy
+	Labels []string `json:"labels,omitempty"`
+	// Annotations are the keys of annotations of the
+	// VirtualMachine to copy
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// GarbageCollectionConfig configures the periodic deletion of instances
+// created by this operator that no VirtualMachine owns.
+type GarbageCollectionConfig struct {
+	// IntervalSeconds is the period between collections;
+	// collection is disabled if it is unset
+	IntervalSeconds int `json:"intervalSeconds"`
+	// GracePeriodSeconds is the minimum age of an instance
+	// before it is considered to be orphaned
+	GracePeriodSeconds int `json:"gracePeriodSeconds"`
+	// DryRun reports orphaned instances without deleting them
+	DryRun bool `json:"dryRun"`
+	// Zones are searched for orphaned instances; all zones
+	// of the provider are searched if unset
+	Zones []string `json:"zones,omitempty"`
 }
 
 type SSHConnectionConfig struct {
 	Retries        int `json:"retries"`
 	DelaySeconds   int `json:"delaySeconds"`
 	TimeoutSeconds int `json:"timeoutSeconds"`
+
+	// VerifyHostKeys enables verification of the host keys
+	// instances report out of band, such as on their serial
+	// console. It must only be enabled if every image reports
+	// its host keys, as instances that do not are never reached.
+	VerifyHostKeys bool `json:"verifyHostKeys,omitempty"`
+	// KnownHostsPath is where consumers mount the known_hosts file
+	// of the connection secret, as referenced by its ssh_config;
+	// relative paths are resolved against the working directory of
+	// the ssh client
+	KnownHostsPath string `json:"knownHostsPath,omitempty"`
+	// MaxRecreations is how often the instance of a VirtualMachine
+	// that cannot be reached over SSH is replaced before the
+	// VirtualMachine is marked as failed
+	MaxRecreations int `json:"maxRecreations,omitempty"`
+}
+
+// Default fills in the zone of providers that have only one, such as
+// the docker provider, so that it need not be repeated in the
+// configuration.
+func (c *Configuration) Default(zones []provider.Zone) {
+	if c.Zone == "" && len(zones) == 1 {
+		c.Zone = zones[0].Name
+	}
+}
+
+// Validate ensures that the zones the configuration names are zones of
+// the provider, so that a misconfiguration is reported at startup rather
+// than when virtual machines fail to be provisioned.
+func (c Configuration) Validate(zones []provider.Zone) error {
+	if c.Zone == "" {
+		return errors.New("zone must be set")
+	}
+	if !isKnownZone(zones, c.Zone) {
+		return fmt.Errorf("zone %q is not supported by the provider", c.Zone)
+	}
+	for _, zone := range c.FallbackZones {
+		if !isKnownZone(zones, zone) {
+			return fmt.Errorf("fallback zone %q is not supported by the provider", zone)
+		}
+	}
+	for _, zone := range c.GarbageCollection.Zones {
+		if !isKnownZone(zones, zone) {
+			return fmt.Errorf("garbage collection zone %q is not supported by the provider", zone)
+		}
+	}
+	return nil
+}
+
+// chooseZone determines the zone a virtual machine should be provisioned
+// in first.
+func (c Configuration) chooseZone(vm *vmapi.VirtualMachine, zones []provider.Zone) (string, error) {
+	candidates, err := c.candidateZones(vm, zones)
+	if err != nil {
+		return "", err
+	}
+	return candidates[0], nil
+}
+
+// candidateZones lists, in order of preference, the zones of the provider
+// a virtual machine may be provisioned in. When only a region is
+// requested, the first zone is chosen deterministically from the UID of
+// the virtual machine so that load is spread across the region.
+func (c Configuration) candidateZones(vm *vmapi.VirtualMachine, zones []provider.Zone) ([]string, error) {
+	if vm.Spec.Zone != "" {
+		if !isKnownZone(zones, vm.Spec.Zone) {
+			return nil, fmt.Errorf("zone %q is not supported", vm.Spec.Zone)
+		}
+		return []string{vm.Spec.Zone}, nil
+	}
+
+	if vm.Spec.Region != "" {
+		inRegion := zonesInRegion(zones, vm.Spec.Region)
+		if len(inRegion) == 0 {
+			return nil, fmt.Errorf("region %q is not supported", vm.Spec.Region)
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(vm.UID))
+		first := int(hash.Sum32() % uint32(len(inRegion)))
+		var candidates []string
+		for i := range inRegion {
+			candidates = append(candidates, inRegion[(first+i)%len(inRegion)])
+		}
+		return candidates, nil
+	}
+
+	candidates := []string{c.Zone}
+	seen := sets.NewString(c.Zone)
+	for _, zone := range c.FallbackZones {
+		if !seen.Has(zone) {
+			seen.Insert(zone)
+			candidates = append(candidates, zone)
+		}
+	}
+	return candidates, nil
+}
+
+// isKnownZone determines if the zone is one the provider provisions in.
+func isKnownZone(zones []provider.Zone, zone string) bool {
+	for _, known := range zones {
+		if known.Name == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// zonesInRegion lists the names of the zones in the region.
+func zonesInRegion(zones []provider.Zone, region string) []string {
+	var names []string
+	for _, zone := range zones {
+		if zone.Region == region {
+			names = append(names, zone.Name)
+		}
+	}
+	return names
 }
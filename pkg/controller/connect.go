@@ -0,0 +1,123 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	coreapi "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// pendingConnection holds the key pair for the instance of a VM, and the
+// parameters the instance is created with, until the operator has
+// connected to the instance and has published the connection secret.
+// It is staged in a secret so that it survives restarts of the operator.
+type pendingConnection struct {
+	user string
+	pem  string
+	pub  string
+
+	// zone and instance are the zone and parameters of the
+	// instance to create, if it is to be created
+	zone     string
+	instance *provider.InstanceSpec
+
+	// attempts counts the failed attempts to connect
+	attempts int
+}
+
+// newPendingConnection creates a new key pair for a VM.
+func newPendingConnection(logger *logrus.Entry) (*pendingConnection, error) {
+	logger.Info("creating SSH keypair")
+	pem, pub, err := newSSHKeypair()
+	if err != nil {
+		return nil, fmt.Errorf("could not create SSH keypair for VM: %v", err)
+	}
+	return &pendingConnection{user: "cloud-user", pem: pem, pub: pub}, nil
+}
+
+// hasSSHKey determines if the public key is installed on the instance.
+func hasSSHKey(instance *provider.Instance, publicKey string) bool {
+	for _, key := range instance.AuthorizedKeys {
+		if key == strings.TrimSpace(publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// connect attempts to connect to the instance of the VM with the pending
+// key pair, and publishes the connection secret once it succeeds. Rather
+// than blocking the worker, failed attempts are retried after a delay
+// until the configured number of attempts is exhausted.
+func (c *Controller) connect(vm *vmapi.VirtualMachine, zone string, instance *provider.Instance, connection *pendingConnection, logger *logrus.Entry) error {
+	sshConfig := c.config.SSHConnectionConfig
+	instanceHostname, err := sshAddressFor(vm, instance)
+	if err != nil {
+		logger.WithError(err).Error("failed to determine address of VM")
+		return c.handleError(vm, reasonNoAddress, err)
+	}
+
+	var hostKeys []ssh.PublicKey
+	var sshErr error
+	if sshConfig.VerifyHostKeys {
+		hostKeys, sshErr = c.hostKeysFor(zone, instance.Name)
+	}
+	if sshErr == nil {
+		logger.Info("attempting SSH connection to VM")
+		sshErr = dialSSH(c.dial, sshConfig, instanceHostname, connection.user, connection.pem, hostKeys, logger)
+	}
+	if sshErr != nil {
+		connection.attempts++
+		if connection.attempts < sshConfig.Retries {
+			logger.WithError(sshErr).WithField("attempt", connection.attempts).Info("could not connect to VM over SSH yet")
+			if err := c.stageConnection(vm, connection); err != nil {
+				return err
+			}
+			c.enqueueAfter(vm, time.Duration(sshConfig.DelaySeconds)*time.Second)
+			return nil
+		}
+		logger.WithError(sshErr).Warning("could not connect to VM over SSH")
+		return c.handleSSHFailure(vm, zone, fmt.Errorf("could not connect to VM over SSH in %d attempts: %v", connection.attempts, sshErr), logger)
+	}
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSSHReachable, coreapi.ConditionTrue, reasonConnected, "")
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+
+	logger.Info("uploading SSH keypair to cluster")
+	if err := c.publishSecret(vm, &coreapi.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            vm.Name,
+			Namespace:       vm.Namespace,
+			OwnerReferences: ownerReferences(vm),
+		},
+		StringData: connectionDetails(sshConfig, vm.Name, instanceHostname, connection.user, connection.pem, connection.pub, hostKeys),
+	}); err != nil {
+		logger.WithError(err).Error("error creating SSH secret")
+		return fmt.Errorf("could not create SSH secret: %v", err)
+	}
+	if err := c.clearStagedConnection(vm); err != nil {
+		return err
+	}
+
+	return c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.SecretRef = coreapi.ObjectReference{
+			Kind:      "Secret",
+			Namespace: vm.Namespace,
+			Name:      vm.Name,
+		}
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSecretPublished, coreapi.ConditionTrue, reasonPublished, "")
+		status.State.ProcessingPhase = vmapi.ProcessingPhaseProvisioned
+		status.State.Message = ""
+		setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionTrue, reasonProvisioned, "")
+	})
+}
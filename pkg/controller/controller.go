@@ -2,15 +2,19 @@ package controller
 
 import (
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/sirupsen/logrus"
 
+	coreapi "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	kubeclientset "k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/tools/cache"
@@ -18,10 +22,12 @@ import (
 	"k8s.io/client-go/util/workqueue"
 
 	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	vmscheme "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned/scheme"
 	vmclient "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned/typed/virtualmachines/v1alpha1"
 	vminformers "github.com/openshift/ci-vm-operator/pkg/client/informers/externalversions/virtualmachines/v1alpha1"
 	vmlisters "github.com/openshift/ci-vm-operator/pkg/client/listers/virtualmachines/v1alpha1"
 	"github.com/openshift/ci-vm-operator/pkg/metrics"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
 )
 
 const (
@@ -36,7 +42,7 @@ const (
 )
 
 // NewController returns a new *Controller to use with virtual machines.
-func New(config Configuration, informer vminformers.VirtualMachineInformer, client vmclient.VirtualMachinesGetter, kubeClient kubeclientset.Interface, gceClient GCEClient) *Controller {
+func New(config Configuration, informer vminformers.VirtualMachineInformer, client vmclient.VirtualMachinesGetter, kubeClient kubeclientset.Interface, dynamicClients dynamic.ClientPool, mapper apimeta.RESTMapper, cloud provider.Provider) *Controller {
 	logger := logrus.WithField("controller", controllerName)
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(logger.Infof)
@@ -50,14 +56,18 @@ func New(config Configuration, informer vminformers.VirtualMachineInformer, clie
 	}
 
 	c := &Controller{
-		config:     config,
-		client:     client,
-		kubeClient: kubeClient,
-		gceClient:  gceClient,
-		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), controllerName),
-		logger:     logger,
-		lister:     informer.Lister(),
-		synced:     informer.Informer().HasSynced,
+		config:         config,
+		client:         client,
+		kubeClient:     kubeClient,
+		dynamicClients: dynamicClients,
+		mapper:         mapper,
+		provider:       cloud,
+		dial:           net.DialTimeout,
+		recorder:       eventBroadcaster.NewRecorder(vmscheme.Scheme, coreapi.EventSource{Component: controllerName}),
+		queue:          workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), controllerName),
+		logger:         logger,
+		lister:         informer.Lister(),
+		synced:         informer.Informer().HasSynced,
 	}
 
 	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -75,7 +85,19 @@ type Controller struct {
 
 	client     vmclient.VirtualMachinesGetter
 	kubeClient kubeclientset.Interface
-	gceClient  GCEClient
+	provider   provider.Provider
+	recorder   record.EventRecorder
+	// dial opens the connections to instances
+	// that SSH is attempted over
+	dial dialFunc
+
+	// dynamicClients and mapper look up the objects
+	// VirtualMachines are bound to, whatever their kind
+	dynamicClients dynamic.ClientPool
+	mapper         apimeta.RESTMapper
+	// renewals remembers invalid lease renewals that
+	// have already been warned about
+	renewals renewalCache
 
 	lister vmlisters.VirtualMachineLister
 	queue  workqueue.RateLimitingInterface
@@ -133,6 +155,11 @@ func (c *Controller) Run(workers int, stopCh <-chan struct{}) {
 		go wait.Until(c.worker, time.Second, stopCh)
 	}
 
+	if interval := c.config.GarbageCollection.IntervalSeconds; interval > 0 {
+		c.logger.Infof("collecting orphaned instances every %ds", interval)
+		go wait.Until(c.collectOrphans, time.Duration(interval)*time.Second, stopCh)
+	}
+
 	<-stopCh
 }
 
@@ -146,6 +173,17 @@ func (c *Controller) enqueue(vm metav1.Object) {
 	c.queue.Add(key)
 }
 
+// enqueueAfter queues the VM to be reconciled once the duration passes.
+func (c *Controller) enqueueAfter(vm metav1.Object, duration time.Duration) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(vm)
+	if err != nil {
+		utilruntime.HandleError(fmt.Errorf("couldn't get key for object %#v: %v", vm, err))
+		return
+	}
+
+	c.queue.AddAfter(key, duration)
+}
+
 // worker runs a worker thread that just dequeues items, processes them, and marks them done.
 // It enforces that the syncHandler is never invoked concurrently with the same key.
 func (c *Controller) worker() {
@@ -213,10 +251,15 @@ func (c *Controller) reconcile(key string) error {
 			return nil
 		}
 		logger.Info("reconciling virtual machine causes deletion")
-		if err := c.deleteVM(vm); err != nil {
+		deleted, err := c.deleteVM(vm)
+		if err != nil {
 			logger.Errorf("error deleting virtual machine: %v", err)
 			return err
 		}
+		if !deleted {
+			logger.Info("virtual machine deletion in progress")
+			return nil
+		}
 
 		logger.Info("virtual machine deletion successful, removing finalizer")
 		finalizers := sets.NewString(vm.ObjectMeta.Finalizers...)
@@ -229,6 +272,13 @@ func (c *Controller) reconcile(key string) error {
 		return nil
 	}
 
+	if reaped, err := c.reapIfExpired(vm, logger); err != nil || reaped {
+		return err
+	}
+	if reaped, err := c.reapIfUnbound(vm, logger); err != nil || reaped {
+		return err
+	}
+
 	logger.Info("reconciling virtual machine causes creation")
 	return c.ensureVM(vm)
 }
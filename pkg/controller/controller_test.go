@@ -0,0 +1,708 @@
+package controller
+
+import (
+	"crypto/rand"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+
+	coreapi "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	vmscheme "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned/scheme"
+	vmclient "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned/typed/virtualmachines/v1alpha1"
+	vmclientfake "github.com/openshift/ci-vm-operator/pkg/client/clientset/versioned/typed/virtualmachines/v1alpha1/fake"
+	vminformers "github.com/openshift/ci-vm-operator/pkg/client/informers/externalversions"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+const (
+	project   = "ci-project"
+	namespace = "ci"
+
+	// maxReconciles bounds the passes a VM may take to
+	// settle, as the queue would otherwise requeue it
+	maxReconciles = 20
+)
+
+// fixture runs the controller against the fake compute API, with fake
+// clients for the cluster and an SSH server that every instance dials
+// through to.
+type fixture struct {
+	controller *Controller
+	server     *fake.Server
+	vmClient   *vmClientset
+	kubeClient *kubefake.Clientset
+	recorder   *record.FakeRecorder
+	// dynamicClients and mapper serve the objects VMs
+	// are bound to, other than Pods
+	dynamicClients *dynamicfake.FakeClientPool
+	mapper         *apimeta.DefaultRESTMapper
+	// informer caches the VirtualMachines the controller lists
+	informer cache.SharedIndexInformer
+
+	api *httptest.Server
+	ssh net.Listener
+
+	lock sync.Mutex
+	// dialed are the addresses SSH was attempted on
+	dialed []string
+	// requests are the methods and paths of the requests
+	// made to the compute API
+	requests []string
+}
+
+// vmClientset serves VirtualMachines from an object tracker. It stands in
+// for the generated fake clientset, which copies the lock of the fake when
+// it is constructed.
+type vmClientset struct {
+	clientgotesting.Fake
+}
+
+func newVMClientset() *vmClientset {
+	tracker := clientgotesting.NewObjectTracker(vmscheme.Scheme, vmscheme.Codecs.UniversalDecoder())
+	c := &vmClientset{}
+	c.AddReactor("*", "*", clientgotesting.ObjectReaction(tracker))
+	c.AddWatchReactor("*", func(action clientgotesting.Action) (bool, watch.Interface, error) {
+		watcher, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		return true, watcher, err
+	})
+	return c
+}
+
+func (c *vmClientset) Discovery() discovery.DiscoveryInterface {
+	return &fakediscovery.FakeDiscovery{Fake: &c.Fake}
+}
+
+func (c *vmClientset) CiV1alpha1() vmclient.CiV1alpha1Interface {
+	return &vmclientfake.FakeCiV1alpha1{Fake: &c.Fake}
+}
+
+func (c *vmClientset) Ci() vmclient.CiV1alpha1Interface {
+	return c.CiV1alpha1()
+}
+
+func newFixture(t *testing.T, config Configuration, serverConfig fake.Config) *fixture {
+	f := &fixture{
+		server:         fake.NewServer(serverConfig),
+		vmClient:       newVMClientset(),
+		kubeClient:     kubefake.NewSimpleClientset(),
+		recorder:       record.NewFakeRecorder(100),
+		dynamicClients: &dynamicfake.FakeClientPool{},
+		mapper:         apimeta.NewDefaultRESTMapper(nil, dynamic.VersionInterfaces),
+	}
+	// the API server fills in the data of secrets from their string
+	// data; the string data is kept, as callers reuse the object when
+	// the secret already exists
+	for _, verb := range []string{"create", "update"} {
+		f.kubeClient.PrependReactor(verb, "secrets", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+			secret := action.(clientgotesting.CreateAction).GetObject().(*coreapi.Secret)
+			if secret.StringData != nil {
+				secret.Data = map[string][]byte{}
+				for key, value := range secret.StringData {
+					secret.Data[key] = []byte(value)
+				}
+			}
+			return false, nil, nil
+		})
+	}
+
+	f.api = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+		f.lock.Unlock()
+		f.server.ServeHTTP(w, r)
+	}))
+	client, err := gce.NewClient(f.api.URL)
+	if err != nil {
+		t.Fatalf("could not create client: %v", err)
+	}
+	f.ssh = serveSSH(t)
+
+	informer := vminformers.NewSharedInformerFactory(f.vmClient, 0).Ci().V1alpha1().VirtualMachines()
+	f.informer = informer.Informer()
+	f.controller = New(config, informer, f.vmClient.CiV1alpha1(), f.kubeClient, f.dynamicClients, f.mapper, gce.New(project, client))
+	f.controller.recorder = f.recorder
+	f.controller.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		f.lock.Lock()
+		f.dialed = append(f.dialed, address)
+		f.lock.Unlock()
+		return net.DialTimeout(network, f.ssh.Addr().String(), timeout)
+	}
+	return f
+}
+
+func (f *fixture) close() {
+	f.controller.queue.ShutDown()
+	f.api.Close()
+	f.ssh.Close()
+}
+
+// inserts counts the requests made to insert instances.
+func (f *fixture) inserts() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var inserts int
+	for _, request := range f.requests {
+		if strings.HasPrefix(request, http.MethodPost+" ") && strings.HasSuffix(request, "/instances") {
+			inserts++
+		}
+	}
+	return inserts
+}
+
+// serveSSH accepts SSH connections with any key until the listener is
+// closed.
+func serveSSH(t *testing.T) net.Listener {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("could not create host key signer: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, channels, requests, err := ssh.NewServerConn(conn, config); err == nil {
+					go ssh.DiscardRequests(requests)
+					for channel := range channels {
+						channel.Reject(ssh.Prohibited, "no channels are served")
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func testConfig() Configuration {
+	return Configuration{
+		Project: project,
+		Zone:    "us-east1-b",
+		SSHConnectionConfig: SSHConnectionConfig{
+			Retries:        1,
+			TimeoutSeconds: 5,
+		},
+	}
+}
+
+func testVM(name string) *vmapi.VirtualMachine {
+	return &vmapi.VirtualMachine{
+		ObjectMeta: meta.ObjectMeta{
+			Name:       name,
+			Namespace:  namespace,
+			UID:        types.UID("uid-" + name),
+			Finalizers: []string{vmapi.VirtualMachineFinalizer},
+		},
+		Spec: vmapi.VirtualMachineSpec{
+			MachineType: vmapi.VirtualMachineTypeStandard2,
+			BootDisk: vmapi.VirtualMachineBootDiskSpec{
+				ImageFamily: "compute/v1/projects/centos-cloud/global/images/family/centos-7",
+				SizeGB:      20,
+				Type:        vmapi.VirtualMachineDiskTypePersistentStandard,
+			},
+		},
+	}
+}
+
+func (f *fixture) create(t *testing.T, vm *vmapi.VirtualMachine) {
+	if _, err := f.vmClient.CiV1alpha1().VirtualMachines(vm.Namespace).Create(vm); err != nil {
+		t.Fatalf("could not create VM: %v", err)
+	}
+}
+
+func (f *fixture) get(t *testing.T, name string) *vmapi.VirtualMachine {
+	vm, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Get(name, meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get VM: %v", err)
+	}
+	return vm
+}
+
+// reconcileUntil reconciles the VM until it satisfies the condition, as
+// the queue would while the VM waits on operations and connections.
+func (f *fixture) reconcileUntil(t *testing.T, name, description string, done func(vm *vmapi.VirtualMachine) bool) *vmapi.VirtualMachine {
+	var vm *vmapi.VirtualMachine
+	for i := 0; i < maxReconciles; i++ {
+		if err := f.controller.reconcile(namespace + "/" + name); err != nil {
+			t.Fatalf("unexpected error reconciling: %v", err)
+		}
+		vm = f.get(t, name)
+		if done(vm) {
+			return vm
+		}
+	}
+	t.Fatalf("VM was not %s after %d reconciles: %#v", description, maxReconciles, vm.Status)
+	return nil
+}
+
+func isReady(vm *vmapi.VirtualMachine) bool {
+	return isConditionTrue(vm.Status, vmapi.VirtualMachineReady)
+}
+
+// hasReadyReason determines if the VM is not ready for the reason.
+func hasReadyReason(reason string) func(vm *vmapi.VirtualMachine) bool {
+	return func(vm *vmapi.VirtualMachine) bool {
+		condition := getCondition(vm.Status, vmapi.VirtualMachineReady)
+		return condition != nil && condition.Status == coreapi.ConditionFalse && condition.Reason == reason
+	}
+}
+
+// events drains the events recorded so far.
+func (f *fixture) events() []string {
+	var events []string
+	for {
+		select {
+		case event := <-f.recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// connectionSecret returns the published connection secret of the VM.
+func (f *fixture) connectionSecret(t *testing.T, vm *vmapi.VirtualMachine) *coreapi.Secret {
+	secret, err := f.kubeClient.CoreV1().Secrets(namespace).Get(vm.Name, meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get connection secret: %v", err)
+	}
+	return secret
+}
+
+func TestCreateVM(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	f.create(t, testVM("vm"))
+
+	vm := f.reconcileUntil(t, "vm", "ready", isReady)
+	if vm.Status.Zone != "us-east1-b" || vm.Status.InstanceName == "" || vm.Status.ExternalIP == "" || vm.Status.Operation != nil {
+		t.Errorf("unexpected status: %#v", vm.Status)
+	}
+	if vm.Status.State.ProcessingPhase != vmapi.ProcessingPhaseProvisioned {
+		t.Errorf("expected the VM to be provisioned, got %q", vm.Status.State.ProcessingPhase)
+	}
+
+	instance, err := f.controller.provider.Get("us-east1-b", vm.Status.InstanceName)
+	if err != nil {
+		t.Fatalf("could not get instance: %v", err)
+	}
+	if !f.controller.ownedBy(instance, vm) {
+		t.Errorf("expected the instance to be labelled for the VM, got %v", instance.Labels)
+	}
+	if expected := []string{vm.Status.ExternalIP + ":22"}; len(f.dialed) != 1 || f.dialed[0] != expected[0] {
+		t.Errorf("expected SSH to be attempted on %v, got %v", expected, f.dialed)
+	}
+
+	secret := f.connectionSecret(t, vm)
+	if !ownsSecret(vm, secret) || !strings.Contains(string(secret.Data["ssh_config"]), vm.Status.ExternalIP) {
+		t.Errorf("expected the connection secret to be published, got %#v", secret)
+	}
+	if !hasSSHKey(instance, string(secret.Data["id_rsa.pub"])) {
+		t.Errorf("expected the published key to be installed, got %v", instance.AuthorizedKeys)
+	}
+	staging, err := f.kubeClient.CoreV1().Secrets(namespace).Get(stagingSecretName(vm), meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get staging secret: %v", err)
+	}
+	if len(staging.Data) != 0 {
+		t.Errorf("expected the staging secret to be emptied, got %v", staging.Data)
+	}
+
+	// a ready VM is left alone
+	if err := f.controller.reconcile(namespace + "/vm"); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	if again := f.get(t, "vm"); again.Status.Operation != nil || !isReady(again) || len(f.dialed) != 1 {
+		t.Errorf("expected the ready VM to be left alone, got %#v", again.Status)
+	}
+}
+
+func TestUnreachableVM(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	f.controller.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	f.create(t, testVM("vm"))
+
+	vm := f.reconcileUntil(t, "vm", "unreachable", hasReadyReason(reasonSSHUnreachable))
+	if vm.Status.State.ProcessingPhase != vmapi.ProcessingPhaseError {
+		t.Errorf("expected the VM to have failed, got %q", vm.Status.State.ProcessingPhase)
+	}
+	if _, err := f.kubeClient.CoreV1().Secrets(namespace).Get(vm.Name, meta.GetOptions{}); err == nil {
+		t.Error("expected no connection secret to be published")
+	}
+
+	// the staged key pair is abandoned once, along with the instance
+	var clears int
+	for _, action := range f.kubeClient.Actions() {
+		if update, ok := action.(clientgotesting.UpdateAction); ok {
+			if secret := update.GetObject().(*coreapi.Secret); secret.Name == stagingSecretName(vm) && len(secret.StringData) == 0 {
+				clears++
+			}
+		}
+	}
+	if clears != 1 {
+		t.Errorf("expected the staging secret to be emptied once, got %d updates", clears)
+	}
+}
+
+func TestCreateVMFallsBackToNextZone(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		exhausted []string
+		ready     bool
+		zone      string
+	}{
+		{
+			name:      "next zone has capacity",
+			exhausted: []string{"us-east1-b"},
+			ready:     true,
+			zone:      "us-east1-c",
+		},
+		{
+			name:      "all zones are exhausted",
+			exhausted: []string{"us-east1-b", "us-east1-c"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := testConfig()
+			config.FallbackZones = []string{"us-east1-c"}
+			f := newFixture(t, config, fake.Config{ExhaustedZones: testCase.exhausted})
+			defer f.close()
+			f.create(t, testVM("vm"))
+
+			var vm *vmapi.VirtualMachine
+			if testCase.ready {
+				vm = f.reconcileUntil(t, "vm", "ready", isReady)
+				if vm.Status.Zone != testCase.zone {
+					t.Errorf("expected the VM to be created in zone %s, got %s", testCase.zone, vm.Status.Zone)
+				}
+			} else {
+				vm = f.reconcileUntil(t, "vm", "out of zones", hasReadyReason(reasonZonesExhausted))
+				if vm.Status.State.ProcessingPhase != vmapi.ProcessingPhaseError {
+					t.Errorf("expected the VM to have failed, got %q", vm.Status.State.ProcessingPhase)
+				}
+
+				// the exhausted VM is not provisioned again
+				inserts := f.inserts()
+				if err := f.controller.reconcile(namespace + "/vm"); err != nil {
+					t.Fatalf("unexpected error reconciling: %v", err)
+				}
+				if again := f.get(t, "vm"); !reflect.DeepEqual(again.Status, vm.Status) {
+					t.Errorf("expected the status of the exhausted VM to be left alone, got %#v", again.Status)
+				}
+				if after := f.inserts(); after != inserts {
+					t.Errorf("expected no further instances to be inserted, got %d more", after-inserts)
+				}
+
+				// a changed spec is provisioned anew
+				vm.Generation++
+				if _, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Update(vm); err != nil {
+					t.Fatalf("could not update VM: %v", err)
+				}
+				if err := f.controller.reconcile(namespace + "/vm"); err != nil {
+					t.Fatalf("unexpected error reconciling: %v", err)
+				}
+				if after := f.inserts(); after != inserts+1 {
+					t.Errorf("expected the changed VM to be inserted again, got %d more inserts", after-inserts)
+				}
+			}
+
+			if len(vm.Status.ZoneAttempts) != len(testCase.exhausted) {
+				t.Fatalf("expected attempts in zones %v, got %#v", testCase.exhausted, vm.Status.ZoneAttempts)
+			}
+			for i, zone := range testCase.exhausted {
+				attempt := vm.Status.ZoneAttempts[i]
+				if attempt.Zone != zone || attempt.Reason != "ZONE_RESOURCE_POOL_EXHAUSTED" {
+					t.Errorf("expected an exhausted attempt in zone %s, got %#v", zone, attempt)
+				}
+			}
+		})
+	}
+}
+
+func TestPreemptedVM(t *testing.T) {
+	var testCases = []struct {
+		name          string
+		restartPolicy vmapi.VirtualMachineRestartPolicy
+		recreated     bool
+	}{
+		{
+			name: "marked as failed by default",
+		},
+		{
+			name:          "recreated when asked to",
+			restartPolicy: vmapi.VirtualMachineRestartPolicyRecreate,
+			recreated:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := newFixture(t, testConfig(), fake.Config{})
+			defer f.close()
+			vm := testVM("vm")
+			vm.Spec.Scheduling = &vmapi.VirtualMachineScheduling{Preemptible: true, RestartPolicy: testCase.restartPolicy}
+			f.create(t, vm)
+			vm = f.reconcileUntil(t, "vm", "ready", isReady)
+			published := f.connectionSecret(t, vm)
+
+			if err := f.server.Preempt(project, vm.Status.Zone, vm.Status.InstanceName); err != nil {
+				t.Fatalf("could not preempt instance: %v", err)
+			}
+			if testCase.recreated {
+				vm = f.reconcileUntil(t, "vm", "ready again", func(vm *vmapi.VirtualMachine) bool {
+					return vm.Status.Preemptions > 0 && isReady(vm)
+				})
+				secret := f.connectionSecret(t, vm)
+				if string(secret.Data["id_rsa"]) == string(published.Data["id_rsa"]) {
+					t.Error("expected a new key pair to be published for the new instance")
+				}
+				instance, err := f.controller.provider.Get(vm.Status.Zone, vm.Status.InstanceName)
+				if err != nil || instance.Terminated {
+					t.Errorf("expected the instance to be running, got %#v, %v", instance, err)
+				}
+			} else {
+				vm = f.reconcileUntil(t, "vm", "failed", hasReadyReason(reasonPreempted))
+				if secret := f.connectionSecret(t, vm); len(secret.Data) != 0 {
+					t.Errorf("expected the connection secret to be withdrawn, got %v", secret.Data)
+				}
+			}
+			if vm.Status.Preemptions != 1 {
+				t.Errorf("expected one preemption, got %d", vm.Status.Preemptions)
+			}
+			if events := len(f.recorder.Events); events == 0 {
+				t.Error("expected the preemption to be recorded as an event")
+			}
+		})
+	}
+}
+
+func TestDeleteVM(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	f.create(t, testVM("vm"))
+	vm := f.reconcileUntil(t, "vm", "ready", isReady)
+
+	now := meta.Now()
+	vm.DeletionTimestamp = &now
+	if _, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Update(vm); err != nil {
+		t.Fatalf("could not delete VM: %v", err)
+	}
+	vm = f.reconcileUntil(t, "vm", "finalized", func(vm *vmapi.VirtualMachine) bool {
+		return len(vm.Finalizers) == 0
+	})
+	if !isConditionTrue(vm.Status, vmapi.VirtualMachineDeleting) {
+		t.Errorf("expected the VM to be marked as deleting, got %#v", vm.Status.Conditions)
+	}
+	if _, err := f.controller.provider.Get(vm.Status.Zone, vm.Status.InstanceName); err != provider.ErrNotFound {
+		t.Errorf("expected the instance to be deleted, got %v", err)
+	}
+
+	// without the finalizer, the VM is left to be deleted
+	if err := f.controller.reconcile(namespace + "/vm"); err != nil {
+		t.Errorf("unexpected error reconciling: %v", err)
+	}
+}
+
+func TestMayAdopt(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		instance   *provider.Instance
+		annotation string
+		secret     *coreapi.Secret
+		expected   bool
+	}{
+		{
+			name:     "instance labelled for another VM",
+			instance: &provider.Instance{Name: "vm", Labels: map[string]string{labelUID: "other"}},
+			secret:   &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace, OwnerReferences: ownerReferences(testVM("vm"))}},
+		},
+		{
+			name:       "instance named in the annotation",
+			instance:   &provider.Instance{Name: "imported"},
+			annotation: "imported",
+			expected:   true,
+		},
+		{
+			name:       "instance named after the VM when another is named in the annotation",
+			instance:   &provider.Instance{Name: "vm"},
+			annotation: "imported",
+			secret:     &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace, OwnerReferences: ownerReferences(testVM("vm"))}},
+		},
+		{
+			name:     "instance named after the VM without a connection secret",
+			instance: &provider.Instance{Name: "vm"},
+		},
+		{
+			name:     "instance named after the VM with a connection secret of another owner",
+			instance: &provider.Instance{Name: "vm"},
+			secret:   &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace}},
+		},
+		{
+			name:     "instance created for the VM before it was labelled",
+			instance: &provider.Instance{Name: "vm"},
+			secret:   &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace, OwnerReferences: ownerReferences(testVM("vm"))}},
+			expected: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := newFixture(t, testConfig(), fake.Config{})
+			defer f.close()
+			vm := testVM("vm")
+			if testCase.annotation != "" {
+				vm.Annotations = map[string]string{AdoptInstanceAnnotation: testCase.annotation}
+			}
+			if testCase.secret != nil {
+				if _, err := f.kubeClient.CoreV1().Secrets(namespace).Create(testCase.secret); err != nil {
+					t.Fatalf("could not create secret: %v", err)
+				}
+			}
+
+			adoptable, err := f.controller.mayAdopt(testCase.instance, vm)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if adoptable != testCase.expected {
+				t.Errorf("expected adoption to be allowed: %v, got %v", testCase.expected, adoptable)
+			}
+		})
+	}
+}
+
+func TestMissingScript(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	vm := testVM("vm")
+	vm.Spec.StartupScript = &vmapi.VirtualMachineScriptSource{
+		ConfigMapKeyRef: &coreapi.ConfigMapKeySelector{
+			LocalObjectReference: coreapi.LocalObjectReference{Name: "scripts"},
+			Key:                  "startup.sh",
+		},
+	}
+	f.create(t, vm)
+
+	vm = f.reconcileUntil(t, "vm", "failed", hasReadyReason(reasonInvalidScript))
+	if vm.Status.State.ProcessingPhase != vmapi.ProcessingPhaseError {
+		t.Errorf("expected the VM to have failed, got %q", vm.Status.State.ProcessingPhase)
+	}
+
+	// until the configmap exists, the VM is left as it is
+	f.vmClient.ClearActions()
+	f.kubeClient.ClearActions()
+	if err := f.controller.reconcile(namespace + "/vm"); err != nil {
+		t.Fatalf("unexpected error reconciling: %v", err)
+	}
+	for _, action := range f.vmClient.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("expected the status of the VM to be left alone, got %#v", action)
+		}
+	}
+	for _, action := range f.kubeClient.Actions() {
+		if action.GetResource().Resource == "secrets" && action.GetVerb() != "get" {
+			t.Errorf("expected no key pair to be staged, got %#v", action)
+		}
+	}
+	if f.inserts() != 0 {
+		t.Errorf("expected no instance to be inserted, got %d inserts", f.inserts())
+	}
+
+	if _, err := f.kubeClient.CoreV1().ConfigMaps(namespace).Create(&coreapi.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Name: "scripts", Namespace: namespace},
+		Data:       map[string]string{"startup.sh": "#!/bin/bash"},
+	}); err != nil {
+		t.Fatalf("could not create configmap: %v", err)
+	}
+	f.reconcileUntil(t, "vm", "ready", isReady)
+}
+
+// failingDeletes fails the given number of deletions before passing
+// them on to the provider.
+type failingDeletes struct {
+	provider.Provider
+	failures int
+}
+
+func (p *failingDeletes) Delete(zone, name string) (*provider.Operation, error) {
+	if p.failures > 0 {
+		p.failures--
+		return nil, errors.New("backend error")
+	}
+	return p.Provider.Delete(zone, name)
+}
+
+func TestDeleteVMRetriesFailedDeletion(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	f.create(t, testVM("vm"))
+	vm := f.reconcileUntil(t, "vm", "ready", isReady)
+	f.controller.provider = &failingDeletes{Provider: f.controller.provider, failures: 1}
+
+	now := meta.Now()
+	vm.DeletionTimestamp = &now
+	if _, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Update(vm); err != nil {
+		t.Fatalf("could not delete VM: %v", err)
+	}
+	if err := f.controller.reconcile(namespace + "/vm"); err == nil {
+		t.Error("expected the failed deletion to be retried")
+	}
+	vm = f.get(t, "vm")
+	if len(vm.Finalizers) == 0 || !hasReadyReason(reasonDeletionFailed)(vm) {
+		t.Errorf("expected the finalizer to be kept after the failed deletion, got %v, %#v", vm.Finalizers, vm.Status.Conditions)
+	}
+
+	vm = f.reconcileUntil(t, "vm", "finalized", func(vm *vmapi.VirtualMachine) bool {
+		return len(vm.Finalizers) == 0
+	})
+	if _, err := f.controller.provider.Get(vm.Status.Zone, vm.Status.InstanceName); err != provider.ErrNotFound {
+		t.Errorf("expected the instance to be deleted, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/metrics"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// collectOrphans deletes instances created by this operator that no
+// VirtualMachine owns any longer, as happens when the finalizer of a
+// VirtualMachine is removed by hand or when the operator crashes before
+// recording the instance it created. Instances younger than the grace
+// period are spared, as their VirtualMachine may not be in our cache yet.
+func (c *Controller) collectOrphans() {
+	logger := c.logger.WithField("collector", "orphans")
+	logger.Debug("collecting orphaned instances")
+
+	vms, err := c.lister.List(labels.Everything())
+	if err != nil {
+		logger.WithError(err).Error("could not list virtual machines")
+		metrics.OrphanCollections.WithLabelValues("failed").Inc()
+		return
+	}
+	owners := sets.NewString()
+	for _, vm := range vms {
+		owners.Insert(sanitizeLabelValue(string(vm.UID)))
+	}
+
+	zones := c.config.GarbageCollection.Zones
+	if len(zones) == 0 {
+		for _, zone := range c.provider.Zones() {
+			zones = append(zones, zone.Name)
+		}
+	}
+	gracePeriod := time.Duration(c.config.GarbageCollection.GracePeriodSeconds) * time.Second
+	selector := map[string]string{labelOperator: sanitizeLabelValue(c.config.operatorID())}
+
+	result := "succeeded"
+	for _, zone := range zones {
+		zoneLogger := logger.WithField("zone", zone)
+		instances, err := c.provider.List(zone, selector)
+		if err != nil {
+			zoneLogger.WithError(err).Error("could not list instances")
+			result = "failed"
+			continue
+		}
+		for _, instance := range instances {
+			if owners.Has(instance.Labels[labelUID]) {
+				continue
+			}
+			if instance.Created.IsZero() {
+				zoneLogger.Warningf("could not determine age of instance %s", instance.Name)
+				continue
+			}
+			if time.Since(instance.Created) < gracePeriod {
+				continue
+			}
+			c.collectOrphan(zone, instance, zoneLogger.WithField("instance", instance.Name))
+		}
+	}
+	metrics.OrphanCollections.WithLabelValues(result).Inc()
+}
+
+// collectOrphan deletes the orphaned instance, or only reports it
+// when the collector is running in dry-run mode.
+func (c *Controller) collectOrphan(zone string, instance *provider.Instance, logger *logrus.Entry) {
+	// the owner no longer exists, but events recorded against
+	// it are still the best place to surface what happened
+	owner := &coreapi.ObjectReference{
+		APIVersion: vmapi.SchemeGroupVersion.String(),
+		Kind:       "VirtualMachine",
+		Namespace:  instance.Labels[labelNamespace],
+		Name:       instance.Labels[labelName],
+		UID:        types.UID(instance.Labels[labelUID]),
+	}
+
+	if c.config.GarbageCollection.DryRun {
+		logger.Warning("found orphaned VM")
+		c.recorder.Eventf(owner, coreapi.EventTypeWarning, "OrphanDetected", "Instance %s in zone %s has no owning VirtualMachine", instance.Name, zone)
+		metrics.OrphanedInstances.WithLabelValues(zone, metrics.OrphanActionReported).Inc()
+		return
+	}
+
+	logger.Info("deleting orphaned VM")
+	if _, err := c.provider.Delete(zone, instance.Name); err != nil {
+		logger.WithError(err).Error("failed to delete orphaned VM")
+		c.recorder.Eventf(owner, coreapi.EventTypeWarning, "OrphanDeletionFailed", "Could not delete instance %s in zone %s with no owning VirtualMachine: %v", instance.Name, zone, err)
+		metrics.OrphanedInstances.WithLabelValues(zone, metrics.OrphanActionFailed).Inc()
+		return
+	}
+	c.recorder.Eventf(owner, coreapi.EventTypeNormal, "OrphanDeleted", "Deleted instance %s in zone %s with no owning VirtualMachine", instance.Name, zone)
+	metrics.OrphanedInstances.WithLabelValues(zone, metrics.OrphanActionDeleted).Inc()
+}
@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+func TestCollectOrphans(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		dryRun      bool
+		gracePeriod int
+		remaining   []string
+		event       string
+	}{
+		{
+			name:      "orphans are deleted",
+			remaining: []string{"other-operator", "owned", "unlabelled"},
+			event:     "OrphanDeleted",
+		},
+		{
+			name:      "orphans are reported in dry-run mode",
+			dryRun:    true,
+			remaining: []string{"orphaned", "other-operator", "owned", "unlabelled"},
+			event:     "OrphanDetected",
+		},
+		{
+			name:        "young orphans are spared",
+			gracePeriod: 3600,
+			remaining:   []string{"orphaned", "other-operator", "owned", "unlabelled"},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := testConfig()
+			config.GarbageCollection = GarbageCollectionConfig{
+				DryRun:             testCase.dryRun,
+				GracePeriodSeconds: testCase.gracePeriod,
+				Zones:              []string{"us-east1-b"},
+			}
+			f := newFixture(t, config, fake.Config{})
+			defer f.close()
+
+			owner := testVM("owner")
+			if err := f.informer.GetIndexer().Add(owner); err != nil {
+				t.Fatalf("could not cache VM: %v", err)
+			}
+			otherOperator := f.controller.ownerLabels(testVM("other"))
+			otherOperator[labelOperator] = "other-operator"
+			for name, labels := range map[string]map[string]string{
+				"owned":          f.controller.ownerLabels(owner),
+				"orphaned":       f.controller.ownerLabels(testVM("deleted")),
+				"other-operator": otherOperator,
+				"unlabelled":     nil,
+			} {
+				if _, err := f.controller.provider.Create(&provider.InstanceSpec{
+					Name:   name,
+					Zone:   "us-east1-b",
+					Labels: labels,
+					User:   "cloud-user",
+					Spec:   owner.Spec,
+				}); err != nil {
+					t.Fatalf("could not create instance %s: %v", name, err)
+				}
+			}
+
+			f.controller.collectOrphans()
+
+			instances, err := f.controller.provider.List("us-east1-b", nil)
+			if err != nil {
+				t.Fatalf("could not list instances: %v", err)
+			}
+			var remaining []string
+			for _, instance := range instances {
+				remaining = append(remaining, instance.Name)
+			}
+			sort.Strings(remaining)
+			if !reflect.DeepEqual(remaining, testCase.remaining) {
+				t.Errorf("expected instances %v to remain, got %v", testCase.remaining, remaining)
+			}
+
+			events := f.events()
+			if testCase.event == "" {
+				if len(events) != 0 {
+					t.Errorf("expected no events, got %v", events)
+				}
+				return
+			}
+			if len(events) != 1 || !strings.Contains(events[0], testCase.event) || !strings.Contains(events[0], "orphaned") {
+				t.Errorf("expected one %s event for the orphaned instance, got %v", testCase.event, events)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	knownHostsFile = "known_hosts"
+)
+
+// hostKeysFor reads the host keys the instance has reported out of
+// band, failing if it has not done so yet.
+func (c *Controller) hostKeysFor(zone, instance string) ([]ssh.PublicKey, error) {
+	keys, err := c.provider.HostKeys(zone, instance)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("instance has not reported its SSH host keys yet")
+	}
+	return keys, nil
+}
+
+// hostKeyCallback accepts only the given host keys.
+func hostKeyCallback(keys []ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, known := range keys {
+			if bytes.Equal(known.Marshal(), key.Marshal()) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host key %s presented by %s was not reported by the instance", ssh.FingerprintSHA256(key), hostname)
+	}
+}
+
+// hostKeyAlgorithms lists the types of the given host keys so that the
+// server is asked to present one of the keys that can be verified.
+func hostKeyAlgorithms(keys []ssh.PublicKey) []string {
+	var algorithms []string
+	for _, key := range keys {
+		algorithms = append(algorithms, key.Type())
+	}
+	return algorithms
+}
+
+// knownHosts formats the host keys as known_hosts entries for the host.
+func knownHosts(host string, keys []ssh.PublicKey) string {
+	entries := bytes.Buffer{}
+	for _, key := range keys {
+		fmt.Fprintf(&entries, "%s %s", host, ssh.MarshalAuthorizedKey(key))
+	}
+	return entries.String()
+}
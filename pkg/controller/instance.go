@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// recordInstance records the identity and addresses of the instance
+// in the status, so that they are available without reading the
+// connection Secret.
+func recordInstance(status *vmapi.VirtualMachineStatus, instance *provider.Instance) {
+	status.InstanceID = instance.ID
+	status.SelfLink = instance.SelfLink
+	status.MachineType = instance.MachineType
+	if instance.Image != "" {
+		status.Image = instance.Image
+	}
+	status.InternalIP = instance.InternalIP
+	status.ExternalIP = instance.ExternalIP
+
+	status.InstanceCreationTimestamp = nil
+	if !instance.Created.IsZero() {
+		timestamp := meta.NewTime(instance.Created)
+		status.InstanceCreationTimestamp = &timestamp
+	}
+}
+
+// sshAddressFor determines the address on which the instance of the VM
+// is reached over SSH. Instances without external access are reached on
+// their internal address unless configured otherwise.
+func sshAddressFor(vm *vmapi.VirtualMachine, instance *provider.Instance) (string, error) {
+	addressType := vmapi.VirtualMachineAddressExternal
+	if spec := vm.Spec.Network; spec != nil {
+		if spec.ExternalAccess == vmapi.VirtualMachineExternalAccessNone {
+			addressType = vmapi.VirtualMachineAddressInternal
+		}
+		if spec.SSHAddress != "" {
+			addressType = spec.SSHAddress
+		}
+	}
+
+	address := instance.ExternalIP
+	if addressType == vmapi.VirtualMachineAddressInternal {
+		address = instance.InternalIP
+	}
+	if address == "" {
+		return "", fmt.Errorf("instance %s has no %s address", instance.Name, strings.ToLower(string(addressType)))
+	}
+	return address, nil
+}
@@ -0,0 +1,153 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// labelOperator identifies the operator that created an instance
+	labelOperator = "ci-vm-operator"
+	// labelNamespace identifies the namespace of the owning VirtualMachine
+	labelNamespace = "ci-vm-namespace"
+	// labelName identifies the name of the owning VirtualMachine
+	labelName = "ci-vm-name"
+	// labelUID identifies the UID of the owning VirtualMachine
+	labelUID = "ci-vm-uid"
+	// labelPropagatedNamespace holds the namespace of the owning
+	// VirtualMachine when it is configured to be propagated
+	labelPropagatedNamespace = "namespace"
+
+	// defaultOperatorID identifies instances created by an operator
+	// that was not configured with an ID
+	defaultOperatorID = "ci-vm-operator"
+
+	// maxLabelValueLength is the longest label value GCE accepts
+	maxLabelValueLength = 63
+
+	// AdoptInstanceAnnotation names a pre-existing GCE instance in the zone
+	// of the VirtualMachine that the operator should adopt, rather than
+	// creating a new instance.
+	AdoptInstanceAnnotation = "virtualmachines.ci.openshift.io/adopt-instance"
+)
+
+// operatorID identifies the instances created by this operator.
+func (c Configuration) operatorID() string {
+	if c.OperatorID == "" {
+		return defaultOperatorID
+	}
+	return c.OperatorID
+}
+
+// ownerLabels are the GCE labels that tie an instance or disk
+// to the VirtualMachine it was created for.
+func (c *Controller) ownerLabels(vm *vmapi.VirtualMachine) map[string]string {
+	return map[string]string{
+		labelOperator:  sanitizeLabelValue(c.config.operatorID()),
+		labelNamespace: sanitizeLabelValue(vm.Namespace),
+		labelName:      sanitizeLabelValue(vm.Name),
+		labelUID:       sanitizeLabelValue(string(vm.UID)),
+	}
+}
+
+// instanceLabels are the GCE labels for the instance and disks of the
+// VM: those the spec asks for, overlaid by those the operator is
+// configured to propagate and finally by the ownership labels, so that
+// neither can be spoofed from the spec.
+func (c *Controller) instanceLabels(vm *vmapi.VirtualMachine) map[string]string {
+	labels := map[string]string{}
+	for key, value := range vm.Spec.Labels {
+		labels[key] = value
+	}
+
+	propagation := c.config.LabelPropagation
+	if propagation.Namespace {
+		labels[labelPropagatedNamespace] = sanitizeLabelValue(vm.Namespace)
+	}
+	for _, key := range propagation.Labels {
+		if value, ok := vm.Labels[key]; ok {
+			labels[sanitizeLabelKey(key)] = sanitizeLabelValue(value)
+		}
+	}
+	for _, key := range propagation.Annotations {
+		if value, ok := vm.Annotations[key]; ok {
+			labels[sanitizeLabelKey(key)] = sanitizeLabelValue(value)
+		}
+	}
+
+	for key, value := range c.ownerLabels(vm) {
+		labels[key] = value
+	}
+	return labels
+}
+
+// sanitizeLabelKey coerces the key into the syntax GCE allows for
+// label keys, which is that of values but starting with a letter.
+func sanitizeLabelKey(key string) string {
+	key = sanitizeLabelValue(key)
+	if key == "" || key[0] < 'a' || key[0] > 'z' {
+		key = sanitizeLabelValue("k" + key)
+	}
+	return key
+}
+
+// sanitizeLabelValue coerces the value into the syntax GCE allows
+// for label values: at most 63 lowercase letters, digits, dashes
+// and underscores.
+func sanitizeLabelValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '_'
+		}
+	}, value)
+	if len(value) > maxLabelValueLength {
+		value = value[:maxLabelValueLength]
+	}
+	return value
+}
+
+// ownedBy determines if the instance is labelled as belonging to the VM.
+func (c *Controller) ownedBy(instance *provider.Instance, vm *vmapi.VirtualMachine) bool {
+	return instance.Labels[labelOperator] == sanitizeLabelValue(c.config.operatorID()) &&
+		instance.Labels[labelUID] == sanitizeLabelValue(string(vm.UID))
+}
+
+// mayAdopt determines if the VM may take ownership of an instance that
+// carries no ownership labels. This is the case when the user asks for
+// the instance to be adopted, or when the instance was created for the VM
+// before ownership labels were introduced, was therefore named after it
+// and left the VM owning its connection secret.
+func (c *Controller) mayAdopt(instance *provider.Instance, vm *vmapi.VirtualMachine) (bool, error) {
+	if _, labelled := instance.Labels[labelUID]; labelled {
+		return false, nil
+	}
+	if adopted, ok := vm.Annotations[AdoptInstanceAnnotation]; ok {
+		return adopted == instance.Name, nil
+	}
+	if instance.Name != vm.Name {
+		return false, nil
+	}
+	return c.ownsConnectionSecret(vm)
+}
+
+// adoptInstance labels an instance that was not created by the operator
+// as owned by the VM. Once the labels have been set, the VM is treated
+// like any other.
+func (c *Controller) adoptInstance(vm *vmapi.VirtualMachine, zone string, instance *provider.Instance, logger *logrus.Entry) error {
+	logger.Info("adopting VM")
+	op, err := c.provider.SetLabels(zone, instance.Name, c.ownerLabels(vm))
+	if err != nil {
+		return fmt.Errorf("could not label instance for adoption: %v", err)
+	}
+	return c.trackOperation(vm, op, logger)
+}
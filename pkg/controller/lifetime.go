@@ -0,0 +1,175 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+// renewalCache remembers the invalid lease renewal annotation of each VM,
+// so that a warning is only issued when the annotation changes rather
+// than on every reconcile.
+type renewalCache struct {
+	lock    sync.Mutex
+	invalid map[types.UID]string
+}
+
+// observe records the lease renewal annotation of the VM and whether it
+// could be parsed, returning true if it is invalid and has not been
+// warned about yet.
+func (r *renewalCache) observe(uid types.UID, value string, err error) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err == nil {
+		delete(r.invalid, uid)
+		return false
+	}
+	if previous, warned := r.invalid[uid]; warned && previous == value {
+		return false
+	}
+	if r.invalid == nil {
+		r.invalid = map[types.UID]string{}
+	}
+	r.invalid[uid] = value
+	return true
+}
+
+// forget drops what was recorded for the VM.
+func (r *renewalCache) forget(uid types.UID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.invalid, uid)
+}
+
+// expiryFor determines when the VM expires: the earliest of the expiry
+// it requests, the end of its TTL, the end of its lease and the end of
+// the maximum lifetime the operator allows. Nil is returned for VMs that
+// never expire.
+func (c Configuration) expiryFor(vm *vmapi.VirtualMachine) *time.Time {
+	var expiry *time.Time
+	consider := func(candidate time.Time) {
+		if expiry == nil || candidate.Before(*expiry) {
+			expiry = &candidate
+		}
+	}
+
+	created := vm.CreationTimestamp.Time
+	if vm.Spec.ExpiresAt != nil {
+		consider(vm.Spec.ExpiresAt.Time)
+	}
+	if vm.Spec.TTL != nil {
+		consider(created.Add(vm.Spec.TTL.Duration))
+	}
+	if c.MaxLifetimeSeconds > 0 {
+		consider(created.Add(time.Duration(c.MaxLifetimeSeconds) * time.Second))
+	}
+	// leases without a duration predate its validation
+	// and are ignored rather than expiring immediately
+	if vm.Spec.Lease != nil && vm.Spec.Lease.DurationSeconds > 0 {
+		renewed, err := lastLeaseRenewal(vm)
+		if err != nil {
+			renewed = created
+		}
+		consider(renewed.Add(time.Duration(vm.Spec.Lease.DurationSeconds) * time.Second))
+	}
+	return expiry
+}
+
+// lastLeaseRenewal determines when the lease on the VM was last renewed,
+// which is when it was created if the lease has never been renewed.
+func lastLeaseRenewal(vm *vmapi.VirtualMachine) (time.Time, error) {
+	value, renewed := vm.Annotations[vmapi.LeaseRenewTimeAnnotation]
+	if !renewed {
+		return vm.CreationTimestamp.Time, nil
+	}
+	renewal, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid lease renewal time %q: %v", value, err)
+	}
+	if renewal.Before(vm.CreationTimestamp.Time) {
+		return vm.CreationTimestamp.Time, nil
+	}
+	return renewal, nil
+}
+
+// reapIfExpired deletes the VirtualMachine once it has expired, which
+// triggers the finalizer to delete the instance. VMs about to expire are
+// marked as expiring and a warning is issued. Otherwise, the VM is queued
+// to be reconciled again when it is next due for action. Returns true if
+// the VirtualMachine was deleted.
+func (c *Controller) reapIfExpired(vm *vmapi.VirtualMachine, logger *logrus.Entry) (bool, error) {
+	if vm.Spec.Lease != nil {
+		_, err := lastLeaseRenewal(vm)
+		if c.renewals.observe(vm.UID, vm.Annotations[vmapi.LeaseRenewTimeAnnotation], err) {
+			logger.WithError(err).Warning("ignoring lease renewal")
+			c.recorder.Eventf(vm, coreapi.EventTypeWarning, "InvalidLeaseRenewal", "Ignoring lease renewal: %v", err)
+		}
+	}
+
+	expiry := c.config.expiryFor(vm)
+	if expiry == nil {
+		return false, nil
+	}
+	warning := expiry.Add(-time.Duration(c.config.ExpiryWarningSeconds) * time.Second)
+	now := time.Now()
+
+	if !now.Before(*expiry) {
+		logger.WithField("expiry", expiry).Info("deleting expired virtual machine")
+		c.recorder.Eventf(vm, coreapi.EventTypeNormal, "Expired", "Deleting VirtualMachine as it expired at %s", expiry.Format(time.RFC3339))
+		if err := c.deleteVirtualMachine(vm); err != nil {
+			return false, fmt.Errorf("could not delete expired virtual machine: %v", err)
+		}
+		c.renewals.forget(vm.UID)
+		return true, nil
+	}
+
+	expiring := c.config.ExpiryWarningSeconds > 0 && !now.Before(warning)
+	wasExpiring := isConditionTrue(vm.Status, vmapi.VirtualMachineExpiring)
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		expiresAt := meta.NewTime(*expiry)
+		status.ExpiresAt = &expiresAt
+		if expiring {
+			setCondition(status, vm.Generation, vmapi.VirtualMachineExpiring, coreapi.ConditionTrue, reasonExpiryImminent, fmt.Sprintf("The VirtualMachine will be deleted at %s.", expiry.Format(time.RFC3339)))
+		} else {
+			setCondition(status, vm.Generation, vmapi.VirtualMachineExpiring, coreapi.ConditionFalse, reasonNotExpiring, "")
+		}
+	}); err != nil {
+		return false, fmt.Errorf("could not update status: %v", err)
+	}
+
+	if expiring {
+		if !wasExpiring {
+			c.recorder.Eventf(vm, coreapi.EventTypeWarning, "Expiring", "VirtualMachine will be deleted at %s", expiry.Format(time.RFC3339))
+		}
+		c.enqueueAfter(vm, expiry.Sub(now))
+	} else if c.config.ExpiryWarningSeconds > 0 {
+		c.enqueueAfter(vm, warning.Sub(now))
+	} else {
+		c.enqueueAfter(vm, expiry.Sub(now))
+	}
+	return false, nil
+}
+
+// deleteVirtualMachine deletes the VirtualMachine, which triggers the
+// finalizer to delete its instance. The deletion is conditional on the
+// UID so that a VirtualMachine created with the same name in the
+// meantime is not deleted in its place.
+func (c *Controller) deleteVirtualMachine(vm *vmapi.VirtualMachine) error {
+	err := c.client.VirtualMachines(vm.Namespace).Delete(vm.Name, &meta.DeleteOptions{
+		Preconditions: &meta.Preconditions{UID: &vm.UID},
+	})
+	if kerrors.IsNotFound(err) || kerrors.IsConflict(err) {
+		// already deleted, or replaced by a new VirtualMachine
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,297 @@
+package controller
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+func TestExpiryFor(t *testing.T) {
+	created := time.Date(2018, time.August, 1, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration) *time.Time {
+		expiry := created.Add(offset)
+		return &expiry
+	}
+	ttl := func(duration time.Duration) *meta.Duration {
+		return &meta.Duration{Duration: duration}
+	}
+	expiresAt := func(offset time.Duration) *meta.Time {
+		expiry := meta.NewTime(created.Add(offset))
+		return &expiry
+	}
+
+	var testCases = []struct {
+		name        string
+		maxLifetime int
+		spec        vmapi.VirtualMachineSpec
+		renewed     string
+		expected    *time.Time
+	}{
+		{
+			name: "never expires",
+		},
+		{
+			name:     "ttl",
+			spec:     vmapi.VirtualMachineSpec{TTL: ttl(time.Hour)},
+			expected: at(time.Hour),
+		},
+		{
+			name:     "expiry",
+			spec:     vmapi.VirtualMachineSpec{ExpiresAt: expiresAt(30 * time.Minute)},
+			expected: at(30 * time.Minute),
+		},
+		{
+			name:     "ttl ending before the expiry",
+			spec:     vmapi.VirtualMachineSpec{TTL: ttl(time.Hour), ExpiresAt: expiresAt(2 * time.Hour)},
+			expected: at(time.Hour),
+		},
+		{
+			name:     "expiry before the end of the ttl",
+			spec:     vmapi.VirtualMachineSpec{TTL: ttl(time.Hour), ExpiresAt: expiresAt(10 * time.Minute)},
+			expected: at(10 * time.Minute),
+		},
+		{
+			name:        "maximum lifetime",
+			maxLifetime: 3600,
+			expected:    at(time.Hour),
+		},
+		{
+			name:        "maximum lifetime ending before the ttl",
+			maxLifetime: 1800,
+			spec:        vmapi.VirtualMachineSpec{TTL: ttl(time.Hour)},
+			expected:    at(30 * time.Minute),
+		},
+		{
+			name:        "ttl ending before the maximum lifetime",
+			maxLifetime: 7200,
+			spec:        vmapi.VirtualMachineSpec{TTL: ttl(time.Hour)},
+			expected:    at(time.Hour),
+		},
+		{
+			name:     "lease that was never renewed",
+			spec:     vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}},
+			expected: at(time.Hour),
+		},
+		{
+			name:     "renewed lease",
+			spec:     vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}},
+			renewed:  created.Add(2 * time.Hour).Format(time.RFC3339),
+			expected: at(3 * time.Hour),
+		},
+		{
+			name:     "renewed lease outliving the ttl",
+			spec:     vmapi.VirtualMachineSpec{TTL: ttl(2 * time.Hour), Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}},
+			renewed:  created.Add(2 * time.Hour).Format(time.RFC3339),
+			expected: at(2 * time.Hour),
+		},
+		{
+			name:     "lease with an invalid renewal",
+			spec:     vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}},
+			renewed:  "tomorrow",
+			expected: at(time.Hour),
+		},
+		{
+			name: "lease without a duration",
+			spec: vmapi.VirtualMachineSpec{Lease: &vmapi.VirtualMachineLeaseSpec{}},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			vm := testVM("vm")
+			vm.CreationTimestamp = meta.NewTime(created)
+			vm.Spec = testCase.spec
+			if testCase.renewed != "" {
+				vm.Annotations = map[string]string{vmapi.LeaseRenewTimeAnnotation: testCase.renewed}
+			}
+			config := Configuration{MaxLifetimeSeconds: testCase.maxLifetime}
+
+			expiry := config.expiryFor(vm)
+			switch {
+			case expiry == nil && testCase.expected == nil:
+			case expiry == nil || testCase.expected == nil || !expiry.Equal(*testCase.expected):
+				t.Errorf("expected expiry %v, got %v", testCase.expected, expiry)
+			}
+		})
+	}
+}
+
+func TestReapIfExpired(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		age      time.Duration
+		reaped   bool
+		expiring bool
+		event    string
+	}{
+		{
+			name: "not expiring yet",
+			age:  10 * time.Minute,
+		},
+		{
+			name:     "about to expire",
+			age:      50 * time.Minute,
+			expiring: true,
+			event:    "Expiring",
+		},
+		{
+			name:   "expired",
+			age:    2 * time.Hour,
+			reaped: true,
+			event:  "Expired",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := testConfig()
+			config.ExpiryWarningSeconds = 900
+			f := newFixture(t, config, fake.Config{})
+			defer f.close()
+			vm := testVM("vm")
+			vm.CreationTimestamp = meta.NewTime(time.Now().Add(-testCase.age))
+			vm.Spec.TTL = &meta.Duration{Duration: time.Hour}
+			f.create(t, vm)
+
+			reaped, err := f.controller.reapIfExpired(vm, f.controller.logger)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if reaped != testCase.reaped {
+				t.Errorf("expected the VM to be reaped: %v, got %v", testCase.reaped, reaped)
+			}
+
+			events := f.events()
+			if testCase.event == "" && len(events) != 0 {
+				t.Errorf("expected no events, got %v", events)
+			}
+			if testCase.event != "" && (len(events) != 1 || !strings.Contains(events[0], testCase.event)) {
+				t.Errorf("expected one %s event, got %v", testCase.event, events)
+			}
+
+			if testCase.reaped {
+				if _, err := f.vmClient.CiV1alpha1().VirtualMachines(namespace).Get("vm", meta.GetOptions{}); !kerrors.IsNotFound(err) {
+					t.Errorf("expected the VM to be deleted, got %v", err)
+				}
+				return
+			}
+			vm = f.get(t, "vm")
+			if expected := vm.CreationTimestamp.Add(time.Hour); vm.Status.ExpiresAt == nil || !vm.Status.ExpiresAt.Time.Equal(expected) {
+				t.Errorf("expected the VM to expire at %v, got %v", expected, vm.Status.ExpiresAt)
+			}
+			if expiring := isConditionTrue(vm.Status, vmapi.VirtualMachineExpiring); expiring != testCase.expiring {
+				t.Errorf("expected the VM to be expiring: %v, got %#v", testCase.expiring, vm.Status.Conditions)
+			}
+		})
+	}
+}
+
+func TestLastLeaseRenewal(t *testing.T) {
+	created := time.Date(2018, time.August, 1, 12, 0, 0, 0, time.UTC)
+	var testCases = []struct {
+		name        string
+		renewed     string
+		expected    time.Time
+		expectedErr bool
+	}{
+		{
+			name:     "never renewed",
+			expected: created,
+		},
+		{
+			name:     "renewed",
+			renewed:  "2018-08-01T14:00:00Z",
+			expected: created.Add(2 * time.Hour),
+		},
+		{
+			name:     "renewed before creation",
+			renewed:  "2018-08-01T10:00:00Z",
+			expected: created,
+		},
+		{
+			name:        "invalid renewal",
+			renewed:     "2018-08-01 14:00",
+			expectedErr: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			vm := testVM("vm")
+			vm.CreationTimestamp = meta.NewTime(created)
+			if testCase.renewed != "" {
+				vm.Annotations = map[string]string{vmapi.LeaseRenewTimeAnnotation: testCase.renewed}
+			}
+
+			renewed, err := lastLeaseRenewal(vm)
+			if testCase.expectedErr != (err != nil) {
+				t.Fatalf("expected an error: %v, got %v", testCase.expectedErr, err)
+			}
+			if err == nil && !renewed.Equal(testCase.expected) {
+				t.Errorf("expected renewal at %v, got %v", testCase.expected, renewed)
+			}
+		})
+	}
+}
+
+func TestRenewalCache(t *testing.T) {
+	invalid := errors.New("invalid")
+	var renewals renewalCache
+	for i, step := range []struct {
+		uid   types.UID
+		value string
+		err   error
+		warn  bool
+	}{
+		{uid: "first", value: "soon", err: invalid, warn: true},
+		{uid: "first", value: "soon", err: invalid},
+		{uid: "second", value: "soon", err: invalid, warn: true},
+		{uid: "first", value: "later", err: invalid, warn: true},
+		{uid: "first", value: "2018-08-01T14:00:00Z"},
+		{uid: "first", value: "later", err: invalid, warn: true},
+	} {
+		if warn := renewals.observe(step.uid, step.value, step.err); warn != step.warn {
+			t.Errorf("step %d: expected a warning: %v, got %v", i, step.warn, warn)
+		}
+	}
+
+	renewals.forget("second")
+	if !renewals.observe("second", "soon", invalid) {
+		t.Error("expected a warning once the VM was forgotten")
+	}
+}
+
+func TestReapIfExpiredWarnsOncePerInvalidRenewal(t *testing.T) {
+	f := newFixture(t, testConfig(), fake.Config{})
+	defer f.close()
+	vm := testVM("vm")
+	vm.CreationTimestamp = meta.Now()
+	vm.Spec.Lease = &vmapi.VirtualMachineLeaseSpec{DurationSeconds: 3600}
+	vm.Annotations = map[string]string{vmapi.LeaseRenewTimeAnnotation: "soon"}
+	f.create(t, vm)
+
+	for _, renewal := range []string{"soon", "soon", "later"} {
+		vm.Annotations[vmapi.LeaseRenewTimeAnnotation] = renewal
+		if reaped, err := f.controller.reapIfExpired(vm, f.controller.logger); err != nil || reaped {
+			t.Fatalf("expected the VM to be kept, got %v, %v", reaped, err)
+		}
+	}
+
+	var warnings int
+	for _, event := range f.events() {
+		if strings.Contains(event, "InvalidLeaseRenewal") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("expected a warning for each invalid renewal, got %d", warnings)
+	}
+}
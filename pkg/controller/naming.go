@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+const (
+	// maxInstanceNameLength is the longest name GCE accepts for an instance
+	maxInstanceNameLength = 63
+	// instanceNameHashLength is the number of hex characters of the
+	// hash that disambiguate instance names
+	instanceNameHashLength = 10
+)
+
+// generateInstanceName derives a GCE instance name for the VM that does not
+// collide with the instance of any other VM, in any namespace. GCE requires
+// names to match [a-z]([-a-z0-9]*[a-z0-9])? and be at most 63 characters long,
+// so the namespace and name are sanitized and truncated for readability, and
+// suffixed with a hash of the namespace, name and UID for uniqueness.
+func generateInstanceName(vm *vmapi.VirtualMachine) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", vm.Namespace, vm.Name, vm.UID)))
+	suffix := hex.EncodeToString(hash[:])[:instanceNameHashLength]
+
+	prefix := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		default:
+			return '-'
+		}
+	}, fmt.Sprintf("%s-%s", vm.Namespace, vm.Name))
+	if prefix[0] < 'a' || prefix[0] > 'z' {
+		prefix = fmt.Sprintf("vm-%s", prefix)
+	}
+	if maxPrefix := maxInstanceNameLength - len(suffix) - 1; len(prefix) > maxPrefix {
+		prefix = prefix[:maxPrefix]
+	}
+	prefix = strings.TrimRight(prefix, "-")
+
+	return fmt.Sprintf("%s-%s", prefix, suffix)
+}
+
+// instanceNameFor determines the name of the GCE instance backing the VM.
+// VMs provisioned before instance names were recorded in the status used
+// the name of the VirtualMachine directly, which we detect by the presence
+// of a connection secret owned by the VM.
+func (c *Controller) instanceNameFor(vm *vmapi.VirtualMachine) (string, error) {
+	if vm.Status.InstanceName != "" {
+		return vm.Status.InstanceName, nil
+	}
+	if adopted, ok := vm.Annotations[AdoptInstanceAnnotation]; ok {
+		return adopted, nil
+	}
+
+	legacy, err := c.ownsConnectionSecret(vm)
+	if err != nil {
+		return "", err
+	}
+	if legacy {
+		return vm.Name, nil
+	}
+
+	return generateInstanceName(vm), nil
+}
+
+// ownsConnectionSecret determines if a connection secret was published
+// for the VM.
+func (c *Controller) ownsConnectionSecret(vm *vmapi.VirtualMachine) (bool, error) {
+	secret, err := c.kubeClient.CoreV1().Secrets(vm.Namespace).Get(vm.Name, meta.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check for existance of secret: %v", err)
+	}
+	return ownsSecret(vm, secret), nil
+}
@@ -0,0 +1,176 @@
+package controller
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	coreapi "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce/fake"
+)
+
+// instanceNamePattern matches the instance names GCE accepts.
+var instanceNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+func namedVM(namespace, name, uid string) *vmapi.VirtualMachine {
+	return &vmapi.VirtualMachine{ObjectMeta: meta.ObjectMeta{Namespace: namespace, Name: name, UID: types.UID(uid)}}
+}
+
+func TestGenerateInstanceName(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		vm     *vmapi.VirtualMachine
+		prefix string
+	}{
+		{
+			name:   "short namespace and name",
+			vm:     namedVM("ci", "vm", "uid"),
+			prefix: "ci-vm-",
+		},
+		{
+			name:   "characters GCE does not accept",
+			vm:     namedVM("ci", "My.VM_1", "uid"),
+			prefix: "ci-my-vm-1-",
+		},
+		{
+			name:   "namespace starting with a digit",
+			vm:     namedVM("1ci", "vm", "uid"),
+			prefix: "vm-1ci-vm-",
+		},
+		{
+			name:   "long namespace and name",
+			vm:     namedVM(strings.Repeat("n", 63), strings.Repeat("v", 253), "uid"),
+			prefix: strings.Repeat("n", 52),
+		},
+		{
+			name:   "truncated at a dash",
+			vm:     namedVM(strings.Repeat("n", 51), "vm", "uid"),
+			prefix: strings.Repeat("n", 51) + "-",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			name := generateInstanceName(testCase.vm)
+			if !instanceNamePattern.MatchString(name) {
+				t.Errorf("expected a name GCE accepts, got %q", name)
+			}
+			if !strings.HasPrefix(name, testCase.prefix) {
+				t.Errorf("expected the name to start with %q, got %q", testCase.prefix, name)
+			}
+			if strings.Contains(name, "--") {
+				t.Errorf("expected the truncated prefix not to end in a dash, got %q", name)
+			}
+			if again := generateInstanceName(testCase.vm); again != name {
+				t.Errorf("expected the name to be stable, got %q and %q", name, again)
+			}
+		})
+	}
+}
+
+func TestGenerateInstanceNameCollisions(t *testing.T) {
+	var testCases = []struct {
+		name  string
+		first *vmapi.VirtualMachine
+		other *vmapi.VirtualMachine
+	}{
+		{
+			name:  "same name in another namespace",
+			first: namedVM("team-a", "vm", "uid-1"),
+			other: namedVM("team-b", "vm", "uid-2"),
+		},
+		{
+			name:  "namespace and name joined the same way",
+			first: namedVM("a-b", "c", "uid-1"),
+			other: namedVM("a", "b-c", "uid-2"),
+		},
+		{
+			name:  "names that sanitize the same way",
+			first: namedVM("ci", "vm.1", "uid-1"),
+			other: namedVM("ci", "vm_1", "uid-2"),
+		},
+		{
+			name:  "names that truncate the same way",
+			first: namedVM("ci", strings.Repeat("v", 60)+"-first", "uid-1"),
+			other: namedVM("ci", strings.Repeat("v", 60)+"-other", "uid-2"),
+		},
+		{
+			name:  "recreated with the same name",
+			first: namedVM("ci", "vm", "uid-1"),
+			other: namedVM("ci", "vm", "uid-2"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if first, other := generateInstanceName(testCase.first), generateInstanceName(testCase.other); first == other {
+				t.Errorf("expected different names, got %q for both", first)
+			}
+		})
+	}
+}
+
+func TestInstanceNameFor(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		status   string
+		adopt    string
+		secret   *coreapi.Secret
+		expected string
+	}{
+		{
+			name:     "recorded in the status",
+			status:   "recorded",
+			adopt:    "imported",
+			expected: "recorded",
+		},
+		{
+			name:     "named in the adoption annotation",
+			adopt:    "imported",
+			expected: "imported",
+		},
+		{
+			name:     "provisioned before names were recorded",
+			secret:   &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace, OwnerReferences: ownerReferences(testVM("vm"))}},
+			expected: "vm",
+		},
+		{
+			name:     "secret of another owner",
+			secret:   &coreapi.Secret{ObjectMeta: meta.ObjectMeta{Name: "vm", Namespace: namespace}},
+			expected: generateInstanceName(testVM("vm")),
+		},
+		{
+			name:     "new VM",
+			expected: generateInstanceName(testVM("vm")),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			f := newFixture(t, testConfig(), fake.Config{})
+			defer f.close()
+			vm := testVM("vm")
+			vm.Status.InstanceName = testCase.status
+			if testCase.adopt != "" {
+				vm.Annotations = map[string]string{AdoptInstanceAnnotation: testCase.adopt}
+			}
+			if testCase.secret != nil {
+				if _, err := f.kubeClient.CoreV1().Secrets(namespace).Create(testCase.secret); err != nil {
+					t.Fatalf("could not create secret: %v", err)
+				}
+			}
+
+			name, err := f.controller.instanceNameFor(vm)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != testCase.expected {
+				t.Errorf("expected instance name %q, got %q", testCase.expected, name)
+			}
+		})
+	}
+}
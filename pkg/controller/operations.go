@@ -0,0 +1,84 @@
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	operationTimeout      = time.Minute * 10
+	operationPollInterval = time.Second * 5
+)
+
+// trackOperation records the operation in the status of the VM instead
+// of waiting for it, and requeues the VM to check on it later. The next
+// reconcile resumes from the recorded operation, even if the operator
+// was restarted in the meantime.
+func (c *Controller) trackOperation(vm *vmapi.VirtualMachine, op *provider.Operation, logger *logrus.Entry) error {
+	logger.WithField("operation", op.Name).Infof("Started %v operation.", op.Type)
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.Operation = &vmapi.VirtualMachineOperation{
+			Name:      op.Name,
+			Zone:      op.Zone,
+			Type:      op.Type,
+			StartTime: meta.Now(),
+		}
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+	c.enqueueAfter(vm, operationPollInterval)
+	return nil
+}
+
+// completedOperation is an operation recorded in the status of a VM that
+// has finished, along with the error it failed with, if any.
+type completedOperation struct {
+	*vmapi.VirtualMachineOperation
+	err error
+}
+
+// pollOperation checks on the operation recorded in the status of the VM.
+// If the operation is still running, the VM is requeued and no operation
+// is returned. Otherwise, the operation is cleared from the status and
+// returned as completed.
+func (c *Controller) pollOperation(vm *vmapi.VirtualMachine, logger *logrus.Entry) (*completedOperation, error) {
+	tracked := vm.Status.Operation
+	logger = logger.WithField("operation", tracked.Name)
+
+	status, err := c.provider.Poll(&provider.Operation{
+		Name: tracked.Name,
+		Zone: tracked.Zone,
+		Type: tracked.Type,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not check on %v operation: %v", tracked.Type, err)
+	}
+	completed := &completedOperation{VirtualMachineOperation: tracked, err: status.Error}
+	if !status.Done {
+		if time.Since(tracked.StartTime.Time) <= operationTimeout {
+			logger.Infof("Waiting for %v operation: %v", tracked.Type, status.Message)
+			c.enqueueAfter(vm, operationPollInterval)
+			return nil, nil
+		}
+		completed.err = fmt.Errorf("%v operation %q timed out after %v", tracked.Type, tracked.Name, time.Since(tracked.StartTime.Time))
+	}
+
+	if completed.err != nil {
+		logger.WithError(completed.err).Warningf("Finished %v operation with errors.", tracked.Type)
+	} else {
+		logger.Infof("Finished %v operation.", tracked.Type)
+	}
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.Operation = nil
+	}); err != nil {
+		return nil, fmt.Errorf("could not update status: %v", err)
+	}
+	return completed, nil
+}
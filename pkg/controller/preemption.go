@@ -0,0 +1,74 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// isPreempted determines if the instance of the VM was stopped by the provider.
+func isPreempted(vm *vmapi.VirtualMachine, instance *provider.Instance) bool {
+	return vm.Spec.Scheduling != nil && vm.Spec.Scheduling.Preemptible && instance.Terminated
+}
+
+// handlePreemption reacts to the instance of the VM being preempted. By
+// default, the VM is marked as failed; if the VM asks for it, the instance
+// is instead deleted and replaced by a new one with a new Secret. Either
+// way, the Secret of the preempted instance is withdrawn.
+func (c *Controller) handlePreemption(vm *vmapi.VirtualMachine, zone string, logger *logrus.Entry) error {
+	recreate := vm.Spec.Scheduling.RestartPolicy == vmapi.VirtualMachineRestartPolicyRecreate
+	created := getCondition(vm.Status, vmapi.VirtualMachineInstanceCreated)
+	handled := created != nil && created.Reason == reasonPreempted
+	if !handled {
+		logger.Warning("VM was preempted")
+		message := "The instance was preempted."
+		if recreate {
+			message = "The instance was preempted and will be recreated."
+		}
+		c.recorder.Event(vm, coreapi.EventTypeWarning, "Preempted", message)
+		// the connection details are those of the preempted instance,
+		// so they are withdrawn until a replacement is reachable
+		if err := c.withdrawSecret(vm); err != nil {
+			logger.WithError(err).Error("error withdrawing SSH secret")
+			return fmt.Errorf("could not withdraw SSH secret: %v", err)
+		}
+		if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+			status.Preemptions++
+			setCondition(status, vm.Generation, vmapi.VirtualMachineInstanceCreated, coreapi.ConditionFalse, reasonPreempted, message)
+			setCondition(status, vm.Generation, vmapi.VirtualMachineSSHReachable, coreapi.ConditionFalse, reasonPreempted, message)
+			setCondition(status, vm.Generation, vmapi.VirtualMachineSecretPublished, coreapi.ConditionFalse, reasonPreempted, message)
+			setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionFalse, reasonPreempted, message)
+		}); err != nil {
+			return fmt.Errorf("could not update status: %v", err)
+		}
+	}
+
+	if !recreate {
+		if handled {
+			return nil
+		}
+		return c.handleError(vm, reasonPreempted, errors.New("the instance was preempted"))
+	}
+
+	return c.recreateInstance(vm, zone, logger)
+}
+
+// recreateInstance deletes the instance of the VM. Once the deletion has
+// completed, the next reconcile of the VM finds no instance and creates
+// a new one in its place.
+func (c *Controller) recreateInstance(vm *vmapi.VirtualMachine, zone string, logger *logrus.Entry) error {
+	logger.Info("deleting VM to recreate it")
+	op, err := c.provider.Delete(zone, vm.Status.InstanceName)
+	if err != nil {
+		logger.WithError(err).Error("failed to delete VM")
+		return fmt.Errorf("could not delete instance: %v", err)
+	}
+
+	return c.trackOperation(vm, op, logger)
+}
@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+// handleSSHFailure reacts to the instance of the VM not becoming reachable
+// over SSH. The connection secret is withheld so that consumers do not
+// start against an unreachable VM, and the staged key pair is abandoned.
+// The instance is replaced as often as the configuration allows, after
+// which the VM is marked as failed.
+func (c *Controller) handleSSHFailure(vm *vmapi.VirtualMachine, zone string, sshErr error, logger *logrus.Entry) error {
+	if err := c.withdrawSecret(vm); err != nil {
+		logger.WithError(err).Error("error withdrawing SSH secret")
+		return fmt.Errorf("could not withdraw SSH secret: %v", err)
+	}
+	if err := c.clearStagedConnection(vm); err != nil {
+		return err
+	}
+
+	recreate := vm.Status.SSHRecreations < int32(c.config.SSHConnectionConfig.MaxRecreations)
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSSHReachable, coreapi.ConditionFalse, reasonConnectionFailed, sshErr.Error())
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSecretPublished, coreapi.ConditionFalse, reasonSSHUnreachable, "The connection secret is withheld until the instance is reachable over SSH.")
+		if recreate {
+			status.SSHRecreations++
+			setCondition(status, vm.Generation, vmapi.VirtualMachineInstanceCreated, coreapi.ConditionFalse, reasonRecreating, "The instance could not be reached over SSH and will be recreated.")
+		}
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+
+	if !recreate {
+		c.recorder.Event(vm, coreapi.EventTypeWarning, reasonSSHUnreachable, "The instance could not be reached over SSH.")
+		return c.handleError(vm, reasonSSHUnreachable, sshErr)
+	}
+
+	c.recorder.Eventf(vm, coreapi.EventTypeWarning, reasonSSHUnreachable, "The instance could not be reached over SSH and will be recreated (attempt %d of %d).", vm.Status.SSHRecreations, c.config.SSHConnectionConfig.MaxRecreations)
+	return c.recreateInstance(vm, zone, logger)
+}
+
+// isSSHFailed determines if the VM was marked as failed because its
+// instance could not be reached over SSH.
+func isSSHFailed(vm *vmapi.VirtualMachine) bool {
+	ready := getCondition(vm.Status, vmapi.VirtualMachineReady)
+	return vm.Status.State.ProcessingPhase == vmapi.ProcessingPhaseError && ready != nil && ready.Reason == reasonSSHUnreachable
+}
+
+// hasConnectionDetails determines if the secret holds connection details,
+// as opposed to having been withdrawn.
+func hasConnectionDetails(secret *coreapi.Secret) bool {
+	_, ok := secret.Data["ssh_config"]
+	return ok
+}
+
+// withdrawSecret clears the connection secret of a VM, if one was
+// published for a previous instance.
+func (c *Controller) withdrawSecret(vm *vmapi.VirtualMachine) error {
+	return c.emptySecret(vm, vm.Name)
+}
+
+// emptySecret clears the data of a secret of the VM, if it exists.
+// Secrets are emptied rather than deleted as the controller may not
+// delete secrets. Secrets the VM does not own are left alone.
+func (c *Controller) emptySecret(vm *vmapi.VirtualMachine, name string) error {
+	existing, err := c.kubeClient.CoreV1().Secrets(vm.Namespace).Get(name, meta.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !ownsSecret(vm, existing) || len(existing.Data) == 0 {
+		return nil
+	}
+	existing.Data = nil
+	existing.StringData = nil
+	_, err = c.kubeClient.CoreV1().Secrets(vm.Namespace).Update(existing)
+	return err
+}
@@ -0,0 +1,83 @@
+package controller
+
+import (
+	"fmt"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/validation"
+)
+
+// resolveScripts resolves the startup script and user data of the VM.
+func (c *Controller) resolveScripts(vm *vmapi.VirtualMachine) (string, string, error) {
+	var startupScript, userData string
+	for _, script := range []struct {
+		name    string
+		source  *vmapi.VirtualMachineScriptSource
+		content *string
+	}{
+		{name: "startup script", source: vm.Spec.StartupScript, content: &startupScript},
+		{name: "user data", source: vm.Spec.UserData, content: &userData},
+	} {
+		if script.source == nil {
+			continue
+		}
+		content, found, err := c.resolveScriptSource(vm.Namespace, script.source)
+		if err != nil {
+			return "", "", fmt.Errorf("could not resolve %s: %v", script.name, err)
+		}
+		if !found {
+			continue
+		}
+		if len(content) > validation.MaxMetadataValueBytes {
+			return "", "", fmt.Errorf("%s is %d bytes, larger than the %d allowed", script.name, len(content), validation.MaxMetadataValueBytes)
+		}
+		*script.content = content
+	}
+	return startupScript, userData, nil
+}
+
+// resolveScriptSource determines the content the source provides. Content
+// from an optional key that does not exist is reported as not found.
+func (c *Controller) resolveScriptSource(namespace string, source *vmapi.VirtualMachineScriptSource) (string, bool, error) {
+	switch {
+	case source.ConfigMapKeyRef != nil:
+		ref := source.ConfigMapKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		configMap, err := c.kubeClient.CoreV1().ConfigMaps(namespace).Get(ref.Name, meta.GetOptions{})
+		if kerrors.IsNotFound(err) && optional {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("could not get configmap %s: %v", ref.Name, err)
+		}
+		if content, ok := configMap.Data[ref.Key]; ok {
+			return content, true, nil
+		}
+		if optional {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("configmap %s has no key %s", ref.Name, ref.Key)
+	case source.SecretKeyRef != nil:
+		ref := source.SecretKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		secret, err := c.kubeClient.CoreV1().Secrets(namespace).Get(ref.Name, meta.GetOptions{})
+		if kerrors.IsNotFound(err) && optional {
+			return "", false, nil
+		}
+		if err != nil {
+			return "", false, fmt.Errorf("could not get secret %s: %v", ref.Name, err)
+		}
+		if content, ok := secret.Data[ref.Key]; ok {
+			return string(content), true, nil
+		}
+		if optional {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+	default:
+		return source.Inline, true, nil
+	}
+}
@@ -13,6 +13,12 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"golang.org/x/crypto/ssh"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
 )
 
 // createSSHSecretForVM will create a SSH keypair for the VM
@@ -40,7 +46,13 @@ func newSSHKeypair() (string, string, error) {
 	return privateKeyData.String(), publicKeyData.String(), nil
 }
 
-func pollForSSHConnection(sshConfig SSHConnectionConfig, instanceHostname, user, pem string, logger *logrus.Entry) error {
+// dialFunc opens a network connection, as net.DialTimeout does.
+type dialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// dialSSH attempts to connect to the host once. If host key
+// verification is enabled, the host must present one of the given
+// host keys.
+func dialSSH(dial dialFunc, sshConfig SSHConnectionConfig, instanceHostname, user, pem string, hostKeys []ssh.PublicKey, logger *logrus.Entry) error {
 	signer, err := ssh.ParsePrivateKey([]byte(pem))
 	if err != nil {
 		logger.WithError(err).Error("failed to parse private key")
@@ -51,35 +63,106 @@ func pollForSSHConnection(sshConfig SSHConnectionConfig, instanceHostname, user,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO: fixed host key
-		Timeout:         time.Duration(sshConfig.TimeoutSeconds) * time.Second,
+		HostKeyCallback:   hostKeyCallback(hostKeys),
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeys),
+		Timeout:           time.Duration(sshConfig.TimeoutSeconds) * time.Second,
+	}
+	if !sshConfig.VerifyHostKeys {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		config.HostKeyAlgorithms = nil
 	}
-	succeeded := false
+
 	logger = logger.WithField("hostname", instanceHostname)
-	for i := 0; i < sshConfig.Retries; i ++ {
-		iLogger := logger.WithField("attempt", i + 1)
-		iLogger.Debug("dialing host")
-		conn, dialErr := net.DialTimeout("tcp", fmt.Sprintf("%s:22", instanceHostname), config.Timeout)
-		if dialErr == nil {
-			iLogger.Debug("dial success")
-			c, _, _, connErr := ssh.NewClientConn(conn, instanceHostname, config)
-			if connErr == nil {
-				iLogger.Debug("SSH connection success")
-				if closeErr := c.Close(); closeErr != nil {
-					iLogger.WithError(closeErr).Warning("failed to close SSH connection")
-				}
-				succeeded = true
-			} else {
-				iLogger.WithError(connErr).Warning("SSH connection failure")
-			}
-			break
-		} else {
-			iLogger.WithError(dialErr).Debug("dial failure")
-		}
-		time.Sleep(time.Duration(sshConfig.DelaySeconds) * time.Second)
+	logger.Debug("dialing host")
+	conn, err := dial("tcp", fmt.Sprintf("%s:22", instanceHostname), config.Timeout)
+	if err != nil {
+		logger.WithError(err).Debug("dial failure")
+		return fmt.Errorf("could not dial VM: %v", err)
 	}
-	if !succeeded {
-		return fmt.Errorf("could not connect to VM over SSH in %d attempts", sshConfig.Retries)
+	logger.Debug("dial success")
+	client, _, _, err := ssh.NewClientConn(conn, instanceHostname, config)
+	if err != nil {
+		logger.WithError(err).Warning("SSH connection failure")
+		return fmt.Errorf("could not connect to VM over SSH: %v", err)
+	}
+	logger.Debug("SSH connection success")
+	if err := client.Close(); err != nil {
+		logger.WithError(err).Warning("failed to close SSH connection")
 	}
 	return nil
 }
+
+// connectionDetails formats the contents of the connection secret for
+// a VM. When the host keys of the instance are known, they are published
+// as a known_hosts file that the ssh_config requires the host to match.
+func connectionDetails(sshConfig SSHConnectionConfig, name, instanceHostname, user, pem, pub string, hostKeys []ssh.PublicKey) map[string]string {
+	details := map[string]string{
+		"id_rsa":     pem,
+		"id_rsa.pub": pub,
+	}
+	if len(hostKeys) == 0 {
+		details["ssh_config"] = fmt.Sprintf(`Host %s
+  HostName %s
+  Port 22
+  User %s
+  StrictHostKeyChecking no
+`, name, instanceHostname, user)
+		return details
+	}
+
+	knownHostsPath := sshConfig.KnownHostsPath
+	if knownHostsPath == "" {
+		knownHostsPath = knownHostsFile
+	}
+	details[knownHostsFile] = knownHosts(instanceHostname, hostKeys)
+	details["ssh_config"] = fmt.Sprintf(`Host %s
+  HostName %s
+  Port 22
+  User %s
+  StrictHostKeyChecking yes
+  UserKnownHostsFile %s
+`, name, instanceHostname, user, knownHostsPath)
+	return details
+}
+
+// publishSecret creates a secret for a VM, replacing the contents of the
+// secret if one was published for a previous instance. Secrets that the
+// VM does not own are left alone, as they may belong to the user.
+func (c *Controller) publishSecret(vm *vmapi.VirtualMachine, secret *coreapi.Secret) error {
+	_, err := c.kubeClient.CoreV1().Secrets(secret.Namespace).Create(secret)
+	if !kerrors.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := c.kubeClient.CoreV1().Secrets(secret.Namespace).Get(secret.Name, meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if !ownsSecret(vm, existing) {
+		c.recorder.Eventf(vm, coreapi.EventTypeWarning, reasonSecretConflict, "Secret %s already exists and does not belong to the VirtualMachine", secret.Name)
+		return fmt.Errorf("secret %s already exists and does not belong to the VirtualMachine", secret.Name)
+	}
+	existing.Data = nil
+	existing.StringData = secret.StringData
+	// secrets published before the owner references were
+	// fixed refer to the VM with an invalid kind
+	var owners []meta.OwnerReference
+	for _, owner := range existing.OwnerReferences {
+		if owner.UID != vm.UID {
+			owners = append(owners, owner)
+		}
+	}
+	existing.OwnerReferences = append(owners, secret.OwnerReferences...)
+	_, err = c.kubeClient.CoreV1().Secrets(secret.Namespace).Update(existing)
+	return err
+}
+
+// ownsSecret determines if the secret was created for the VM.
+func ownsSecret(vm *vmapi.VirtualMachine, secret *coreapi.Secret) bool {
+	for _, owner := range secret.OwnerReferences {
+		if owner.UID == vm.UID {
+			return true
+		}
+	}
+	return false
+}
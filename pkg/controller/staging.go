@@ -0,0 +1,115 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	stagingKeyPrivateKey = "id_rsa"
+	stagingKeyPublicKey  = "id_rsa.pub"
+	stagingKeyUser       = "user"
+	stagingKeyZone       = "zone"
+	stagingKeyInstance   = "instance.json"
+	stagingKeyAttempts   = "attempts"
+)
+
+// stagingSecretName names the secret in which the connection of a VM
+// is staged. The name is derived from the UID so that it can never
+// collide with secrets that do not belong to the operator.
+func stagingSecretName(vm *vmapi.VirtualMachine) string {
+	return fmt.Sprintf("ci-vm-staging-%s", vm.UID)
+}
+
+// ownerReferences ties secrets the operator creates to the VM.
+func ownerReferences(vm *vmapi.VirtualMachine) []meta.OwnerReference {
+	// we do not want this controller to be able to delete
+	// secrets across the cluster, so we use owner refs to
+	// allow for garbage collection instead
+	return []meta.OwnerReference{*meta.NewControllerRef(vm, vmapi.SchemeGroupVersion.WithKind("VirtualMachine"))}
+}
+
+// stagedConnection loads the connection staged for the VM, if any.
+func (c *Controller) stagedConnection(vm *vmapi.VirtualMachine) (*pendingConnection, error) {
+	secret, err := c.kubeClient.CoreV1().Secrets(vm.Namespace).Get(stagingSecretName(vm), meta.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get staging secret: %v", err)
+	}
+	if _, staged := secret.Data[stagingKeyPrivateKey]; !staged {
+		return nil, nil
+	}
+
+	connection := &pendingConnection{
+		user: string(secret.Data[stagingKeyUser]),
+		pem:  string(secret.Data[stagingKeyPrivateKey]),
+		pub:  string(secret.Data[stagingKeyPublicKey]),
+		zone: string(secret.Data[stagingKeyZone]),
+	}
+	if raw, ok := secret.Data[stagingKeyInstance]; ok {
+		connection.instance = &provider.InstanceSpec{}
+		if err := json.Unmarshal(raw, connection.instance); err != nil {
+			return nil, fmt.Errorf("could not parse staged instance: %v", err)
+		}
+	}
+	if raw, ok := secret.Data[stagingKeyAttempts]; ok {
+		if connection.attempts, err = strconv.Atoi(string(raw)); err != nil {
+			return nil, fmt.Errorf("could not parse staged attempts: %v", err)
+		}
+	}
+	return connection, nil
+}
+
+// stageConnection persists the connection for the VM, so that a reconcile
+// that resumes after the operator restarted uses the same key pair and
+// instance parameters rather than generating new ones.
+func (c *Controller) stageConnection(vm *vmapi.VirtualMachine, connection *pendingConnection) error {
+	data := map[string]string{
+		stagingKeyPrivateKey: connection.pem,
+		stagingKeyPublicKey:  connection.pub,
+		stagingKeyUser:       connection.user,
+		stagingKeyZone:       connection.zone,
+		stagingKeyAttempts:   strconv.Itoa(connection.attempts),
+	}
+	if connection.instance != nil {
+		raw, err := json.Marshal(connection.instance)
+		if err != nil {
+			return fmt.Errorf("could not serialize staged instance: %v", err)
+		}
+		data[stagingKeyInstance] = string(raw)
+	}
+
+	if err := c.publishSecret(vm, &coreapi.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            stagingSecretName(vm),
+			Namespace:       vm.Namespace,
+			Labels:          c.ownerLabels(vm),
+			OwnerReferences: ownerReferences(vm),
+		},
+		StringData: data,
+	}); err != nil {
+		return fmt.Errorf("could not stage connection: %v", err)
+	}
+	return nil
+}
+
+// clearStagedConnection empties the staging secret of the VM once the
+// connection has been published or abandoned, so that the private key
+// does not linger in it. The secret itself is garbage collected along
+// with the VM.
+func (c *Controller) clearStagedConnection(vm *vmapi.VirtualMachine) error {
+	if err := c.emptySecret(vm, stagingSecretName(vm)); err != nil {
+		return fmt.Errorf("could not clear staging secret: %v", err)
+	}
+	return nil
+}
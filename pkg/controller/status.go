@@ -0,0 +1,98 @@
+package controller
+
+import (
+	coreapi "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+const (
+	reasonPending           = "Pending"
+	reasonInvalidZone       = "InvalidZone"
+	reasonZoneExhausted     = "ZoneExhausted"
+	reasonZonesExhausted    = "ZonesExhausted"
+	reasonInstanceConflict  = "InstanceConflict"
+	reasonInvalidScript     = "InvalidScript"
+	reasonCreating          = "Creating"
+	reasonInstanceExists    = "InstanceExists"
+	reasonOperationFailed   = "OperationFailed"
+	reasonNoAddress         = "NoAddress"
+	reasonConnected         = "Connected"
+	reasonConnectionFailed  = "ConnectionFailed"
+	reasonPublished         = "Published"
+	reasonSecretConflict    = "SecretConflict"
+	reasonSSHKeyUnsupported = "SSHKeyUnsupported"
+	reasonProvisioned       = "Provisioned"
+	reasonProvisioning      = "Provisioning"
+	reasonSSHUnreachable    = "SSHUnreachable"
+	reasonRecreating        = "Recreating"
+	reasonDeleting          = "Deleting"
+	reasonDeletionFailed    = "DeletionFailed"
+	reasonExpiryImminent    = "ExpiryImminent"
+	reasonPreempted         = "Preempted"
+	reasonNotExpiring       = "NotExpiring"
+)
+
+// updateStatus applies mutate to the status of vm and persists the
+// result if anything changed. On success, vm is updated in place to
+// the object returned by the server so that subsequent updates do not
+// conflict.
+func (c *Controller) updateStatus(vm *vmapi.VirtualMachine, mutate func(status *vmapi.VirtualMachineStatus)) error {
+	updated := vm.DeepCopy()
+	mutate(&updated.Status)
+	updated.Status.ObservedGeneration = vm.Generation
+	if equality.Semantic.DeepEqual(vm.Status, updated.Status) {
+		return nil
+	}
+
+	result, err := c.client.VirtualMachines(vm.Namespace).UpdateStatus(updated)
+	if err != nil {
+		return err
+	}
+	*vm = *result
+	return nil
+}
+
+// setCondition records a condition in the status. The transition time
+// is only bumped when the status of the condition changes.
+func setCondition(status *vmapi.VirtualMachineStatus, generation int64, conditionType vmapi.VirtualMachineConditionType, conditionStatus coreapi.ConditionStatus, reason, message string) {
+	condition := vmapi.VirtualMachineCondition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		LastTransitionTime: meta.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+	for i, existing := range status.Conditions {
+		if existing.Type != conditionType {
+			continue
+		}
+		if existing.Status == conditionStatus {
+			condition.LastTransitionTime = existing.LastTransitionTime
+		}
+		status.Conditions[i] = condition
+		return
+	}
+	status.Conditions = append(status.Conditions, condition)
+}
+
+// getCondition returns the condition of the given type, or nil
+// if it has not been recorded.
+func getCondition(status vmapi.VirtualMachineStatus, conditionType vmapi.VirtualMachineConditionType) *vmapi.VirtualMachineCondition {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == conditionType {
+			return &status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// isConditionTrue determines if the condition of the given type
+// has been recorded as true.
+func isConditionTrue(status vmapi.VirtualMachineStatus, conditionType vmapi.VirtualMachineConditionType) bool {
+	condition := getCondition(status, conditionType)
+	return condition != nil && condition.Status == coreapi.ConditionTrue
+}
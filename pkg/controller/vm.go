@@ -0,0 +1,461 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// deleteVM deletes the instance of the VM, returning true once it no
+// longer exists. The deletion runs asynchronously; the VM is requeued
+// until it has completed. Failed deletions are retried, so that the
+// finalizer is only removed once the instance is gone.
+func (c *Controller) deleteVM(vm *vmapi.VirtualMachine) (bool, error) {
+	logger := c.logger.WithFields(logrus.Fields{
+		"virtual-machine": vm.Name,
+		"namespace":       vm.Namespace,
+	})
+
+	if vm.Status.Operation != nil {
+		completed, err := c.pollOperation(vm, logger)
+		if err != nil || completed == nil {
+			return false, err
+		}
+		if completed.Type == provider.OperationDelete && completed.err != nil {
+			logger.WithError(completed.err).Info("failed to delete VM")
+			return false, c.deletionFailed(vm, completed.err)
+		}
+	}
+
+	zone, err := c.zoneFor(vm)
+	if err != nil {
+		logger.WithError(err).Info("Skipped deleting a VM that could not have been created.")
+		return true, nil
+	}
+	name, err := c.instanceNameFor(vm)
+	if err != nil {
+		return false, fmt.Errorf("could not determine instance name: %v", err)
+	}
+
+	instance, err := c.provider.Get(zone, name)
+	if err != nil {
+		if err == provider.ErrNotFound {
+			logger.Infof("Skipped deleting a VM that is already deleted.")
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to check for existance of virtual machine: %v", err)
+	}
+
+	if !c.ownedBy(instance, vm) {
+		adoptable, err := c.mayAdopt(instance, vm)
+		if err != nil {
+			return false, err
+		}
+		if !adoptable {
+			logger.Warning("Skipped deleting a VM that belongs to another owner.")
+			return true, nil
+		}
+	}
+
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		setCondition(status, vm.Generation, vmapi.VirtualMachineDeleting, coreapi.ConditionTrue, reasonDeleting, "The instance is being deleted.")
+		setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionFalse, reasonDeleting, "The instance is being deleted.")
+	}); err != nil {
+		return false, fmt.Errorf("could not update status: %v", err)
+	}
+
+	logger.Info("deleting VM")
+	op, err := c.provider.Delete(zone, name)
+	if err != nil {
+		logger.WithError(err).Info("failed to delete VM")
+		return false, c.deletionFailed(vm, err)
+	}
+
+	return false, c.trackOperation(vm, op, logger)
+}
+
+// deletionFailed records that the instance of the VM could not be
+// deleted and returns the error, so that the deletion is retried.
+func (c *Controller) deletionFailed(vm *vmapi.VirtualMachine, err error) error {
+	err = fmt.Errorf("error deleting instance: %v", err)
+	if statusErr := c.handleError(vm, reasonDeletionFailed, err); statusErr != nil {
+		return fmt.Errorf("could not update status: %v", statusErr)
+	}
+	return err
+}
+
+// ensureVM ensures an instance exists to fulfill the request. A machine-local SSH
+// key is generated to access the root account for the machine. See:
+// https://cloud.google.com/compute/docs/instances/adding-removing-ssh-keys
+//
+// Every step that involves a provider operation records the operation in the
+// status and returns; the next reconcile of the VM resumes once the
+// operation has completed.
+func (c *Controller) ensureVM(vm *vmapi.VirtualMachine) error {
+	logger := c.logger.WithFields(logrus.Fields{
+		"virtual-machine": vm.Name,
+		"namespace":       vm.Namespace,
+	})
+
+	if vm.Status.Operation != nil {
+		completed, err := c.pollOperation(vm, logger)
+		if err != nil || completed == nil {
+			return err
+		}
+		if completed.err != nil {
+			return c.handleOperationError(vm, completed.VirtualMachineOperation, completed.err, logger)
+		}
+	}
+
+	if exhausted := zonesExhausted(vm); exhausted != nil {
+		if exhausted.ObservedGeneration == vm.Generation {
+			logger.Info("Skipped reconciling a VM for which no zone had capacity.")
+			return nil
+		}
+		// the spec has changed since, so every zone is tried anew
+		if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+			status.Zone = ""
+			status.ZoneAttempts = nil
+		}); err != nil {
+			return fmt.Errorf("could not update status: %v", err)
+		}
+	}
+
+	name, err := c.instanceNameFor(vm)
+	if err != nil {
+		return fmt.Errorf("could not determine instance name: %v", err)
+	}
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.InstanceName = name
+		if status.State.ProcessingPhase == "" {
+			status.State.ProcessingPhase = vmapi.ProcessingPhasePending
+			setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionFalse, reasonPending, "The VM has not yet been provisioned.")
+		}
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+	logger = logger.WithField("instance", name)
+
+	zone, err := c.zoneFor(vm)
+	if err != nil {
+		logger.WithError(err).Error("could not determine zone for VM")
+		return c.handleError(vm, reasonInvalidZone, err)
+	}
+
+	instance, err := c.provider.Get(zone, vm.Status.InstanceName)
+	if err != nil {
+		if err != provider.ErrNotFound {
+			return fmt.Errorf("failed to check for existance of virtual machine: %v", err)
+		}
+		return c.createNewVM(vm, zone, logger)
+	}
+
+	if !c.ownedBy(instance, vm) {
+		adoptable, err := c.mayAdopt(instance, vm)
+		if err != nil {
+			return err
+		}
+		if !adoptable {
+			logger.Error("refusing to use a VM that belongs to another owner")
+			return c.handleError(vm, reasonInstanceConflict, fmt.Errorf("instance %s in zone %s does not belong to this VirtualMachine", instance.Name, zone))
+		}
+		return c.adoptInstance(vm, zone, instance, logger)
+	}
+	if isPreempted(vm, instance) {
+		return c.handlePreemption(vm, zone, logger)
+	}
+	if isSSHFailed(vm) {
+		logger.Info("Skipped reconciling a VM that never became reachable over SSH.")
+		return nil
+	}
+
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.Zone = zone
+		recordInstance(status, instance)
+		setCondition(status, vm.Generation, vmapi.VirtualMachineInstanceCreated, coreapi.ConditionTrue, reasonInstanceExists, "")
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+
+	connection, err := c.stagedConnection(vm)
+	if err != nil {
+		return err
+	}
+	if connection != nil {
+		if !hasSSHKey(instance, connection.pub) {
+			return c.installSSHKey(vm, zone, connection, logger)
+		}
+		return c.connect(vm, zone, instance, connection, logger)
+	}
+
+	secret, err := c.kubeClient.CoreV1().Secrets(vm.Namespace).Get(vm.Name, meta.GetOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return fmt.Errorf("failed to check for existance of secret: %v", err)
+	}
+	if err != nil || !ownsSecret(vm, secret) || !hasConnectionDetails(secret) {
+		if isSSHKeyRefreshUnsupported(vm) {
+			logger.Debug("Skipped regenerating the SSH key, which the provider cannot install.")
+			return nil
+		}
+		logger.Infof("Regenerating SSH key for existing VM.")
+		return c.refreshSSHKey(vm, zone, logger)
+	}
+
+	logger.Infof("Skipped creating a VM that is already created.")
+	return c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSecretPublished, coreapi.ConditionTrue, reasonPublished, "")
+		// VMs provisioned before conditions were recorded
+		// have no record of their readiness
+		if getCondition(*status, vmapi.VirtualMachineReady) == nil {
+			status.State.ProcessingPhase = vmapi.ProcessingPhaseProvisioned
+			setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionTrue, reasonProvisioned, "")
+		}
+	})
+}
+
+// handleOperationError reacts to a provider operation for the VM having
+// failed. Instances that could not be created for lack of capacity are
+// retried in another zone; other failures mark the VM as failed.
+func (c *Controller) handleOperationError(vm *vmapi.VirtualMachine, op *vmapi.VirtualMachineOperation, err error, logger *logrus.Entry) error {
+	logger.WithError(err).Error("failed to run operation on VM")
+	if op.Type == provider.OperationCreate && provider.IsCapacityError(err) && !isConditionTrue(vm.Status, vmapi.VirtualMachineInstanceCreated) {
+		return c.failover(vm, op.Zone, err, logger)
+	}
+	return c.handleError(vm, reasonOperationFailed, fmt.Errorf("error running %v operation: %v", op.Type, err))
+}
+
+// zoneFor determines the zone the VM lives in. Once a zone has been
+// chosen it is recorded in the status so that later operations on the
+// VM target the same zone.
+func (c *Controller) zoneFor(vm *vmapi.VirtualMachine) (string, error) {
+	if vm.Status.Zone != "" {
+		return vm.Status.Zone, nil
+	}
+	return c.config.chooseZone(vm, c.provider.Zones())
+}
+
+func (c *Controller) createNewVM(vm *vmapi.VirtualMachine, zone string, logger *logrus.Entry) error {
+	logger = logger.WithField("zone", zone)
+
+	// a previous attempt may have staged the connection before
+	// the operator was restarted, in which case the instance may
+	// already be in the process of being created with it
+	connection, err := c.stagedConnection(vm)
+	if err != nil {
+		return err
+	}
+	staged := connection != nil && connection.instance != nil && connection.zone == zone
+
+	// scripts are resolved before the VM is marked as provisioning and
+	// before a key pair is generated: until the spec or the objects the
+	// scripts refer to change, the same failure is found again and the
+	// VM is left as it is
+	var startupScript, userData string
+	if !staged {
+		if startupScript, userData, err = c.resolveScripts(vm); err != nil {
+			if failedWith(vm, reasonInvalidScript, err) {
+				logger.WithError(err).Debug("Skipped provisioning a VM whose scripts still cannot be resolved.")
+				return nil
+			}
+			logger.WithError(err).Error("could not resolve scripts for VM")
+			return c.handleError(vm, reasonInvalidScript, err)
+		}
+	}
+
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.Zone = zone
+		status.State.ProcessingPhase = vmapi.ProcessingPhaseProvisioning
+		status.State.Message = ""
+		setCondition(status, vm.Generation, vmapi.VirtualMachineInstanceCreated, coreapi.ConditionFalse, reasonCreating, "The instance is being created.")
+		setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionFalse, reasonProvisioning, "The instance is being created.")
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+
+	if connection == nil {
+		if connection, err = newPendingConnection(logger); err != nil {
+			return err
+		}
+	}
+	if !staged {
+		spec := c.instanceSpecFor(vm, zone, connection)
+		spec.StartupScript = startupScript
+		spec.UserData = userData
+		connection.zone = zone
+		connection.instance = spec
+	}
+	if err := c.stageConnection(vm, connection); err != nil {
+		return err
+	}
+
+	logger.Info("creating VM")
+	op, err := c.provider.Create(connection.instance)
+	if err == provider.ErrAlreadyExists {
+		logger.Info("VM was already created")
+		c.enqueue(vm)
+		return nil
+	}
+	if err != nil {
+		return c.handleOperationError(vm, &vmapi.VirtualMachineOperation{Type: provider.OperationCreate, Zone: zone}, err, logger)
+	}
+
+	return c.trackOperation(vm, op, logger)
+}
+
+// instanceSpecFor describes the instance for the VM in the zone,
+// accessible with the key pair of the connection.
+func (c *Controller) instanceSpecFor(vm *vmapi.VirtualMachine, zone string, connection *pendingConnection) *provider.InstanceSpec {
+	return &provider.InstanceSpec{
+		Name:      vm.Status.InstanceName,
+		Zone:      zone,
+		Labels:    c.instanceLabels(vm),
+		User:      connection.user,
+		PublicKey: connection.pub,
+		Spec:      vm.Spec,
+	}
+}
+
+// failover records that provisioning in the zone failed for lack of
+// capacity and moves the VM to the next candidate zone that has not yet
+// been attempted, if there is one.
+func (c *Controller) failover(vm *vmapi.VirtualMachine, zone string, err error, logger *logrus.Entry) error {
+	attempt := vmapi.ZoneAttempt{
+		Zone:    zone,
+		Time:    meta.Now(),
+		Message: strings.TrimSpace(err.Error()),
+	}
+	if capacityErr, ok := err.(*provider.CapacityError); ok {
+		attempt.Reason = strings.Join(capacityErr.Codes, ",")
+	}
+	attempted := sets.NewString(zone)
+	for _, previous := range vm.Status.ZoneAttempts {
+		attempted.Insert(previous.Zone)
+	}
+
+	candidates, candidateErr := c.config.candidateZones(vm, c.provider.Zones())
+	if candidateErr != nil {
+		return c.handleError(vm, reasonInvalidZone, candidateErr)
+	}
+	next := ""
+	for _, candidate := range candidates {
+		if !attempted.Has(candidate) {
+			next = candidate
+			break
+		}
+	}
+
+	recordAttempt := func(status *vmapi.VirtualMachineStatus) {
+		for i := range status.ZoneAttempts {
+			if status.ZoneAttempts[i].Zone == zone {
+				status.ZoneAttempts[i] = attempt
+				return
+			}
+		}
+		status.ZoneAttempts = append(status.ZoneAttempts, attempt)
+	}
+
+	if next == "" {
+		logger.Warning("no zones with capacity remain for VM")
+		if err := c.updateStatus(vm, recordAttempt); err != nil {
+			return fmt.Errorf("could not update status: %v", err)
+		}
+		return c.handleError(vm, reasonZonesExhausted, fmt.Errorf("no capacity in any of zones %s: %v", strings.Join(attempted.List(), ", "), err))
+	}
+
+	logger.WithField("next-zone", next).Info("failing over to next zone")
+	if err := c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		recordAttempt(status)
+		status.Zone = next
+		message := fmt.Sprintf("No capacity in zone %s, retrying in zone %s.", zone, next)
+		setCondition(status, vm.Generation, vmapi.VirtualMachineInstanceCreated, coreapi.ConditionFalse, reasonZoneExhausted, message)
+	}); err != nil {
+		return fmt.Errorf("could not update status: %v", err)
+	}
+	c.enqueue(vm)
+	return nil
+}
+
+// zonesExhausted returns the readiness condition of the VM if it was
+// marked as failed because no candidate zone had capacity for it.
+func zonesExhausted(vm *vmapi.VirtualMachine) *vmapi.VirtualMachineCondition {
+	ready := getCondition(vm.Status, vmapi.VirtualMachineReady)
+	if vm.Status.State.ProcessingPhase != vmapi.ProcessingPhaseError || ready == nil || ready.Reason != reasonZonesExhausted {
+		return nil
+	}
+	return ready
+}
+
+// failedWith determines if the error was already recorded for the
+// current generation of the VM as the reason it is not ready.
+func failedWith(vm *vmapi.VirtualMachine, reason string, err error) bool {
+	ready := getCondition(vm.Status, vmapi.VirtualMachineReady)
+	return ready != nil && ready.Reason == reason && ready.ObservedGeneration == vm.Generation && ready.Message == err.Error()
+}
+
+// handleError records the error in the status of the VirtualMachine,
+// marking it as not ready for the given reason.
+func (c *Controller) handleError(vm *vmapi.VirtualMachine, reason string, err error) error {
+	return c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		status.State.ProcessingPhase = vmapi.ProcessingPhaseError
+		status.State.Message = err.Error()
+		setCondition(status, vm.Generation, vmapi.VirtualMachineReady, coreapi.ConditionFalse, reason, err.Error())
+	})
+}
+
+// refreshSSHKey installs a new key pair on an instance for which no
+// connection secret exists.
+func (c *Controller) refreshSSHKey(vm *vmapi.VirtualMachine, zone string, logger *logrus.Entry) error {
+	connection, err := newPendingConnection(logger)
+	if err != nil {
+		return err
+	}
+	connection.zone = zone
+	if err := c.stageConnection(vm, connection); err != nil {
+		return err
+	}
+	return c.installSSHKey(vm, zone, connection, logger)
+}
+
+// installSSHKey adds the staged key pair to the instance.
+func (c *Controller) installSSHKey(vm *vmapi.VirtualMachine, zone string, connection *pendingConnection, logger *logrus.Entry) error {
+	logger.Info("adding new SSH key to VM")
+	op, err := c.provider.SetSSHKey(c.instanceSpecFor(vm, zone, connection))
+	if err == provider.ErrUnsupported {
+		return c.skipSSHKeyRefresh(vm, logger)
+	}
+	if err != nil {
+		return c.handleOperationError(vm, &vmapi.VirtualMachineOperation{Type: provider.OperationSetSSHKey, Zone: zone}, err, logger)
+	}
+
+	return c.trackOperation(vm, op, logger)
+}
+
+// skipSSHKeyRefresh records that the provider cannot install a new key
+// pair on the instance, so that no connection secret can be published
+// for it, and that later reconciles need not try again.
+func (c *Controller) skipSSHKeyRefresh(vm *vmapi.VirtualMachine, logger *logrus.Entry) error {
+	logger.Warning("the provider cannot install a new SSH key on the VM")
+	if err := c.clearStagedConnection(vm); err != nil {
+		return err
+	}
+	c.recorder.Event(vm, coreapi.EventTypeWarning, reasonSSHKeyUnsupported, "The provider cannot install a new SSH key on the instance, so the connection secret cannot be recreated.")
+	return c.updateStatus(vm, func(status *vmapi.VirtualMachineStatus) {
+		setCondition(status, vm.Generation, vmapi.VirtualMachineSecretPublished, coreapi.ConditionFalse, reasonSSHKeyUnsupported, "The provider cannot install a new SSH key on the instance, so the connection secret cannot be recreated.")
+	})
+}
+
+// isSSHKeyRefreshUnsupported determines if the provider was found to be
+// unable to install a new key pair on the instance of the VM.
+func isSSHKeyRefreshUnsupported(vm *vmapi.VirtualMachine) bool {
+	condition := getCondition(vm.Status, vmapi.VirtualMachineSecretPublished)
+	return condition != nil && condition.Status == coreapi.ConditionFalse && condition.Reason == reasonSSHKeyUnsupported
+}
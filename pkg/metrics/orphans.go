@@ -0,0 +1,34 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// OrphanActionDeleted marks orphaned instances that were deleted
+	OrphanActionDeleted = "deleted"
+	// OrphanActionReported marks orphaned instances that were only
+	// reported, as the collector runs in dry-run mode
+	OrphanActionReported = "reported"
+	// OrphanActionFailed marks orphaned instances that could not be deleted
+	OrphanActionFailed = "failed"
+)
+
+var (
+	// OrphanedInstances counts the instances found without an owning
+	// VirtualMachine, by zone and by the action taken on them
+	OrphanedInstances = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ci_vm_operator_orphaned_instances_total",
+		Help: "Instances found without an owning VirtualMachine, by zone and the action taken on them.",
+	}, []string{"zone", "action"})
+	// OrphanCollections counts the garbage collection passes that
+	// completed or failed
+	OrphanCollections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ci_vm_operator_orphan_collections_total",
+		Help: "Passes of the orphaned instance garbage collector, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(OrphanedInstances, OrphanCollections)
+}
@@ -0,0 +1,195 @@
+package aws
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	apiVersion = "2016-11-15"
+	service    = "ec2"
+
+	signingAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat    = "20060102T150405Z"
+	scopeDateFormat  = "20060102"
+)
+
+// Client calls actions of the EC2 Query API.
+type Client interface {
+	// Do calls the action in the region with the parameters,
+	// decoding the response into the result.
+	Do(region, action string, params url.Values, result interface{}) error
+}
+
+// Credentials authenticate requests to the API.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsFromEnvironment reads the credentials from the environment
+// variables the AWS tools use.
+func CredentialsFromEnvironment() (Credentials, error) {
+	credentials := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return credentials, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return credentials, nil
+}
+
+// NewClient returns a client that signs requests with the credentials.
+// Requests are sent to the regional endpoints of EC2 unless an endpoint
+// is given, as for a local stand-in for the API.
+func NewClient(credentials Credentials, endpoint string) Client {
+	return &ec2Client{
+		credentials: credentials,
+		endpoint:    endpoint,
+		client:      &http.Client{Timeout: time.Minute},
+	}
+}
+
+type ec2Client struct {
+	credentials Credentials
+	endpoint    string
+	client      *http.Client
+}
+
+func (c *ec2Client) Do(region, action string, params url.Values, result interface{}) error {
+	endpoint := c.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://ec2.%s.amazonaws.com/", region)
+	}
+	form := url.Values{}
+	for key, values := range params {
+		form[key] = values
+	}
+	form.Set("Action", action)
+	form.Set("Version", apiVersion)
+	body := form.Encode()
+
+	request, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	sign(request, []byte(body), c.credentials, region, time.Now().UTC())
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("could not call %s: %v", action, err)
+	}
+	defer response.Body.Close()
+	raw, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response to %s: %v", action, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return errorFrom(response.StatusCode, raw)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(raw, result); err != nil {
+		return fmt.Errorf("could not parse response to %s: %v", action, err)
+	}
+	return nil
+}
+
+// sign adds a Signature Version 4 authorization to the request.
+func sign(request *http.Request, body []byte, credentials Credentials, region string, now time.Time) {
+	amzDate := now.Format(amzDateFormat)
+	scope := strings.Join([]string{now.Format(scopeDateFormat), region, service, "aws4_request"}, "/")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if credentials.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		request.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hashHex(body),
+	}, "\n")
+	stringToSign := strings.Join([]string{signingAlgorithm, amzDate, scope, hashHex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+credentials.SecretAccessKey), now.Format(scopeDateFormat))
+	for _, part := range []string{region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", signingAlgorithm, credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hashHex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// APIError is returned when EC2 rejects a request.
+type APIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// errorFrom decodes the error EC2 responded with.
+func errorFrom(statusCode int, body []byte) error {
+	response := struct {
+		Errors []struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Errors>Error"`
+	}{}
+	if err := xml.Unmarshal(body, &response); err != nil || len(response.Errors) == 0 {
+		return &APIError{StatusCode: statusCode, Code: http.StatusText(statusCode), Message: strings.TrimSpace(string(body))}
+	}
+	return &APIError{StatusCode: statusCode, Code: response.Errors[0].Code, Message: response.Errors[0].Message}
+}
@@ -0,0 +1,47 @@
+package aws
+
+import (
+	"strings"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// capacityErrorCodes are the error codes with which EC2 reports that an
+// availability zone cannot currently fit an instance.
+var capacityErrorCodes = map[string]bool{
+	"InsufficientInstanceCapacity":         true,
+	"InsufficientHostCapacity":             true,
+	"InsufficientReservedInstanceCapacity": true,
+	"InsufficientFreeAddressesInSubnet":    true,
+	"InstanceLimitExceeded":                true,
+	"VcpuLimitExceeded":                    true,
+	"MaxSpotInstanceCountExceeded":         true,
+	"SpotMaxPriceTooLow":                   true,
+	// the instance type is not offered in the zone
+	"Unsupported": true,
+}
+
+// translateError maps errors from EC2 to those of the provider contract.
+// The reasons instances were terminated for are prefixed with Server or
+// Client, which is ignored.
+func translateError(err error) error {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		return err
+	}
+	code := apiErr.Code
+	if index := strings.Index(code, "."); index >= 0 && (code[:index] == "Server" || code[:index] == "Client") {
+		code = code[index+1:]
+	}
+	switch {
+	case code == "InvalidInstanceID.NotFound":
+		return provider.ErrNotFound
+	case code == "IdempotentParameterMismatch":
+		// an instance was launched for the attempt already, with
+		// user data that differs in the host key it was given
+		return provider.ErrAlreadyExists
+	case capacityErrorCodes[code]:
+		return &provider.CapacityError{Codes: []string{code}, Message: apiErr.Error()}
+	}
+	return err
+}
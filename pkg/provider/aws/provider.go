@@ -0,0 +1,510 @@
+// Package aws implements the provider contract for Amazon EC2, calling the
+// EC2 Query API directly. Instances are given their SSH key by cloud-init
+// through their user data, and report their host keys on their console.
+package aws
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/cloudinit"
+)
+
+const (
+	// Name identifies the provider in the configuration
+	Name = "aws"
+
+	// tagName holds the name of an instance, as
+	// the EC2 console shows it
+	tagName = "Name"
+
+	stateRunning = "running"
+	stateStopped = "stopped"
+	// instances linger in the terminated state for
+	// some time after they are deleted
+	stateTerminated = "terminated"
+
+	defaultVolumeType = "gp2"
+)
+
+// liveStates are the states of instances that have not been deleted.
+var liveStates = []string{"pending", "running", "shutting-down", "stopping", "stopped"}
+
+// defaultInstanceTypes map standard GCE machine types to instance types
+// with at least as many vCPUs and as much memory.
+var defaultInstanceTypes = map[string]string{
+	"n1-standard-1":  "m5.large",
+	"n1-standard-2":  "m5.large",
+	"n1-standard-4":  "m5.xlarge",
+	"n1-standard-8":  "m5.2xlarge",
+	"n1-standard-16": "m5.4xlarge",
+	"n1-standard-32": "m5.8xlarge",
+	"n1-standard-64": "m5.16xlarge",
+	"n1-standard-96": "m5.24xlarge",
+}
+
+// volumeTypes map GCE disk types to EBS volume types.
+var volumeTypes = map[vmapi.VirtualMachineDiskType]string{
+	vmapi.VirtualMachineDiskTypePersistentStandard: "standard",
+	vmapi.VirtualMachineDiskTypePersistentSSD:      "gp2",
+}
+
+// Config configures the instances the provider creates.
+type Config struct {
+	// Endpoint is the URL requests are sent to instead of the
+	// regional endpoints of EC2, as for a local stand-in
+	Endpoint string `json:"endpoint,omitempty"`
+	// Zones are the availability zones instances may be
+	// created in
+	Zones []string `json:"zones"`
+	// InstanceTypes maps the machine type of a VirtualMachine
+	// to an instance type, overriding the defaults for standard
+	// GCE machine types
+	InstanceTypes map[string]string `json:"instanceTypes,omitempty"`
+	// Images maps the image family of the boot disk of a
+	// VirtualMachine to the AMIs to choose the newest of
+	Images map[string]ImageLookup `json:"images"`
+	// Subnets maps availability zones to the subnet instances
+	// are attached to unless they request a subnetwork; the
+	// default subnet is used for zones not listed
+	Subnets map[string]string `json:"subnets,omitempty"`
+	// SecurityGroups are the IDs of the security groups
+	// instances are attached to
+	SecurityGroups []string `json:"securityGroups,omitempty"`
+}
+
+// ImageLookup identifies a series of AMIs.
+type ImageLookup struct {
+	// Name is a pattern the names of the AMIs match, as in
+	// CentOS Linux 7 x86_64*
+	Name string `json:"name"`
+	// Owner is the account ID or alias of the owner of the
+	// AMIs, as in amazon or self
+	Owner string `json:"owner"`
+}
+
+// New returns a provider that manages instances with the client.
+func New(config Config, client Client) provider.Provider {
+	return &awsProvider{config: config, client: client}
+}
+
+type awsProvider struct {
+	config Config
+	client Client
+}
+
+var _ provider.Provider = &awsProvider{}
+
+// Zones lists the configured availability zones, which are in the
+// region their name without the trailing letter refers to.
+func (p *awsProvider) Zones() []provider.Zone {
+	var zones []provider.Zone
+	for _, zone := range p.config.Zones {
+		zones = append(zones, provider.Zone{Name: zone, Region: regionOf(zone)})
+	}
+	return zones
+}
+
+func (p *awsProvider) Create(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	if err := p.checkZone(spec.Zone); err != nil {
+		return nil, err
+	}
+	if _, err := p.find(spec.Zone, spec.Name); err != provider.ErrNotFound {
+		if err == nil {
+			return nil, provider.ErrAlreadyExists
+		}
+		return nil, err
+	}
+
+	instanceType, ok := p.config.InstanceTypes[string(spec.Spec.MachineType)]
+	if !ok {
+		if instanceType, ok = defaultInstanceTypes[string(spec.Spec.MachineType)]; !ok {
+			return nil, fmt.Errorf("machine type %q is not supported", spec.Spec.MachineType)
+		}
+	}
+	image, err := p.imageFor(regionOf(spec.Zone), spec.Spec.BootDisk.ImageFamily)
+	if err != nil {
+		return nil, err
+	}
+	// the host key cloud-init is given is read back from
+	// the console, like those of instances we did not seed
+	userData, _, err := cloudinit.UserData(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	params := url.Values{}
+	params.Set("ClientToken", clientTokenFor(spec))
+	params.Set("ImageId", image.ImageID)
+	params.Set("InstanceType", instanceType)
+	params.Set("MinCount", "1")
+	params.Set("MaxCount", "1")
+	params.Set("UserData", base64.StdEncoding.EncodeToString(userData))
+	params.Set("Placement.AvailabilityZone", spec.Zone)
+
+	volumeType, ok := volumeTypes[spec.Spec.BootDisk.Type]
+	if !ok {
+		volumeType = defaultVolumeType
+	}
+	params.Set("BlockDeviceMapping.1.DeviceName", image.RootDeviceName)
+	params.Set("BlockDeviceMapping.1.Ebs.VolumeSize", fmt.Sprintf("%d", spec.Spec.BootDisk.SizeGB))
+	params.Set("BlockDeviceMapping.1.Ebs.VolumeType", volumeType)
+	params.Set("BlockDeviceMapping.1.Ebs.DeleteOnTermination", "true")
+
+	if err := p.setNetworkParams(params, spec); err != nil {
+		return nil, err
+	}
+	if scheduling := spec.Spec.Scheduling; scheduling != nil && scheduling.Preemptible {
+		params.Set("InstanceMarketOptions.MarketType", "spot")
+		params.Set("InstanceMarketOptions.SpotOptions.SpotInstanceType", "one-time")
+		params.Set("InstanceMarketOptions.SpotOptions.InstanceInterruptionBehavior", "terminate")
+	}
+
+	tags := map[string]string{tagName: spec.Name}
+	for key, value := range spec.Labels {
+		tags[key] = value
+	}
+	for i, resourceType := range []string{"instance", "volume"} {
+		prefix := fmt.Sprintf("TagSpecification.%d", i+1)
+		params.Set(prefix+".ResourceType", resourceType)
+		setTagParams(params, prefix+".Tag", tags)
+	}
+
+	response := runInstancesResponse{}
+	if err := p.client.Do(regionOf(spec.Zone), "RunInstances", params, &response); err != nil {
+		return nil, translateError(err)
+	}
+	if len(response.Instances) == 0 {
+		return nil, errors.New("no instance was launched")
+	}
+	return operationFor(spec.Zone, response.Instances[0].InstanceID, provider.OperationCreate), nil
+}
+
+func (p *awsProvider) Get(zone, name string) (*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	found, err := p.find(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	instance := instanceFrom(found)
+
+	params := url.Values{}
+	params.Set("InstanceId", found.InstanceID)
+	params.Set("Attribute", "userData")
+	response := describeInstanceAttributeResponse{}
+	if err := p.client.Do(regionOf(zone), "DescribeInstanceAttribute", params, &response); err != nil {
+		return nil, translateError(err)
+	}
+	if userData, err := base64.StdEncoding.DecodeString(response.UserData.Value); err == nil {
+		instance.AuthorizedKeys = cloudinit.AuthorizedKeys(userData)
+	}
+	return instance, nil
+}
+
+func (p *awsProvider) Delete(zone, name string) (*provider.Operation, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	found, err := p.find(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("InstanceId.1", found.InstanceID)
+	if err := p.client.Do(regionOf(zone), "TerminateInstances", params, nil); err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(zone, found.InstanceID, provider.OperationDelete), nil
+}
+
+// SetSSHKey fails, as cloud-init only installs keys from the user data
+// when the instance first boots.
+func (p *awsProvider) SetSSHKey(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	return nil, provider.ErrUnsupported
+}
+
+// SetLabels adds the labels to the tags of the instance.
+func (p *awsProvider) SetLabels(zone, name string, labels map[string]string) (*provider.Operation, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	found, err := p.find(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("ResourceId.1", found.InstanceID)
+	setTagParams(params, "Tag", labels)
+	if err := p.client.Do(regionOf(zone), "CreateTags", params, nil); err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(zone, found.InstanceID, provider.OperationSetLabels), nil
+}
+
+// Poll checks on the state of the instance the operation changed, as
+// EC2 has no operations to wait for. An instance is created once it is
+// running, and deleted once it is terminated.
+func (p *awsProvider) Poll(op *provider.Operation) (*provider.OperationStatus, error) {
+	if op.Type != provider.OperationCreate && op.Type != provider.OperationDelete {
+		return &provider.OperationStatus{Done: true, Message: "completed"}, nil
+	}
+	params := url.Values{}
+	params.Set("InstanceId.1", op.Name)
+	response := describeInstancesResponse{}
+	err := p.client.Do(regionOf(op.Zone), "DescribeInstances", params, &response)
+	if err != nil && translateError(err) != provider.ErrNotFound {
+		return nil, err
+	}
+	instances := response.instances()
+	if len(instances) == 0 {
+		if op.Type == provider.OperationDelete {
+			return &provider.OperationStatus{Done: true, Message: "the instance no longer exists"}, nil
+		}
+		// new instances are not described right away
+		return &provider.OperationStatus{Message: "waiting for the instance to be described"}, nil
+	}
+
+	found := instances[0]
+	status := &provider.OperationStatus{Message: found.State.Name}
+	switch op.Type {
+	case provider.OperationCreate:
+		switch found.State.Name {
+		case stateRunning, stateStopped:
+			status.Done = true
+		case stateTerminated, "shutting-down":
+			status.Done = true
+			status.Error = errors.New("the instance was terminated")
+			if found.StateReason.Code != "" {
+				status.Error = translateError(&APIError{Code: found.StateReason.Code, Message: found.StateReason.Message})
+			}
+		}
+	case provider.OperationDelete:
+		status.Done = found.State.Name == stateTerminated
+	}
+	return status, nil
+}
+
+// List lists the instances in the zone that carry all of the labels as
+// tags. The authorized keys of the instances are not looked up.
+func (p *awsProvider) List(zone string, labels map[string]string) ([]*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	filters := map[string][]string{}
+	for key, value := range labels {
+		filters["tag:"+key] = []string{value}
+	}
+	found, err := p.describe(zone, filters)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*provider.Instance
+	for i := range found {
+		instances = append(instances, instanceFrom(&found[i]))
+	}
+	return instances, nil
+}
+
+// HostKeys reads the host keys cloud-init printed on the console of the
+// instance, if it has done so yet.
+func (p *awsProvider) HostKeys(zone, name string) ([]ssh.PublicKey, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	found, err := p.find(zone, name)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{}
+	params.Set("InstanceId", found.InstanceID)
+	params.Set("Latest", "true")
+	response := getConsoleOutputResponse{}
+	if err := p.client.Do(regionOf(zone), "GetConsoleOutput", params, &response); err != nil {
+		return nil, fmt.Errorf("could not get console output: %v", translateError(err))
+	}
+	output, err := base64.StdEncoding.DecodeString(response.Output)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode console output: %v", err)
+	}
+	return cloudinit.ParseHostKeys(string(output)), nil
+}
+
+// find looks up the instance with the name in the zone that has not
+// been deleted.
+func (p *awsProvider) find(zone, name string) (*instance, error) {
+	found, err := p.describe(zone, map[string][]string{"tag:" + tagName: {name}})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, provider.ErrNotFound
+	}
+	return &found[0], nil
+}
+
+// describe lists the instances in the zone that match the filters and
+// have not been deleted.
+func (p *awsProvider) describe(zone string, filters map[string][]string) ([]instance, error) {
+	filters["availability-zone"] = []string{zone}
+	filters["instance-state-name"] = liveStates
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := url.Values{}
+	for i, name := range names {
+		prefix := fmt.Sprintf("Filter.%d", i+1)
+		params.Set(prefix+".Name", name)
+		for j, value := range filters[name] {
+			params.Set(fmt.Sprintf("%s.Value.%d", prefix, j+1), value)
+		}
+	}
+	response := describeInstancesResponse{}
+	if err := p.client.Do(regionOf(zone), "DescribeInstances", params, &response); err != nil {
+		return nil, translateError(err)
+	}
+	return response.instances(), nil
+}
+
+// imageFor looks up the newest available AMI for the image family.
+func (p *awsProvider) imageFor(region, family string) (*image, error) {
+	lookup, ok := p.config.Images[family]
+	if !ok {
+		return nil, fmt.Errorf("no image is configured for image family %q", family)
+	}
+	params := url.Values{}
+	params.Set("Owner.1", lookup.Owner)
+	params.Set("Filter.1.Name", "name")
+	params.Set("Filter.1.Value.1", lookup.Name)
+	params.Set("Filter.2.Name", "state")
+	params.Set("Filter.2.Value.1", "available")
+	response := describeImagesResponse{}
+	if err := p.client.Do(region, "DescribeImages", params, &response); err != nil {
+		return nil, fmt.Errorf("could not look up images: %v", err)
+	}
+	if len(response.Images) == 0 {
+		return nil, fmt.Errorf("no image matches %q", lookup.Name)
+	}
+	// creation dates are in ISO 8601 and sort as strings
+	newest := &response.Images[0]
+	for i := range response.Images {
+		if response.Images[i].CreationDate > newest.CreationDate {
+			newest = &response.Images[i]
+		}
+	}
+	return newest, nil
+}
+
+// setNetworkParams attaches the instance to its subnet, with a public
+// address unless it has no external access.
+func (p *awsProvider) setNetworkParams(params url.Values, spec *provider.InstanceSpec) error {
+	subnet := p.config.Subnets[spec.Zone]
+	public := true
+	if network := spec.Spec.Network; network != nil {
+		if network.ExternalAccess == vmapi.VirtualMachineExternalAccessStatic {
+			return errors.New("static addresses are not supported on EC2")
+		}
+		if network.Subnetwork != "" {
+			subnet = network.Subnetwork
+		}
+		public = network.ExternalAccess != vmapi.VirtualMachineExternalAccessNone
+	}
+
+	params.Set("NetworkInterface.1.DeviceIndex", "0")
+	params.Set("NetworkInterface.1.AssociatePublicIpAddress", fmt.Sprintf("%t", public))
+	if subnet != "" {
+		params.Set("NetworkInterface.1.SubnetId", subnet)
+	}
+	for i, group := range p.config.SecurityGroups {
+		params.Set(fmt.Sprintf("NetworkInterface.1.SecurityGroupId.%d", i+1), group)
+	}
+	return nil
+}
+
+// checkZone ensures that the zone is one the provider manages.
+func (p *awsProvider) checkZone(zone string) error {
+	for _, known := range p.config.Zones {
+		if known == zone {
+			return nil
+		}
+	}
+	return fmt.Errorf("zone %q is not supported", zone)
+}
+
+// setTagParams adds the tags to the parameters in a stable order.
+func setTagParams(params url.Values, prefix string, tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		params.Set(fmt.Sprintf("%s.%d.Key", prefix, i+1), key)
+		params.Set(fmt.Sprintf("%s.%d.Value", prefix, i+1), tags[key])
+	}
+}
+
+// instanceFrom describes the instance in the terms of the provider
+// contract. Instances the provider creates are never stopped, so an
+// instance that was stopped or is being terminated by EC2 for lack of
+// spot capacity is reported as terminated.
+func instanceFrom(found *instance) *provider.Instance {
+	labels := found.tags()
+	name := labels[tagName]
+	delete(labels, tagName)
+	described := &provider.Instance{
+		Name:        name,
+		Zone:        found.Placement.AvailabilityZone,
+		ID:          found.InstanceID,
+		MachineType: found.InstanceType,
+		Image:       found.ImageID,
+		InternalIP:  found.PrivateIPAddress,
+		ExternalIP:  found.IPAddress,
+		Labels:      labels,
+		Terminated:  found.State.Name == stateStopped || found.StateReason.Code == "Server.SpotInstanceTermination",
+	}
+	if created, err := time.Parse(time.RFC3339, found.LaunchTime); err == nil {
+		described.Created = created
+	}
+	return described
+}
+
+// clientTokenFor identifies the attempt to create the instance, so that
+// EC2 launches a single instance however often the request is retried,
+// even if the instance is not yet listed when it is. The controller keeps
+// the name, zone and key pair of an attempt until it has succeeded, and
+// uses a new key pair to replace the instance, which must not be taken
+// for the one it replaces.
+func clientTokenFor(spec *provider.InstanceSpec) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s", spec.Name, spec.Zone, strings.TrimSpace(spec.PublicKey))))
+	return hex.EncodeToString(hash[:])
+}
+
+// regionOf determines the region of the availability zone.
+func regionOf(zone string) string {
+	return strings.TrimRight(zone, "abcdefghijklmnopqrstuvwxyz")
+}
+
+// operationFor identifies a change to an instance. EC2 has no operations
+// to wait for, so the operation is named after the instance to poll.
+func operationFor(zone, instanceID, operationType string) *provider.Operation {
+	return &provider.Operation{
+		Name: instanceID,
+		Zone: zone,
+		Type: operationType,
+	}
+}
@@ -0,0 +1,587 @@
+package aws
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	zone      = "us-east-1a"
+	publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILyxEa9JZiX0xiJFKnergptOnVslKGOwFvZLDzgddBuI"
+	hostKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIg+kVde4NoOxJuSImLUa/rQ0rHV+yLE3Oq4xoFbPB6H"
+)
+
+// fakeEC2 stands in for the EC2 Query API, serving the actions the
+// provider calls from the instances it launched.
+type fakeEC2 struct {
+	t *testing.T
+
+	lock      sync.Mutex
+	images    []image
+	instances []*fakeInstance
+	// launched maps client tokens to the instances launched for them
+	launched map[string]*fakeInstance
+	// unlisted hides instances from filtered descriptions, as EC2
+	// does for some time after they are launched
+	unlisted bool
+	// fail maps actions to the error code to reject them with
+	fail map[string]string
+	// requests are the parameters of the requests, by action
+	requests map[string][]url.Values
+
+	server *httptest.Server
+}
+
+// returnResponse is the response to actions that return nothing else.
+type returnResponse struct {
+	Return bool `xml:"return"`
+}
+
+type fakeInstance struct {
+	instance
+	userData string
+	console  string
+}
+
+func newFakeEC2(t *testing.T) *fakeEC2 {
+	return &fakeEC2{
+		t: t,
+		images: []image{
+			{ImageID: "ami-old", Name: "CentOS 7 1805", CreationDate: "2018-05-01T00:00:00.000Z", RootDeviceName: "/dev/sda1"},
+			{ImageID: "ami-new", Name: "CentOS 7 1808", CreationDate: "2018-08-01T00:00:00.000Z", RootDeviceName: "/dev/sda1"},
+		},
+		launched: map[string]*fakeInstance{},
+		fail:     map[string]string{},
+		requests: map[string][]url.Values{},
+	}
+}
+
+func (f *fakeEC2) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), signingAlgorithm+" Credential=AKID/") {
+		f.t.Errorf("expected a signed request, got authorization %q", r.Header.Get("Authorization"))
+	}
+	if err := r.ParseForm(); err != nil {
+		f.t.Errorf("could not parse request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := r.PostForm
+	action := params.Get("Action")
+	f.requests[action] = append(f.requests[action], params)
+	if code, ok := f.fail[action]; ok {
+		writeError(w, code)
+		return
+	}
+
+	var response interface{}
+	switch action {
+	case "DescribeImages":
+		response = describeImagesResponse{Images: f.images}
+	case "DescribeInstances":
+		found := describeInstancesResponse{}
+		found.Reservations = append(found.Reservations, struct {
+			Instances []instance `xml:"instancesSet>item"`
+		}{Instances: f.describe(params)})
+		response = found
+	case "RunInstances":
+		launched, code := f.run(params)
+		if code != "" {
+			writeError(w, code)
+			return
+		}
+		response = runInstancesResponse{Instances: []instance{launched.instance}}
+	case "DescribeInstanceAttribute":
+		found := f.get(params.Get("InstanceId"))
+		if found == nil {
+			writeError(w, "InvalidInstanceID.NotFound")
+			return
+		}
+		attribute := describeInstanceAttributeResponse{}
+		attribute.UserData.Value = found.userData
+		response = attribute
+	case "GetConsoleOutput":
+		found := f.get(params.Get("InstanceId"))
+		if found == nil {
+			writeError(w, "InvalidInstanceID.NotFound")
+			return
+		}
+		response = getConsoleOutputResponse{Output: base64.StdEncoding.EncodeToString([]byte(found.console))}
+	case "TerminateInstances":
+		found := f.get(params.Get("InstanceId.1"))
+		if found == nil {
+			writeError(w, "InvalidInstanceID.NotFound")
+			return
+		}
+		found.State.Name = "shutting-down"
+		response = returnResponse{Return: true}
+	case "CreateTags":
+		found := f.get(params.Get("ResourceId.1"))
+		if found == nil {
+			writeError(w, "InvalidInstanceID.NotFound")
+			return
+		}
+		for key, value := range tagsFrom(params, "Tag") {
+			found.Tags = append(found.Tags, tag{Key: key, Value: value})
+		}
+		response = returnResponse{Return: true}
+	default:
+		f.t.Errorf("unexpected action %q", action)
+		writeError(w, "InvalidAction")
+		return
+	}
+
+	raw, err := xml.Marshal(response)
+	if err != nil {
+		f.t.Errorf("could not encode response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(raw)
+}
+
+// run launches an instance, unless one was launched with the client
+// token already, which is returned if the parameters are the same.
+func (f *fakeEC2) run(params url.Values) (*fakeInstance, string) {
+	token := params.Get("ClientToken")
+	if launched, ok := f.launched[token]; ok && token != "" {
+		if launched.userData != params.Get("UserData") {
+			return nil, "IdempotentParameterMismatch"
+		}
+		return launched, ""
+	}
+
+	launched := &fakeInstance{userData: params.Get("UserData")}
+	launched.InstanceID = fmt.Sprintf("i-%04d", len(f.instances)+1)
+	launched.ImageID = params.Get("ImageId")
+	launched.InstanceType = params.Get("InstanceType")
+	launched.LaunchTime = "2018-08-01T12:00:00.000Z"
+	launched.PrivateIPAddress = "10.0.0.5"
+	launched.Placement.AvailabilityZone = params.Get("Placement.AvailabilityZone")
+	launched.State.Name = "pending"
+	for key, value := range tagsFrom(params, "TagSpecification.1.Tag") {
+		launched.Tags = append(launched.Tags, tag{Key: key, Value: value})
+	}
+	f.instances = append(f.instances, launched)
+	f.launched[token] = launched
+	return launched, ""
+}
+
+// describe returns the instances matching the filters or IDs of the
+// request.
+func (f *fakeEC2) describe(params url.Values) []instance {
+	var found []instance
+	for _, candidate := range f.instances {
+		if id := params.Get("InstanceId.1"); id != "" {
+			if candidate.InstanceID == id {
+				found = append(found, candidate.instance)
+			}
+			continue
+		}
+		if !f.unlisted && matches(candidate, params) {
+			found = append(found, candidate.instance)
+		}
+	}
+	return found
+}
+
+func (f *fakeEC2) get(id string) *fakeInstance {
+	for _, candidate := range f.instances {
+		if candidate.InstanceID == id && candidate.State.Name != stateTerminated {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// matches determines whether the instance matches all filters of the
+// request.
+func matches(candidate *fakeInstance, params url.Values) bool {
+	tags := candidate.tags()
+	for i := 1; params.Get(fmt.Sprintf("Filter.%d.Name", i)) != ""; i++ {
+		name := params.Get(fmt.Sprintf("Filter.%d.Name", i))
+		var value string
+		switch {
+		case name == "availability-zone":
+			value = candidate.Placement.AvailabilityZone
+		case name == "instance-state-name":
+			value = candidate.State.Name
+		case strings.HasPrefix(name, "tag:"):
+			tagValue, ok := tags[strings.TrimPrefix(name, "tag:")]
+			if !ok {
+				return false
+			}
+			value = tagValue
+		}
+		matched := false
+		for j := 1; params.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)) != ""; j++ {
+			matched = matched || params.Get(fmt.Sprintf("Filter.%d.Value.%d", i, j)) == value
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func tagsFrom(params url.Values, prefix string) map[string]string {
+	tags := map[string]string{}
+	for i := 1; params.Get(fmt.Sprintf("%s.%d.Key", prefix, i)) != ""; i++ {
+		tags[params.Get(fmt.Sprintf("%s.%d.Key", prefix, i))] = params.Get(fmt.Sprintf("%s.%d.Value", prefix, i))
+	}
+	return tags
+}
+
+func writeError(w http.ResponseWriter, code string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "<Response><Errors><Error><Code>%s</Code><Message>rejected by the stand-in</Message></Error></Errors><RequestID>1</RequestID></Response>", code)
+}
+
+// setState moves the instance to the state, for the reason if any.
+func (f *fakeEC2) setState(id, state, reason string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, candidate := range f.instances {
+		if candidate.InstanceID == id {
+			candidate.State.Name = state
+			candidate.StateReason.Code = reason
+		}
+	}
+}
+
+// newFakeProvider returns a provider against a stand-in for EC2, which
+// is to be closed once done.
+func newFakeProvider(t *testing.T) (*awsProvider, *fakeEC2) {
+	ec2 := newFakeEC2(t)
+	ec2.server = httptest.NewServer(ec2)
+	p := New(Config{
+		Zones: []string{zone, "us-east-1b"},
+		Images: map[string]ImageLookup{
+			"centos-7": {Name: "CentOS 7*", Owner: "aws-marketplace"},
+		},
+		Subnets:        map[string]string{zone: "subnet-a"},
+		SecurityGroups: []string{"sg-1"},
+	}, NewClient(Credentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}, ec2.server.URL)).(*awsProvider)
+	return p, ec2
+}
+
+func instanceSpec() *provider.InstanceSpec {
+	return &provider.InstanceSpec{
+		Name:      "vm",
+		Zone:      zone,
+		Labels:    map[string]string{"ci-vm-uid": "uid"},
+		User:      "cloud-user",
+		PublicKey: publicKey + " cloud-user@operator\n",
+		Spec: vmapi.VirtualMachineSpec{
+			MachineType: vmapi.VirtualMachineTypeStandard2,
+			BootDisk: vmapi.VirtualMachineBootDiskSpec{
+				ImageFamily: "centos-7",
+				SizeGB:      20,
+				Type:        vmapi.VirtualMachineDiskTypePersistentSSD,
+			},
+			Scheduling: &vmapi.VirtualMachineScheduling{Preemptible: true},
+		},
+	}
+}
+
+func TestCreate(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	op, err := p.Create(instanceSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	params := ec2.requests["RunInstances"][0]
+	expected := map[string]string{
+		"ClientToken":                          clientTokenFor(instanceSpec()),
+		"ImageId":                              "ami-new",
+		"InstanceType":                         "m5.large",
+		"Placement.AvailabilityZone":           zone,
+		"BlockDeviceMapping.1.DeviceName":      "/dev/sda1",
+		"BlockDeviceMapping.1.Ebs.VolumeSize":  "20",
+		"BlockDeviceMapping.1.Ebs.VolumeType":  "gp2",
+		"NetworkInterface.1.SubnetId":          "subnet-a",
+		"NetworkInterface.1.SecurityGroupId.1": "sg-1",
+		"InstanceMarketOptions.MarketType":     "spot",
+		"TagSpecification.1.ResourceType":      "instance",
+		"TagSpecification.2.ResourceType":      "volume",
+	}
+	for key, value := range expected {
+		if actual := params.Get(key); actual != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, actual)
+		}
+	}
+	if token := params.Get("ClientToken"); token == "" || len(token) > 64 {
+		t.Errorf("expected a client token of at most 64 characters, got %q", token)
+	}
+
+	if status, err := p.Poll(op); err != nil || status.Done {
+		t.Errorf("expected the operation to be pending, got %#v, %v", status, err)
+	}
+	ec2.setState(op.Name, stateRunning, "")
+	if status, err := p.Poll(op); err != nil || !status.Done || status.Error != nil {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+
+	instance, err := p.Get(zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance.ID != op.Name || instance.Image != "ami-new" || instance.InternalIP != "10.0.0.5" || instance.Zone != zone {
+		t.Errorf("unexpected instance: %#v", instance)
+	}
+	if expected := map[string]string{"ci-vm-uid": "uid"}; !reflect.DeepEqual(expected, instance.Labels) {
+		t.Errorf("expected labels %v, got %v", expected, instance.Labels)
+	}
+	if !reflect.DeepEqual([]string{publicKey}, instance.AuthorizedKeys) {
+		t.Errorf("expected authorized keys %v, got %v", []string{publicKey}, instance.AuthorizedKeys)
+	}
+
+	if _, err := p.Create(instanceSpec()); err != provider.ErrAlreadyExists {
+		t.Errorf("expected %v creating the instance again, got %v", provider.ErrAlreadyExists, err)
+	}
+}
+
+func TestCreateRetryLaunchesOneInstance(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	ec2.unlisted = true
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the retry is given another host key in its user data
+	if _, err := p.Create(instanceSpec()); err != provider.ErrAlreadyExists {
+		t.Errorf("expected %v retrying, got %v", provider.ErrAlreadyExists, err)
+	}
+	if len(ec2.instances) != 1 {
+		t.Errorf("expected one instance to be launched, got %d", len(ec2.instances))
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	token := clientTokenFor(instanceSpec())
+	if clientTokenFor(instanceSpec()) != token {
+		t.Error("expected the client token to be the same for the same attempt")
+	}
+
+	var testCases = []struct {
+		name   string
+		mutate func(spec *provider.InstanceSpec)
+	}{
+		{
+			name:   "another zone",
+			mutate: func(spec *provider.InstanceSpec) { spec.Zone = "us-east-1b" },
+		},
+		{
+			name:   "another key pair",
+			mutate: func(spec *provider.InstanceSpec) { spec.PublicKey = hostKey },
+		},
+		{
+			name:   "another name",
+			mutate: func(spec *provider.InstanceSpec) { spec.Name = "other" },
+		},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			spec := instanceSpec()
+			testCase.mutate(spec)
+			if clientTokenFor(spec) == token {
+				t.Errorf("expected another client token, got %q", token)
+			}
+		})
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		mutate func(spec *provider.InstanceSpec)
+	}{
+		{
+			name:   "unknown zone",
+			mutate: func(spec *provider.InstanceSpec) { spec.Zone = "us-west-2a" },
+		},
+		{
+			name:   "unknown machine type",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.MachineType = "n1-highmem-2" },
+		},
+		{
+			name:   "unknown image family",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.BootDisk.ImageFamily = "rhel-7" },
+		},
+		{
+			name: "static address",
+			mutate: func(spec *provider.InstanceSpec) {
+				spec.Spec.Network = &vmapi.VirtualMachineNetworkSpec{ExternalAccess: vmapi.VirtualMachineExternalAccessStatic}
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p, ec2 := newFakeProvider(t)
+			defer ec2.server.Close()
+			defer ec2.server.Close()
+			spec := instanceSpec()
+			testCase.mutate(spec)
+			if _, err := p.Create(spec); err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if requests := ec2.requests["RunInstances"]; len(requests) != 0 {
+				t.Errorf("expected no instance to be launched, got %v", requests)
+			}
+		})
+	}
+}
+
+func TestCreateCapacityError(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	ec2.fail["RunInstances"] = "InsufficientInstanceCapacity"
+	_, err := p.Create(instanceSpec())
+	capacityErr, ok := err.(*provider.CapacityError)
+	if !ok {
+		t.Fatalf("expected a capacity error, got %v", err)
+	}
+	if expected := []string{"InsufficientInstanceCapacity"}; !reflect.DeepEqual(expected, capacityErr.Codes) {
+		t.Errorf("expected codes %v, got %v", expected, capacityErr.Codes)
+	}
+}
+
+func TestPollTerminatedInstance(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	op, err := p.Create(instanceSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ec2.setState(op.Name, stateTerminated, "Server.InsufficientInstanceCapacity")
+	status, err := p.Poll(op)
+	if err != nil || !status.Done {
+		t.Fatalf("expected the operation to be done, got %#v, %v", status, err)
+	}
+	if _, ok := status.Error.(*provider.CapacityError); !ok {
+		t.Errorf("expected a capacity error, got %v", status.Error)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	op, err := p.Delete(zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status, err := p.Poll(op); err != nil || status.Done {
+		t.Errorf("expected the operation to be pending, got %#v, %v", status, err)
+	}
+	ec2.setState(op.Name, stateTerminated, "")
+	if status, err := p.Poll(op); err != nil || !status.Done {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+	if _, err := p.Get(zone, "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v after deletion, got %v", provider.ErrNotFound, err)
+	}
+	if _, err := p.Delete(zone, "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v deleting again, got %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestListAndSetLabels(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	for _, name := range []string{"first", "second"} {
+		spec := instanceSpec()
+		spec.Name = name
+		if _, err := p.Create(spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := p.SetLabels(zone, "second", map[string]string{"ci-vm-namespace": "ci"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	instances, err := p.List(zone, map[string]string{"ci-vm-namespace": "ci"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].Name != "second" {
+		t.Fatalf("expected only the relabeled instance, got %#v", instances)
+	}
+	expected := map[string]string{"ci-vm-uid": "uid", "ci-vm-namespace": "ci"}
+	if !reflect.DeepEqual(expected, instances[0].Labels) {
+		t.Errorf("expected labels %v, got %v", expected, instances[0].Labels)
+	}
+	if instances, err := p.List(zone, map[string]string{"ci-vm-uid": "uid"}); err != nil || len(instances) != 2 {
+		t.Errorf("expected both instances, got %#v, %v", instances, err)
+	}
+	if instances, err := p.List("us-east-1b", map[string]string{"ci-vm-uid": "uid"}); err != nil || len(instances) != 0 {
+		t.Errorf("expected no instances in another zone, got %#v, %v", instances, err)
+	}
+}
+
+func TestHostKeys(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	op, err := p.Create(instanceSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ec2.get(op.Name).console = strings.Join([]string{
+		"[   12.345] cloud-init[1234]: Cloud-init v. 18.2 running 'modules:final'",
+		"-----BEGIN SSH HOST KEY KEYS-----",
+		hostKey + " root@vm",
+		"-----END SSH HOST KEY KEYS-----",
+	}, "\n")
+	keys, err := p.HostKeys(zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 1 || keys[0].Type() != "ssh-ed25519" {
+		t.Errorf("expected the host key, got %v", keys)
+	}
+}
+
+func TestSetSSHKeyIsUnsupported(t *testing.T) {
+	p, ec2 := newFakeProvider(t)
+	defer ec2.server.Close()
+	if _, err := p.SetSSHKey(instanceSpec()); err != provider.ErrUnsupported {
+		t.Errorf("expected %v, got %v", provider.ErrUnsupported, err)
+	}
+}
+
+func TestTranslateError(t *testing.T) {
+	var testCases = []struct {
+		code     string
+		expected error
+	}{
+		{code: "InvalidInstanceID.NotFound", expected: provider.ErrNotFound},
+		{code: "IdempotentParameterMismatch", expected: provider.ErrAlreadyExists},
+		{code: "Server.InsufficientInstanceCapacity", expected: &provider.CapacityError{Codes: []string{"InsufficientInstanceCapacity"}, Message: "Server.InsufficientInstanceCapacity: no capacity"}},
+		{code: "UnauthorizedOperation", expected: &APIError{Code: "UnauthorizedOperation", Message: "no capacity"}},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.code, func(t *testing.T) {
+			if actual := translateError(&APIError{Code: testCase.code, Message: "no capacity"}); !reflect.DeepEqual(testCase.expected, actual) {
+				t.Errorf("expected %v, got %v", testCase.expected, actual)
+			}
+		})
+	}
+}
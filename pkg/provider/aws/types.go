@@ -0,0 +1,77 @@
+package aws
+
+// The responses of the EC2 Query API, holding the fields the provider uses.
+
+type runInstancesResponse struct {
+	Instances []instance `xml:"instancesSet>item"`
+}
+
+type describeInstancesResponse struct {
+	Reservations []struct {
+		Instances []instance `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+}
+
+// instances flattens the instances of all reservations.
+func (r *describeInstancesResponse) instances() []instance {
+	var instances []instance
+	for _, reservation := range r.Reservations {
+		instances = append(instances, reservation.Instances...)
+	}
+	return instances
+}
+
+type instance struct {
+	InstanceID       string `xml:"instanceId"`
+	ImageID          string `xml:"imageId"`
+	InstanceType     string `xml:"instanceType"`
+	LaunchTime       string `xml:"launchTime"`
+	PrivateIPAddress string `xml:"privateIpAddress"`
+	IPAddress        string `xml:"ipAddress"`
+	Placement        struct {
+		AvailabilityZone string `xml:"availabilityZone"`
+	} `xml:"placement"`
+	State struct {
+		Name string `xml:"name"`
+	} `xml:"instanceState"`
+	StateReason struct {
+		Code    string `xml:"code"`
+		Message string `xml:"message"`
+	} `xml:"stateReason"`
+	Tags []tag `xml:"tagSet>item"`
+}
+
+type tag struct {
+	Key   string `xml:"key"`
+	Value string `xml:"value"`
+}
+
+// tags maps the keys of the tags of the instance to their values.
+func (i *instance) tags() map[string]string {
+	tags := map[string]string{}
+	for _, tag := range i.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags
+}
+
+type describeImagesResponse struct {
+	Images []image `xml:"imagesSet>item"`
+}
+
+type image struct {
+	ImageID        string `xml:"imageId"`
+	Name           string `xml:"name"`
+	CreationDate   string `xml:"creationDate"`
+	RootDeviceName string `xml:"rootDeviceName"`
+}
+
+type describeInstanceAttributeResponse struct {
+	UserData struct {
+		Value string `xml:"value"`
+	} `xml:"userData"`
+}
+
+type getConsoleOutputResponse struct {
+	Output string `xml:"output"`
+}
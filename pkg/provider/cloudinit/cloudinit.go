@@ -0,0 +1,158 @@
+// Package cloudinit renders the user data with which cloud-init installs
+// the SSH key, host key and startup script of an instance, and reads back
+// what cloud-init reports, for providers whose images are configured by
+// cloud-init.
+package cloudinit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	hostKeyBits = 2048
+
+	// startupScriptPath is where cloud-init runs scripts
+	// from on every boot, as GCE runs startup scripts
+	startupScriptPath = "/var/lib/cloud/scripts/per-boot/ci-vm-operator-startup-script"
+)
+
+// UserData renders the user data for the instance, returning it along
+// with the public host key that cloud-init installs. The host key is
+// generated for the instance, so that it is known without reading the
+// console of the instance. The user data of the spec, if any, is
+// combined with that of the provider.
+func UserData(spec *provider.InstanceSpec) ([]byte, string, error) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, hostKeyBits)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not generate host key: %v", err)
+	}
+	publicHostKey, err := ssh.NewPublicKey(&hostKey.PublicKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not encode host key: %v", err)
+	}
+	authorizedHostKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicHostKey)))
+
+	config := map[string]interface{}{
+		"users": []interface{}{
+			"default",
+			map[string]interface{}{
+				"name":                spec.User,
+				"sudo":                "ALL=(ALL) NOPASSWD:ALL",
+				"ssh_authorized_keys": []string{strings.TrimSpace(spec.PublicKey)},
+			},
+		},
+		// only the host key we know of may be installed
+		"ssh_deletekeys":  true,
+		"ssh_genkeytypes": []string{},
+		"ssh_keys": map[string]string{
+			"rsa_private": string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(hostKey)})),
+			"rsa_public":  authorizedHostKey,
+		},
+	}
+	if spec.StartupScript != "" {
+		config["write_files"] = []interface{}{
+			map[string]string{
+				"path":        startupScriptPath,
+				"permissions": "0755",
+				"content":     spec.StartupScript,
+			},
+		}
+	}
+	// JSON is a subset of YAML, so it serves as cloud-config
+	rawConfig, err := json.Marshal(config)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not render cloud-config: %v", err)
+	}
+	userData := append([]byte("#cloud-config\n"), rawConfig...)
+	if spec.UserData != "" {
+		if userData, err = multipartUserData(userData, []byte(spec.UserData)); err != nil {
+			return nil, "", err
+		}
+	}
+
+	return userData, authorizedHostKey, nil
+}
+
+// multipartUserData combines the cloud-config of the provider with the
+// user data of the VirtualMachine, which cloud-init processes in turn.
+func multipartUserData(config, userData []byte) ([]byte, error) {
+	combined := bytes.Buffer{}
+	writer := multipart.NewWriter(&combined)
+	fmt.Fprintf(&combined, "Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n", writer.Boundary())
+	for _, part := range [][]byte{config, userData} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", userDataContentType(part))
+		partWriter, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, fmt.Errorf("could not render user data: %v", err)
+		}
+		partWriter.Write(part)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("could not render user data: %v", err)
+	}
+	return combined.Bytes(), nil
+}
+
+// userDataContentType determines the type of the user data from the
+// marker it starts with, as cloud-init does for user data that is not
+// multipart.
+func userDataContentType(userData []byte) string {
+	for prefix, contentType := range map[string]string{
+		"#cloud-config":   "text/cloud-config",
+		"#cloud-boothook": "text/cloud-boothook",
+		"#include":        "text/x-include-url",
+		"#!":              "text/x-shellscript",
+	} {
+		if bytes.HasPrefix(userData, []byte(prefix)) {
+			return contentType
+		}
+	}
+	return "text/plain"
+}
+
+// AuthorizedKeys reads the SSH keys back from user data rendered by
+// UserData, dropping their comments.
+func AuthorizedKeys(userData []byte) []string {
+	var keys []string
+	lines := strings.Split(string(userData), "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) != "#cloud-config" {
+			continue
+		}
+		config := struct {
+			Users []json.RawMessage `json:"users"`
+		}{}
+		if err := json.Unmarshal([]byte(lines[i+1]), &config); err != nil {
+			continue
+		}
+		for _, raw := range config.Users {
+			user := struct {
+				SSHAuthorizedKeys []string `json:"ssh_authorized_keys"`
+			}{}
+			// the default user is given by name only
+			if err := json.Unmarshal(raw, &user); err != nil {
+				continue
+			}
+			for _, authorizedKey := range user.SSHAuthorizedKeys {
+				if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey)); err == nil {
+					keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+				}
+			}
+		}
+	}
+	return keys
+}
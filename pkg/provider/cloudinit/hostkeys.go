@@ -0,0 +1,57 @@
+package cloudinit
+
+import (
+	"bufio"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// cloud-init prints the host keys of the instance to the
+	// console between these markers on every boot
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// ParseHostKeys extracts the host keys cloud-init printed on the console
+// of an instance from its output. Only the last set of keys printed is
+// used, as keys may have been regenerated since earlier boots.
+func ParseHostKeys(output string) []ssh.PublicKey {
+	var keys, current []ssh.PublicKey
+	inBlock := false
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, hostKeysBegin):
+			inBlock = true
+			current = nil
+		case strings.Contains(line, hostKeysEnd):
+			if inBlock && len(current) > 0 {
+				keys = current
+			}
+			inBlock = false
+		case inBlock:
+			if key := parseHostKeyLine(line); key != nil {
+				current = append(current, key)
+			}
+		}
+	}
+	return keys
+}
+
+// parseHostKeyLine parses a line of authorized_keys format, ignoring any
+// prefix the console may have added before the key type.
+func parseHostKeyLine(line string) ssh.PublicKey {
+	for _, prefix := range []string{"ssh-", "ecdsa-"} {
+		index := strings.Index(line, prefix)
+		if index < 0 {
+			continue
+		}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line[index:])); err == nil {
+			return key
+		}
+	}
+	return nil
+}
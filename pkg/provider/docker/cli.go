@@ -0,0 +1,52 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// runCommand runs the command, returning its output or an error that
+// carries what it printed on stderr.
+func runCommand(input string, command string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", &commandError{args: args, err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.String(), nil
+}
+
+// commandError is returned when the CLI fails.
+type commandError struct {
+	args   []string
+	err    error
+	stderr string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s failed: %v: %s", e.args[0], e.err, e.stderr)
+}
+
+// translateError maps the errors docker and podman print to those of
+// the provider contract.
+func translateError(err error) error {
+	cmdErr, ok := err.(*commandError)
+	if !ok {
+		return err
+	}
+	message := strings.ToLower(cmdErr.stderr)
+	switch {
+	case strings.Contains(message, "no such container"), strings.Contains(message, "no such object"):
+		return provider.ErrNotFound
+	case strings.Contains(message, "is already in use"):
+		return provider.ErrAlreadyExists
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// container holds the fields of the output of inspect that the provider
+// uses, which docker and podman share.
+type container struct {
+	ID      string `json:"Id"`
+	Name    string `json:"Name"`
+	Created string `json:"Created"`
+	State   struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+	Config struct {
+		Image  string            `json:"Image"`
+		Labels map[string]string `json:"Labels"`
+	} `json:"Config"`
+	NetworkSettings struct {
+		IPAddress string `json:"IPAddress"`
+		Networks  map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// inspect looks up the containers, returning ErrNotFound
+// if any of them does not exist.
+func (p *dockerProvider) inspect(names ...string) ([]container, error) {
+	output, err := p.docker("", append([]string{"container", "inspect"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	var containers []container
+	if err := json.Unmarshal([]byte(output), &containers); err != nil {
+		return nil, fmt.Errorf("could not parse containers: %v", err)
+	}
+	if len(containers) != len(names) {
+		return nil, provider.ErrNotFound
+	}
+	return containers, nil
+}
+
+// instanceFrom describes the container in the terms of the provider
+// contract. The container is reached on the same address from the
+// operator and from consumers, so it is reported as both the internal
+// and the external address.
+func (p *dockerProvider) instanceFrom(container container) *provider.Instance {
+	address := p.addressOf(container)
+	instance := &provider.Instance{
+		Name:       strings.TrimPrefix(container.Name, "/"),
+		Zone:       p.config.Zone,
+		ID:         container.ID,
+		Image:      container.Config.Image,
+		InternalIP: address,
+		ExternalIP: address,
+		Labels:     container.Config.Labels,
+		Terminated: container.State.Status == "exited" || container.State.Status == "dead",
+	}
+	if created, err := time.Parse(time.RFC3339Nano, container.Created); err == nil {
+		instance.Created = created
+	}
+	return instance
+}
+
+// addressOf determines the address of the container on the configured
+// network, or on the first network it is attached to otherwise.
+func (p *dockerProvider) addressOf(container container) string {
+	networks := container.NetworkSettings.Networks
+	if p.config.Network != "" {
+		return networks[p.config.Network].IPAddress
+	}
+	if container.NetworkSettings.IPAddress != "" {
+		return container.NetworkSettings.IPAddress
+	}
+	names := make([]string, 0, len(networks))
+	for name := range networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if address := networks[name].IPAddress; address != "" {
+			return address
+		}
+	}
+	return ""
+}
+
+// authorizedKeys parses the keys recorded in the container, dropping
+// their comments.
+func authorizedKeys(output string) []string {
+	var keys []string
+	for _, line := range strings.Split(output, "\n") {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			continue
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	return keys
+}
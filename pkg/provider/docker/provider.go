@@ -0,0 +1,270 @@
+// Package docker implements the provider contract with local containers
+// running sshd, launched with the docker or podman CLI. It stands in for
+// a cloud when developing or testing the operator without one.
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// Name identifies the provider in the configuration
+	Name = "docker"
+
+	defaultCommand = "docker"
+	defaultZone    = "local"
+
+	// stateDir holds the files the provider keeps in each container
+	stateDir           = "/etc/ci-vm-operator"
+	authorizedKeysFile = stateDir + "/authorized_keys"
+	startupScriptFile  = stateDir + "/startup-script"
+)
+
+// Config configures the containers the provider launches.
+type Config struct {
+	// Command is the container CLI to run, docker or podman;
+	// docker is used if unset
+	Command string `json:"command,omitempty"`
+	// Image is the image containers are launched from. It must
+	// run sshd and provide useradd or adduser to create the user
+	// the SSH key is installed for
+	Image string `json:"image"`
+	// Images maps the image family of the boot disk of a
+	// VirtualMachine to the image to launch instead of Image
+	Images map[string]string `json:"images,omitempty"`
+	// Network is the network containers are attached to; the
+	// default network of the runtime is used if unset
+	Network string `json:"network,omitempty"`
+	// Zone is the name of the only zone of the provider, which
+	// VirtualMachines are provisioned in; local is used if unset
+	Zone string `json:"zone,omitempty"`
+}
+
+// New returns a provider that manages containers with the CLI.
+func New(config Config) provider.Provider {
+	if config.Command == "" {
+		config.Command = defaultCommand
+	}
+	if config.Zone == "" {
+		config.Zone = defaultZone
+	}
+	return &dockerProvider{config: config, run: runCommand}
+}
+
+type dockerProvider struct {
+	config Config
+	// run runs the CLI with the arguments, feeding it the input
+	run func(input string, command string, args ...string) (string, error)
+}
+
+var _ provider.Provider = &dockerProvider{}
+
+func (p *dockerProvider) Zones() []provider.Zone {
+	return []provider.Zone{{Name: p.config.Zone, Region: p.config.Zone}}
+}
+
+// Create launches the container and installs the SSH key in it. The CLI
+// waits for the container to start, so the returned operation is done.
+func (p *dockerProvider) Create(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	if err := p.checkZone(spec.Zone); err != nil {
+		return nil, err
+	}
+	if spec.UserData != "" {
+		return nil, errors.New("user data is not supported by the docker provider")
+	}
+
+	args := []string{"run", "--detach", "--name", spec.Name, "--hostname", spec.Name}
+	if p.config.Network != "" {
+		args = append(args, "--network", p.config.Network)
+	}
+	for key, value := range spec.Labels {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", key, value))
+	}
+	args = append(args, p.imageFor(spec))
+	if _, err := p.docker("", args...); err != nil {
+		return nil, err
+	}
+
+	if err := p.installSSHKey(spec); err != nil {
+		return nil, err
+	}
+	if spec.StartupScript != "" {
+		if _, err := p.docker(spec.StartupScript, "exec", "--interactive", "--user", "0", spec.Name, "sh", "-c", fmt.Sprintf("cat > %[1]s && chmod +x %[1]s", startupScriptFile)); err != nil {
+			return nil, fmt.Errorf("could not copy startup script: %v", err)
+		}
+		if _, err := p.docker("", "exec", "--detach", "--user", "0", spec.Name, startupScriptFile); err != nil {
+			return nil, fmt.Errorf("could not run startup script: %v", err)
+		}
+	}
+	return operationFor(spec.Zone, spec.Name, provider.OperationCreate), nil
+}
+
+func (p *dockerProvider) Get(zone, name string) (*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	containers, err := p.inspect(name)
+	if err != nil {
+		return nil, err
+	}
+	instance := p.instanceFrom(containers[0])
+	if !instance.Terminated {
+		// the container may not have a key yet, or may be
+		// shutting down, in which case it has none we can use
+		if output, err := p.docker("", "exec", name, "cat", authorizedKeysFile); err == nil {
+			instance.AuthorizedKeys = authorizedKeys(output)
+		}
+	}
+	return instance, nil
+}
+
+func (p *dockerProvider) Delete(zone, name string) (*provider.Operation, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	if _, err := p.docker("", "rm", "--force", name); err != nil {
+		return nil, err
+	}
+	return operationFor(zone, name, provider.OperationDelete), nil
+}
+
+// SetSSHKey replaces the SSH keys of the user in the container.
+func (p *dockerProvider) SetSSHKey(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	if err := p.checkZone(spec.Zone); err != nil {
+		return nil, err
+	}
+	if err := p.installSSHKey(spec); err != nil {
+		return nil, err
+	}
+	return operationFor(spec.Zone, spec.Name, provider.OperationSetSSHKey), nil
+}
+
+// SetLabels fails, as the labels of a container are fixed when it is
+// created, so containers cannot be adopted.
+func (p *dockerProvider) SetLabels(zone, name string, labels map[string]string) (*provider.Operation, error) {
+	return nil, errors.New("the labels of containers cannot be changed")
+}
+
+// Poll reports every operation as done, as the CLI waits for changes to
+// containers to complete.
+func (p *dockerProvider) Poll(op *provider.Operation) (*provider.OperationStatus, error) {
+	return &provider.OperationStatus{Done: true, Message: "completed"}, nil
+}
+
+// List lists the containers, running or not, that carry all of the labels.
+func (p *dockerProvider) List(zone string, labels map[string]string) ([]*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	args := []string{"ps", "--all", "--quiet"}
+	for key, value := range labels {
+		args = append(args, "--filter", fmt.Sprintf("label=%s=%s", key, value))
+	}
+	output, err := p.docker("", args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := strings.Fields(output)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	containers, err := p.inspect(ids...)
+	if err == provider.ErrNotFound {
+		// a container was removed after we listed it
+		return nil, fmt.Errorf("containers changed while they were listed")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var instances []*provider.Instance
+	for _, container := range containers {
+		instances = append(instances, p.instanceFrom(container))
+	}
+	return instances, nil
+}
+
+// HostKeys reads the host keys sshd generated in the container. The
+// container runtime is trusted to reach the right container, so the
+// keys are as trustworthy as those reported on a serial console.
+func (p *dockerProvider) HostKeys(zone, name string) ([]ssh.PublicKey, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	output, err := p.docker("", "exec", name, "sh", "-c", "cat /etc/ssh/ssh_host_*_key.pub 2>/dev/null || true")
+	if err != nil {
+		return nil, fmt.Errorf("could not read host keys: %v", err)
+	}
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(output, "\n") {
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// installSSHKeyScript creates the user if needed and replaces its
+// authorized keys, recording the key where Get can find it.
+const installSSHKeyScript = `set -e
+user="$1"
+key="$2"
+if ! id -u "${user}" >/dev/null 2>&1; then
+  useradd --create-home "${user}" 2>/dev/null || adduser -D "${user}"
+  # sshd refuses keys for locked accounts
+  passwd -u "${user}" >/dev/null 2>&1 || usermod -p '*' "${user}" >/dev/null 2>&1 || true
+fi
+home="$( eval echo "~${user}" )"
+mkdir -p "${home}/.ssh" ` + stateDir + `
+echo "${key}" > "${home}/.ssh/authorized_keys"
+chmod 700 "${home}/.ssh"
+chmod 600 "${home}/.ssh/authorized_keys"
+chown -R "${user}" "${home}/.ssh"
+echo "${key}" > ` + authorizedKeysFile + `
+`
+
+func (p *dockerProvider) installSSHKey(spec *provider.InstanceSpec) error {
+	if _, err := p.docker("", "exec", "--user", "0", spec.Name, "sh", "-c", installSSHKeyScript, "sh", spec.User, strings.TrimSpace(spec.PublicKey)); err != nil {
+		return fmt.Errorf("could not install SSH key: %v", err)
+	}
+	return nil
+}
+
+// imageFor determines the image to launch the container from.
+func (p *dockerProvider) imageFor(spec *provider.InstanceSpec) string {
+	if image, ok := p.config.Images[spec.Spec.BootDisk.ImageFamily]; ok {
+		return image
+	}
+	return p.config.Image
+}
+
+// checkZone ensures that the zone is the one the provider manages.
+func (p *dockerProvider) checkZone(zone string) error {
+	if zone != p.config.Zone {
+		return fmt.Errorf("zone %q is not supported", zone)
+	}
+	return nil
+}
+
+// docker runs the CLI with the arguments.
+func (p *dockerProvider) docker(input string, args ...string) (string, error) {
+	output, err := p.run(input, p.config.Command, args...)
+	return output, translateError(err)
+}
+
+// operationFor identifies a change to the container. The CLI waits for
+// changes to complete, so the name only serves to tell them apart.
+func operationFor(zone, name, operationType string) *provider.Operation {
+	return &provider.Operation{
+		Name: fmt.Sprintf("%s-%s-%d", operationType, name, time.Now().UnixNano()),
+		Zone: zone,
+		Type: operationType,
+	}
+}
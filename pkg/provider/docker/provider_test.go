@@ -0,0 +1,239 @@
+package docker
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGtTSXdGjUSG4Vb6gQ9Yd4VzS0yO6KBQ0Ww9DqvN0f3r"
+
+	inspectOutput = `[{
+  "Id": "0123456789ab",
+  "Name": "/vm",
+  "Created": "2018-05-01T12:00:00.123456789Z",
+  "State": {"Status": "running"},
+  "Config": {"Image": "centos-sshd", "Labels": {"ci-vm-uid": "uid"}},
+  "NetworkSettings": {"IPAddress": "", "Networks": {"ci": {"IPAddress": "10.0.0.2"}}}
+}]`
+)
+
+// invocation is an expected run of the CLI and what it returns.
+type invocation struct {
+	input  string
+	args   []string
+	output string
+	err    error
+}
+
+// fakeCLI replays the invocations in order, failing the test
+// if the provider runs the CLI differently.
+type fakeCLI struct {
+	t           *testing.T
+	invocations []invocation
+}
+
+func (f *fakeCLI) run(input string, command string, args ...string) (string, error) {
+	if command != "podman" {
+		f.t.Errorf("expected podman to be run, got %s", command)
+	}
+	if len(f.invocations) == 0 {
+		f.t.Fatalf("unexpected invocation: %s", strings.Join(args, " "))
+	}
+	expected := f.invocations[0]
+	f.invocations = f.invocations[1:]
+	if !reflect.DeepEqual(expected.args, args) {
+		f.t.Errorf("expected invocation %v, got %v", expected.args, args)
+	}
+	if expected.input != input {
+		f.t.Errorf("expected input %q, got %q", expected.input, input)
+	}
+	return expected.output, expected.err
+}
+
+func (f *fakeCLI) done() {
+	for _, missing := range f.invocations {
+		f.t.Errorf("expected invocation did not happen: %v", missing.args)
+	}
+}
+
+func newFakeProvider(t *testing.T, invocations ...invocation) (*dockerProvider, *fakeCLI) {
+	cli := &fakeCLI{t: t, invocations: invocations}
+	p := New(Config{Command: "podman", Image: "centos-sshd", Network: "ci"}).(*dockerProvider)
+	p.run = cli.run
+	return p, cli
+}
+
+func installKeyArgs(name string) []string {
+	return []string{"exec", "--user", "0", name, "sh", "-c", installSSHKeyScript, "sh", "cloud-user", publicKey}
+}
+
+func TestCreate(t *testing.T) {
+	spec := &provider.InstanceSpec{
+		Name:          "vm",
+		Zone:          "local",
+		Labels:        map[string]string{"ci-vm-uid": "uid"},
+		User:          "cloud-user",
+		PublicKey:     publicKey + "\n",
+		StartupScript: "#!/bin/sh\necho hello\n",
+		Spec: vmapi.VirtualMachineSpec{
+			BootDisk: vmapi.VirtualMachineBootDiskSpec{ImageFamily: "centos-7"},
+		},
+	}
+	p, cli := newFakeProvider(t,
+		invocation{args: []string{"run", "--detach", "--name", "vm", "--hostname", "vm", "--network", "ci", "--label", "ci-vm-uid=uid", "centos-sshd"}},
+		invocation{args: installKeyArgs("vm")},
+		invocation{input: spec.StartupScript, args: []string{"exec", "--interactive", "--user", "0", "vm", "sh", "-c", "cat > /etc/ci-vm-operator/startup-script && chmod +x /etc/ci-vm-operator/startup-script"}},
+		invocation{args: []string{"exec", "--detach", "--user", "0", "vm", "/etc/ci-vm-operator/startup-script"}},
+	)
+	op, err := p.Create(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Type != provider.OperationCreate || op.Zone != "local" {
+		t.Errorf("unexpected operation: %#v", op)
+	}
+	cli.done()
+
+	status, err := p.Poll(op)
+	if err != nil || !status.Done || status.Error != nil {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		spec        *provider.InstanceSpec
+		invocations []invocation
+		expected    error
+	}{
+		{
+			name: "other zones are rejected",
+			spec: &provider.InstanceSpec{Name: "vm", Zone: "us-east1-b"},
+		},
+		{
+			name: "user data is rejected",
+			spec: &provider.InstanceSpec{Name: "vm", Zone: "local", UserData: "#cloud-config"},
+		},
+		{
+			name: "existing containers are reported",
+			spec: &provider.InstanceSpec{Name: "vm", Zone: "local"},
+			invocations: []invocation{{
+				args: []string{"run", "--detach", "--name", "vm", "--hostname", "vm", "--network", "ci", "centos-sshd"},
+				err:  &commandError{args: []string{"run"}, err: errors.New("exit status 125"), stderr: `Error: the container name "vm" is already in use by "0123456789ab"`},
+			}},
+			expected: provider.ErrAlreadyExists,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p, cli := newFakeProvider(t, testCase.invocations...)
+			_, err := p.Create(testCase.spec)
+			if err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if testCase.expected != nil && err != testCase.expected {
+				t.Errorf("expected error %v, got %v", testCase.expected, err)
+			}
+			cli.done()
+		})
+	}
+}
+
+func TestGet(t *testing.T) {
+	p, cli := newFakeProvider(t,
+		invocation{args: []string{"container", "inspect", "vm"}, output: inspectOutput},
+		invocation{args: []string{"exec", "vm", "cat", authorizedKeysFile}, output: publicKey + " cloud-user@operator\n"},
+	)
+	instance, err := p.Get("local", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cli.done()
+
+	expected := &provider.Instance{
+		Name:           "vm",
+		Zone:           "local",
+		ID:             "0123456789ab",
+		Image:          "centos-sshd",
+		InternalIP:     "10.0.0.2",
+		ExternalIP:     "10.0.0.2",
+		Created:        time.Date(2018, 5, 1, 12, 0, 0, 123456789, time.UTC),
+		Labels:         map[string]string{"ci-vm-uid": "uid"},
+		AuthorizedKeys: []string{publicKey},
+	}
+	if !reflect.DeepEqual(expected, instance) {
+		t.Errorf("unexpected instance: %s", diff.ObjectReflectDiff(expected, instance))
+	}
+}
+
+func TestGetNotFound(t *testing.T) {
+	p, cli := newFakeProvider(t, invocation{
+		args: []string{"container", "inspect", "vm"},
+		err:  &commandError{args: []string{"container"}, err: errors.New("exit status 1"), stderr: "Error: No such container: vm"},
+	})
+	if _, err := p.Get("local", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v, got %v", provider.ErrNotFound, err)
+	}
+	cli.done()
+}
+
+func TestList(t *testing.T) {
+	p, cli := newFakeProvider(t,
+		invocation{args: []string{"ps", "--all", "--quiet", "--filter", "label=ci-vm-operator=ci"}, output: "0123456789ab\n"},
+		invocation{args: []string{"container", "inspect", "0123456789ab"}, output: inspectOutput},
+	)
+	instances, err := p.List("local", map[string]string{"ci-vm-operator": "ci"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cli.done()
+	if len(instances) != 1 || instances[0].Name != "vm" || instances[0].InternalIP != "10.0.0.2" {
+		t.Errorf("unexpected instances: %#v", instances)
+	}
+}
+
+func TestListEmpty(t *testing.T) {
+	p, cli := newFakeProvider(t, invocation{args: []string{"ps", "--all", "--quiet"}})
+	instances, err := p.List("local", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cli.done()
+	if len(instances) != 0 {
+		t.Errorf("expected no instances, got %#v", instances)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p, cli := newFakeProvider(t, invocation{args: []string{"rm", "--force", "vm"}, output: "vm\n"})
+	op, err := p.Delete("local", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cli.done()
+	if op.Type != provider.OperationDelete || op.Zone != "local" {
+		t.Errorf("unexpected operation: %#v", op)
+	}
+}
+
+func TestDeleteNotFound(t *testing.T) {
+	p, cli := newFakeProvider(t, invocation{
+		args: []string{"rm", "--force", "vm"},
+		err:  &commandError{args: []string{"rm"}, err: errors.New("exit status 1"), stderr: "Error: No such container: vm"},
+	})
+	if _, err := p.Delete("local", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v, got %v", provider.ErrNotFound, err)
+	}
+	cli.done()
+}
@@ -0,0 +1,94 @@
+package gce
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+)
+
+// Client is the subset of the GCE compute API that the provider uses.
+type Client interface {
+	DisksGet(project string, zone string, disk string) (*compute.Disk, error)
+	GetSerialPortOutput(project string, zone string, instance string) (*compute.SerialPortOutput, error)
+	InstancesDelete(project string, zone string, targetInstance string) (*compute.Operation, error)
+	InstancesGet(project string, zone string, instance string) (*compute.Instance, error)
+	InstancesInsert(project string, zone string, instance *compute.Instance) (*compute.Operation, error)
+	InstancesList(project string, zone string, filter string) ([]*compute.Instance, error)
+	SetLabels(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error)
+	SetMetadata(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error)
+	ZoneOperationsGet(project string, zone string, operation string) (*compute.Operation, error)
+}
+
+// NewClient returns a client for the GCE compute API. If an endpoint is
+// given, requests are sent to it without credentials instead, as for
+// the fake compute API.
+func NewClient(endpoint string) (Client, error) {
+	if endpoint != "" {
+		service, err := compute.New(http.DefaultClient)
+		if err != nil {
+			return nil, err
+		}
+		service.BasePath = strings.TrimSuffix(endpoint, "/") + "/compute/v1/projects/"
+		return &gceClient{c: service}, nil
+	}
+
+	// The default GCP client expects the environment variable
+	// GOOGLE_APPLICATION_CREDENTIALS to point to a file with service credentials.
+	client, err := google.DefaultClient(context.TODO(), compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+	service, err := compute.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &gceClient{c: service}, nil
+}
+
+type gceClient struct {
+	c *compute.Service
+}
+
+func (c *gceClient) DisksGet(project string, zone string, disk string) (*compute.Disk, error) {
+	return c.c.Disks.Get(project, zone, disk).Do()
+}
+
+func (c *gceClient) GetSerialPortOutput(project string, zone string, instance string) (*compute.SerialPortOutput, error) {
+	return c.c.Instances.GetSerialPortOutput(project, zone, instance).Do()
+}
+
+func (c *gceClient) InstancesDelete(project string, zone string, targetInstance string) (*compute.Operation, error) {
+	return c.c.Instances.Delete(project, zone, targetInstance).Do()
+}
+
+func (c *gceClient) InstancesGet(project string, zone string, instance string) (*compute.Instance, error) {
+	return c.c.Instances.Get(project, zone, instance).Do()
+}
+
+func (c *gceClient) InstancesInsert(project string, zone string, instance *compute.Instance) (*compute.Operation, error) {
+	return c.c.Instances.Insert(project, zone, instance).Do()
+}
+
+func (c *gceClient) InstancesList(project string, zone string, filter string) ([]*compute.Instance, error) {
+	var instances []*compute.Instance
+	err := c.c.Instances.List(project, zone).Filter(filter).Pages(context.TODO(), func(list *compute.InstanceList) error {
+		instances = append(instances, list.Items...)
+		return nil
+	})
+	return instances, err
+}
+
+func (c *gceClient) SetLabels(project string, zone string, instance string, request *compute.InstancesSetLabelsRequest) (*compute.Operation, error) {
+	return c.c.Instances.SetLabels(project, zone, instance, request).Do()
+}
+
+func (c *gceClient) SetMetadata(project string, zone string, instance string, metadata *compute.Metadata) (*compute.Operation, error) {
+	return c.c.Instances.SetMetadata(project, zone, instance, metadata).Do()
+}
+
+func (c *gceClient) ZoneOperationsGet(project string, zone string, operation string) (*compute.Operation, error) {
+	return c.c.ZoneOperations.Get(project, zone, operation).Do()
+}
@@ -0,0 +1,88 @@
+package gce
+
+import (
+	"bytes"
+	"net/http"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// capacityErrorCodes are the error codes with which GCE reports
+// that a zone cannot currently fit an instance.
+var capacityErrorCodes = map[string]bool{
+	"ZONE_RESOURCE_POOL_EXHAUSTED":              true,
+	"ZONE_RESOURCE_POOL_EXHAUSTED_WITH_DETAILS": true,
+	"QUOTA_EXCEEDED":                            true,
+	"quotaExceeded":                             true,
+}
+
+// operationError is the error reported by a failed GCE operation.
+type operationError struct {
+	errors []*compute.OperationErrorErrors
+}
+
+func (e *operationError) Error() string {
+	var errs bytes.Buffer
+	for _, v := range e.errors {
+		errs.WriteString(v.Message)
+		errs.WriteByte('\n')
+	}
+	return errs.String()
+}
+
+// errorCodes extracts the GCE error codes from an error returned
+// by a call to the GCE API or by a failed operation.
+func errorCodes(err error) []string {
+	var codes []string
+	switch e := err.(type) {
+	case *operationError:
+		for _, v := range e.errors {
+			codes = append(codes, v.Code)
+		}
+	case *googleapi.Error:
+		for _, v := range e.Errors {
+			codes = append(codes, v.Reason)
+		}
+	}
+	return codes
+}
+
+// translateError converts errors from the GCE API into the errors the
+// provider contract defines, where there is an equivalent.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if gerr, ok := err.(*googleapi.Error); ok {
+		switch gerr.Code {
+		case http.StatusNotFound:
+			return provider.ErrNotFound
+		case http.StatusConflict:
+			return provider.ErrAlreadyExists
+		}
+	}
+	codes := errorCodes(err)
+	for _, code := range codes {
+		if capacityErrorCodes[code] {
+			return &provider.CapacityError{Codes: codes, Message: err.Error()}
+		}
+	}
+	return err
+}
+
+// isNotFound determines if the error signals that the resource does
+// not exist.
+func isNotFound(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusNotFound
+}
+
+// isConflict determines if the error signals that the fingerprint
+// sent with an update no longer matches the resource.
+func isConflict(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	return ok && gerr.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,346 @@
+package fake
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	selfLinkPrefix = "https://www.googleapis.com/compute/v1/projects/"
+
+	statusProvisioning = "PROVISIONING"
+	statusRunning      = "RUNNING"
+	statusStopping     = "STOPPING"
+	statusTerminated   = "TERMINATED"
+
+	// cloud-init prints the host keys of an instance between these
+	// markers, which is where the gce provider looks for them
+	hostKeysBegin = "-----BEGIN SSH HOST KEY KEYS-----"
+	hostKeysEnd   = "-----END SSH HOST KEY KEYS-----"
+)
+
+// instance is an instance and the state of its guest.
+type instance struct {
+	*compute.Instance
+	started time.Time
+	console string
+}
+
+func (i *instance) running() bool {
+	return i.Status == statusRunning
+}
+
+func (i *instance) preemptible() bool {
+	return i.Scheduling != nil && i.Scheduling.Preemptible
+}
+
+// start boots the guest of an instance that is being provisioned, which
+// prints a host key on the console.
+func (i *instance) start() {
+	if i.Status != statusProvisioning {
+		return
+	}
+	i.Status = statusRunning
+	i.started = time.Now()
+	i.console += fmt.Sprintf("Booting %s\n%s", i.Name, hostKeyOutput())
+}
+
+// preempt stops the guest of a running instance.
+func (i *instance) preempt() {
+	if !i.running() {
+		return
+	}
+	i.Status = statusTerminated
+	i.console += "Instance was preempted\n"
+}
+
+// disk is a disk and whether it is deleted along with the instance
+// it is attached to.
+type disk struct {
+	*compute.Disk
+	autoDelete bool
+}
+
+func (s *Server) insertInstance(project, zone string, r *http.Request) (interface{}, *apiError) {
+	spec := &compute.Instance{}
+	if err := decode(r, spec); err != nil {
+		return nil, err
+	}
+	if spec.Name == "" {
+		return nil, newAPIError(http.StatusBadRequest, "required", "Required field 'resource.name' not specified")
+	}
+	key := resourceKey(project, zone, spec.Name)
+	if s.quotaExceeded[zone] {
+		return nil, newAPIError(http.StatusForbidden, "quotaExceeded", "Quota 'CPUS' exceeded. Limit: 0.0 in region %s.", regionOf(zone))
+	}
+	if _, exists := s.instances[key]; exists {
+		return nil, newAPIError(http.StatusConflict, "alreadyExists", "The resource 'projects/%s' already exists", resourcePath("instances", key))
+	}
+
+	n := s.next()
+	spec.Kind = "compute#instance"
+	spec.Id = n
+	spec.Zone = fmt.Sprintf("%s%s/zones/%s", selfLinkPrefix, project, zone)
+	spec.SelfLink = selfLinkPrefix + resourcePath("instances", key)
+	spec.CreationTimestamp = time.Now().Format(time.RFC3339)
+	spec.Status = statusProvisioning
+	if spec.Metadata == nil {
+		spec.Metadata = &compute.Metadata{}
+	}
+	spec.Metadata.Kind = "compute#metadata"
+	spec.Metadata.Fingerprint = s.fingerprint()
+	spec.LabelFingerprint = s.fingerprint()
+	for _, networkInterface := range spec.NetworkInterfaces {
+		networkInterface.NetworkIP = address(10, 128, n)
+		for _, accessConfig := range networkInterface.AccessConfigs {
+			if accessConfig.NatIP == "" {
+				accessConfig.NatIP = address(198, 18, n)
+			}
+		}
+	}
+	for index, attached := range spec.Disks {
+		s.attachDisk(project, zone, spec, int64(index), attached)
+	}
+	i := &instance{Instance: spec}
+	s.instances[key] = i
+
+	exhausted := s.exhausted[zone]
+	return s.startOperation(project, zone, "insert", spec, func(op *compute.Operation) {
+		if !exhausted {
+			i.start()
+			return
+		}
+		s.removeInstance(key, i)
+		op.Error = &compute.OperationError{Errors: []*compute.OperationErrorErrors{{
+			Code:    "ZONE_RESOURCE_POOL_EXHAUSTED",
+			Message: fmt.Sprintf("The zone 'projects/%s/zones/%s' does not have enough resources available to fulfill the request.", project, zone),
+		}}}
+	}), nil
+}
+
+// attachDisk creates the disk an instance is inserted with, unless it
+// attaches an existing one.
+func (s *Server) attachDisk(project, zone string, spec *compute.Instance, index int64, attached *compute.AttachedDisk) {
+	attached.Kind = "compute#attachedDisk"
+	attached.Index = index
+	if attached.Source != "" || attached.InitializeParams == nil {
+		return
+	}
+	name := attached.InitializeParams.DiskName
+	if name == "" {
+		name = spec.Name
+		if index > 0 {
+			name = fmt.Sprintf("%s-%d", spec.Name, index)
+		}
+	}
+	key := resourceKey(project, zone, name)
+	created := &compute.Disk{
+		Kind:              "compute#disk",
+		Id:                s.next(),
+		Name:              name,
+		Zone:              spec.Zone,
+		SelfLink:          selfLinkPrefix + resourcePath("disks", key),
+		CreationTimestamp: spec.CreationTimestamp,
+		SizeGb:            attached.InitializeParams.DiskSizeGb,
+		SourceImage:       attached.InitializeParams.SourceImage,
+		Type:              attached.InitializeParams.DiskType,
+		Labels:            attached.InitializeParams.Labels,
+		Status:            "READY",
+		Users:             []string{spec.SelfLink},
+	}
+	s.disks[key] = &disk{Disk: created, autoDelete: attached.AutoDelete}
+	attached.Source = created.SelfLink
+	attached.DeviceName = name
+}
+
+// removeInstance drops the instance and the disks that are deleted along
+// with it, unless it was already replaced by an instance of the same name.
+func (s *Server) removeInstance(key string, i *instance) {
+	if s.instances[key] != i {
+		return
+	}
+	delete(s.instances, key)
+	for _, attached := range i.Disks {
+		for diskKey, d := range s.disks {
+			if d.SelfLink == attached.Source && d.autoDelete {
+				delete(s.disks, diskKey)
+			}
+		}
+	}
+}
+
+func (s *Server) getInstance(project, zone, name string) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	i, ok := s.instances[key]
+	if !ok {
+		return nil, notFound("instances", key)
+	}
+	return i.Instance, nil
+}
+
+func (s *Server) deleteInstance(project, zone, name string) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	i, ok := s.instances[key]
+	if !ok {
+		return nil, notFound("instances", key)
+	}
+	i.Status = statusStopping
+	return s.startOperation(project, zone, "delete", i.Instance, func(*compute.Operation) {
+		s.removeInstance(key, i)
+	}), nil
+}
+
+// labelFilter matches the clauses of the filters the gce provider lists
+// instances with.
+var labelFilter = regexp.MustCompile(`\(labels\.([^ =]+) = ("(?:[^"\\]|\\.)*")\)`)
+
+func (s *Server) listInstances(project, zone, filter string) (interface{}, *apiError) {
+	if strings.TrimSpace(labelFilter.ReplaceAllString(filter, "")) != "" {
+		return nil, newAPIError(http.StatusBadRequest, "invalid", "Invalid list filter expression %q", filter)
+	}
+	labels := map[string]string{}
+	for _, match := range labelFilter.FindAllStringSubmatch(filter, -1) {
+		value, err := strconv.Unquote(match[2])
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid", "Invalid value in list filter expression %q", filter)
+		}
+		labels[match[1]] = value
+	}
+
+	list := &compute.InstanceList{
+		Kind:     "compute#instanceList",
+		SelfLink: fmt.Sprintf("%s%s/zones/%s/instances", selfLinkPrefix, project, zone),
+	}
+	prefix := resourceKey(project, zone, "")
+	for key, i := range s.instances {
+		if strings.HasPrefix(key, prefix) && hasLabels(i.Labels, labels) {
+			list.Items = append(list.Items, i.Instance)
+		}
+	}
+	sort.Slice(list.Items, func(a, b int) bool {
+		return list.Items[a].Name < list.Items[b].Name
+	})
+	return list, nil
+}
+
+// hasLabels determines if the labels include all of the wanted ones.
+func hasLabels(labels, wanted map[string]string) bool {
+	for key, value := range wanted {
+		if current, ok := labels[key]; !ok || current != value {
+			return false
+		}
+	}
+	return true
+}
+
+// setMetadata replaces the metadata of the instance, rejecting the update
+// if the metadata changed since the caller read it.
+func (s *Server) setMetadata(project, zone, name string, r *http.Request) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	i, ok := s.instances[key]
+	if !ok {
+		return nil, notFound("instances", key)
+	}
+	metadata := &compute.Metadata{}
+	if err := decode(r, metadata); err != nil {
+		return nil, err
+	}
+	if metadata.Fingerprint != i.Metadata.Fingerprint {
+		return nil, newAPIError(http.StatusPreconditionFailed, "conditionNotMet", "Supplied fingerprint does not match current metadata fingerprint.")
+	}
+	i.Metadata = &compute.Metadata{
+		Kind:        "compute#metadata",
+		Items:       metadata.Items,
+		Fingerprint: s.fingerprint(),
+	}
+	return s.startOperation(project, zone, "setMetadata", i.Instance, nil), nil
+}
+
+// setLabels replaces the labels of the instance, rejecting the update if
+// the labels changed since the caller read them.
+func (s *Server) setLabels(project, zone, name string, r *http.Request) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	i, ok := s.instances[key]
+	if !ok {
+		return nil, notFound("instances", key)
+	}
+	request := &compute.InstancesSetLabelsRequest{}
+	if err := decode(r, request); err != nil {
+		return nil, err
+	}
+	if request.LabelFingerprint != i.LabelFingerprint {
+		return nil, newAPIError(http.StatusPreconditionFailed, "conditionNotMet", "Labels fingerprint either invalid or resource labels have changed")
+	}
+	i.Labels = request.Labels
+	i.LabelFingerprint = s.fingerprint()
+	return s.startOperation(project, zone, "setLabels", i.Instance, nil), nil
+}
+
+func (s *Server) getSerialPortOutput(project, zone, name string) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	i, ok := s.instances[key]
+	if !ok {
+		return nil, notFound("instances", key)
+	}
+	return &compute.SerialPortOutput{
+		Kind:     "compute#serialPortOutput",
+		SelfLink: i.SelfLink + "/serialPort",
+		Contents: i.console,
+		Next:     int64(len(i.console)),
+	}, nil
+}
+
+func (s *Server) getDisk(project, zone, name string) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	d, ok := s.disks[key]
+	if !ok {
+		return nil, notFound("disks", key)
+	}
+	return d.Disk, nil
+}
+
+// fingerprint returns a fingerprint for a new version of a resource.
+func (s *Server) fingerprint() string {
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, s.next())
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// regionOf determines the region the zone is in.
+func regionOf(zone string) string {
+	if index := strings.LastIndex(zone, "-"); index > 0 {
+		return zone[:index]
+	}
+	return zone
+}
+
+// address returns the nth address in the range starting at the prefix.
+func address(first, second byte, n uint64) string {
+	return fmt.Sprintf("%d.%d.%d.%d", first, second+byte(n>>16), byte(n>>8), byte(n))
+}
+
+// hostKeyOutput prints a newly generated host key the way cloud-init
+// does on the console of a booting instance.
+func hostKeyOutput() string {
+	public, _, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		return ""
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s\n%s%s\n", hostKeysBegin, ssh.MarshalAuthorizedKey(key), hostKeysEnd)
+}
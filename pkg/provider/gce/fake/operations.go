@@ -0,0 +1,73 @@
+package fake
+
+import (
+	"fmt"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+)
+
+const (
+	operationStatusRunning = "RUNNING"
+	operationStatusDone    = "DONE"
+)
+
+// operation is a zone operation and what happens when it completes.
+type operation struct {
+	*compute.Operation
+	due        time.Time
+	onComplete func(op *compute.Operation)
+}
+
+func (o *operation) done() bool {
+	return o.Status == operationStatusDone
+}
+
+func (o *operation) complete() {
+	o.Status = operationStatusDone
+	o.Progress = 100
+	o.EndTime = time.Now().Format(time.RFC3339)
+	if o.onComplete != nil {
+		o.onComplete(o.Operation)
+	}
+}
+
+// startOperation records an operation on the instance that completes
+// once the configured duration has passed.
+func (s *Server) startOperation(project, zone, operationType string, target *compute.Instance, onComplete func(op *compute.Operation)) *compute.Operation {
+	now := time.Now()
+	n := s.next()
+	name := fmt.Sprintf("operation-%d-%d", now.UnixNano()/int64(time.Millisecond), n)
+	key := resourceKey(project, zone, name)
+	op := &operation{
+		Operation: &compute.Operation{
+			Kind:          "compute#operation",
+			Id:            n,
+			Name:          name,
+			Zone:          target.Zone,
+			SelfLink:      selfLinkPrefix + resourcePath("operations", key),
+			OperationType: operationType,
+			TargetLink:    target.SelfLink,
+			TargetId:      target.Id,
+			Status:        operationStatusRunning,
+			InsertTime:    now.Format(time.RFC3339),
+			StartTime:     now.Format(time.RFC3339),
+		},
+		due:        now.Add(s.config.OperationDuration),
+		onComplete: onComplete,
+	}
+	s.operations[key] = op
+	if s.config.OperationDuration <= 0 {
+		op.complete()
+	}
+	return op.Operation
+}
+
+func (s *Server) getOperation(project, zone, name string) (interface{}, *apiError) {
+	key := resourceKey(project, zone, name)
+	op, ok := s.operations[key]
+	if !ok {
+		return nil, notFound("operations", key)
+	}
+	return op.Operation, nil
+}
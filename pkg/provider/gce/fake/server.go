@@ -0,0 +1,265 @@
+// Package fake implements an in-process stand-in for the parts of the GCE
+// compute API that the gce provider uses, so that the operator can be run
+// against it without credentials or network access.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BasePath is the path under which the server serves the compute API. The
+// server is reached by pointing a client at its root URL.
+const BasePath = "/compute/v1/projects/"
+
+// Config determines how the server behaves.
+type Config struct {
+	// Latency delays every response of the server.
+	Latency time.Duration
+	// OperationDuration is the time operations take to complete.
+	OperationDuration time.Duration
+	// FailureRate is the fraction of requests that fail with a
+	// transient backend error, between 0 and 1.
+	FailureRate float64
+	// QuotaExceededZones are the zones in which inserting an instance
+	// is rejected because the project has run out of quota.
+	QuotaExceededZones []string
+	// ExhaustedZones are the zones in which the operation inserting an
+	// instance fails because the zone has run out of resources.
+	ExhaustedZones []string
+	// PreemptAfter is the time after which running preemptible
+	// instances are preempted. They are never preempted if unset.
+	PreemptAfter time.Duration
+	// Seed seeds the choice of requests that fail.
+	Seed int64
+}
+
+// Server serves the fake compute API. Resources are kept in memory and
+// are lost when the server stops.
+type Server struct {
+	config Config
+
+	lock          sync.Mutex
+	random        *rand.Rand
+	quotaExceeded map[string]bool
+	exhausted     map[string]bool
+	instances     map[string]*instance
+	disks         map[string]*disk
+	operations    map[string]*operation
+	// counter numbers the resources the server creates
+	counter uint64
+}
+
+// NewServer returns a server without any resources.
+func NewServer(config Config) *Server {
+	s := &Server{
+		config:        config,
+		random:        rand.New(rand.NewSource(config.Seed)),
+		quotaExceeded: map[string]bool{},
+		exhausted:     map[string]bool{},
+		instances:     map[string]*instance{},
+		disks:         map[string]*disk{},
+		operations:    map[string]*operation{},
+	}
+	for _, zone := range config.QuotaExceededZones {
+		s.quotaExceeded[zone] = true
+	}
+	for _, zone := range config.ExhaustedZones {
+		s.exhausted[zone] = true
+	}
+	return s
+}
+
+// SetQuotaExceeded determines whether inserting instances into the zone
+// is rejected for lack of quota.
+func (s *Server) SetQuotaExceeded(zone string, exceeded bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.quotaExceeded[zone] = exceeded
+}
+
+// SetExhausted determines whether inserting instances into the zone fails
+// for lack of resources.
+func (s *Server) SetExhausted(zone string, exhausted bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.exhausted[zone] = exhausted
+}
+
+// Preempt stops the instance in the zone of the project as GCE does
+// when it preempts an instance.
+func (s *Server) Preempt(project, zone, name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance(time.Now())
+	i, ok := s.instances[resourceKey(project, zone, name)]
+	if !ok {
+		return fmt.Errorf("instance %s/%s/%s does not exist", project, zone, name)
+	}
+	i.preempt()
+	return nil
+}
+
+// apiError is an error response of the compute API.
+type apiError struct {
+	Code    int            `json:"code"`
+	Message string         `json:"message"`
+	Errors  []apiErrorItem `json:"errors"`
+}
+
+type apiErrorItem struct {
+	Domain  string `json:"domain"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newAPIError(code int, reason, format string, args ...interface{}) *apiError {
+	message := fmt.Sprintf(format, args...)
+	return &apiError{
+		Code:    code,
+		Message: message,
+		Errors:  []apiErrorItem{{Domain: "global", Reason: reason, Message: message}},
+	}
+}
+
+func notFound(kind, key string) *apiError {
+	return newAPIError(http.StatusNotFound, "notFound", "The resource 'projects/%s' was not found", resourcePath(kind, key))
+}
+
+// ServeHTTP routes requests for the resources of a zone in a project.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.config.Latency)
+
+	logger := logrus.WithFields(logrus.Fields{"method": r.Method, "path": r.URL.Path})
+	body, err := s.handle(r)
+	if err != nil {
+		logger.WithError(err).Debug("request failed")
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(err.Code)
+		json.NewEncoder(w).Encode(struct {
+			Error *apiError `json:"error"`
+		}{Error: err})
+		return
+	}
+	logger.Debug("request succeeded")
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(body)
+}
+
+// handle serves the request, encoding the resource it responds with while
+// holding the lock as the resource may change as soon as it is released.
+func (s *Server) handle(r *http.Request) ([]byte, *apiError) {
+	if !strings.HasPrefix(r.URL.Path, BasePath) {
+		return nil, newAPIError(http.StatusNotFound, "notFound", "%s is not part of the compute API", r.URL.Path)
+	}
+	// {project}/zones/{zone}/{collection}[/{name}[/{method}]]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, BasePath), "/")
+	if len(parts) < 4 || len(parts) > 6 || parts[1] != "zones" {
+		return nil, newAPIError(http.StatusNotFound, "notFound", "%s is not a zonal resource", r.URL.Path)
+	}
+	project, zone, collection := parts[0], parts[2], parts[3]
+	name, method := "", ""
+	if len(parts) > 4 {
+		name = parts[4]
+	}
+	if len(parts) > 5 {
+		method = parts[5]
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance(time.Now())
+	if s.config.FailureRate > 0 && s.random.Float64() < s.config.FailureRate {
+		return nil, newAPIError(http.StatusServiceUnavailable, "backendError", "Backend Error")
+	}
+
+	result, err := s.route(r, project, zone, collection, name, method)
+	if err != nil {
+		return nil, err
+	}
+	body, encodeErr := json.Marshal(result)
+	if encodeErr != nil {
+		return nil, newAPIError(http.StatusInternalServerError, "internalError", "could not encode response: %v", encodeErr)
+	}
+	return body, nil
+}
+
+// route dispatches the request to the method of the collection.
+func (s *Server) route(r *http.Request, project, zone, collection, name, method string) (interface{}, *apiError) {
+	switch {
+	case collection == "instances" && name == "" && r.Method == http.MethodPost:
+		return s.insertInstance(project, zone, r)
+	case collection == "instances" && name == "" && r.Method == http.MethodGet:
+		return s.listInstances(project, zone, r.URL.Query().Get("filter"))
+	case collection == "instances" && method == "" && r.Method == http.MethodGet:
+		return s.getInstance(project, zone, name)
+	case collection == "instances" && method == "" && r.Method == http.MethodDelete:
+		return s.deleteInstance(project, zone, name)
+	case collection == "instances" && method == "setMetadata" && r.Method == http.MethodPost:
+		return s.setMetadata(project, zone, name, r)
+	case collection == "instances" && method == "setLabels" && r.Method == http.MethodPost:
+		return s.setLabels(project, zone, name, r)
+	case collection == "instances" && method == "serialPort" && r.Method == http.MethodGet:
+		return s.getSerialPortOutput(project, zone, name)
+	case collection == "disks" && method == "" && name != "" && r.Method == http.MethodGet:
+		return s.getDisk(project, zone, name)
+	case collection == "operations" && method == "" && name != "" && r.Method == http.MethodGet:
+		return s.getOperation(project, zone, name)
+	}
+	return nil, newAPIError(http.StatusNotFound, "notFound", "%s %s is not implemented", r.Method, r.URL.Path)
+}
+
+// decode parses the body of the request into the resource.
+func decode(r *http.Request, resource interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(resource); err != nil {
+		return newAPIError(http.StatusBadRequest, "parseError", "could not parse request: %v", err)
+	}
+	return nil
+}
+
+// advance completes the operations that are due and preempts the
+// instances that have run for long enough.
+func (s *Server) advance(now time.Time) {
+	for _, op := range s.operations {
+		if !op.done() && !now.Before(op.due) {
+			op.complete()
+		}
+	}
+	if s.config.PreemptAfter <= 0 {
+		return
+	}
+	for _, i := range s.instances {
+		if i.preemptible() && i.running() && now.Sub(i.started) >= s.config.PreemptAfter {
+			i.preempt()
+		}
+	}
+}
+
+// next returns the next number for a resource.
+func (s *Server) next() uint64 {
+	s.counter++
+	return s.counter
+}
+
+// resourceKey identifies a resource in a zone of a project.
+func resourceKey(project, zone, name string) string {
+	return strings.Join([]string{project, zone, name}, "/")
+}
+
+// resourcePath formats the path of a resource of the kind relative to
+// the projects collection.
+func resourcePath(kind, key string) string {
+	parts := strings.SplitN(key, "/", 3)
+	return fmt.Sprintf("%s/zones/%s/%s/%s", parts[0], parts[1], kind, parts[2])
+}
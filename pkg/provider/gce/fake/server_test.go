@@ -0,0 +1,348 @@
+package fake
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider/gce"
+)
+
+const (
+	project = "ci-project"
+	zone    = "us-east1-b"
+)
+
+func newTestServer(t *testing.T, config Config) (*Server, gce.Client, func()) {
+	s := NewServer(config)
+	server := httptest.NewServer(s)
+	client, err := gce.NewClient(server.URL)
+	if err != nil {
+		server.Close()
+		t.Fatalf("could not create client: %v", err)
+	}
+	return s, client, server.Close
+}
+
+// advance moves the clock of the server forward, completing the
+// operations and preempting the instances that are due by then.
+func advance(s *Server, duration time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance(time.Now().Add(duration))
+}
+
+func testInstance(name string, preemptible bool) *compute.Instance {
+	return &compute.Instance{
+		Name:   name,
+		Labels: map[string]string{"ci-vm-name": name},
+		Disks: []*compute.AttachedDisk{
+			{
+				Boot:       true,
+				AutoDelete: true,
+				InitializeParams: &compute.AttachedDiskInitializeParams{
+					DiskSizeGb:  20,
+					SourceImage: "projects/centos-cloud/global/images/family/centos-7",
+				},
+			},
+			{
+				InitializeParams: &compute.AttachedDiskInitializeParams{DiskSizeGb: 100},
+			},
+		},
+		NetworkInterfaces: []*compute.NetworkInterface{{
+			AccessConfigs: []*compute.AccessConfig{{Type: "ONE_TO_ONE_NAT"}},
+		}},
+		Scheduling: &compute.Scheduling{Preemptible: preemptible},
+	}
+}
+
+// expectAPIError checks that the request failed with the status code
+// and reason.
+func expectAPIError(t *testing.T, err error, code int, reason string) {
+	apiErr, ok := err.(*googleapi.Error)
+	if !ok {
+		t.Fatalf("expected an API error, got %v", err)
+	}
+	if apiErr.Code != code || len(apiErr.Errors) != 1 || apiErr.Errors[0].Reason != reason {
+		t.Errorf("expected a %d %s error, got %#v", code, reason, apiErr)
+	}
+}
+
+func TestInsertInstance(t *testing.T) {
+	s, client, done := newTestServer(t, Config{OperationDuration: time.Hour})
+	defer done()
+
+	op, err := client.InstancesInsert(project, zone, testInstance("vm", false))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Status != operationStatusRunning || op.OperationType != "insert" {
+		t.Errorf("expected a running insert operation, got %#v", op)
+	}
+	instance, err := client.InstancesGet(project, zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance.Status != statusProvisioning {
+		t.Errorf("expected the instance to be provisioning, got %s", instance.Status)
+	}
+	if network := instance.NetworkInterfaces[0]; network.NetworkIP == "" || network.AccessConfigs[0].NatIP == "" {
+		t.Errorf("expected the instance to be given addresses, got %#v", network)
+	}
+	for _, name := range []string{"vm", "vm-1"} {
+		if _, err := client.DisksGet(project, zone, name); err != nil {
+			t.Errorf("expected disk %s to be created, got %v", name, err)
+		}
+	}
+	if _, err := client.InstancesInsert(project, zone, testInstance("vm", false)); err == nil {
+		t.Error("expected an error inserting the instance again, got none")
+	} else {
+		expectAPIError(t, err, http.StatusConflict, "alreadyExists")
+	}
+
+	advance(s, time.Hour)
+	if op, err = client.ZoneOperationsGet(project, zone, op.Name); err != nil || op.Status != operationStatusDone || op.Error != nil {
+		t.Errorf("expected the operation to be done, got %#v, %v", op, err)
+	}
+	if instance, err = client.InstancesGet(project, zone, "vm"); err != nil || instance.Status != statusRunning {
+		t.Fatalf("expected the instance to be running, got %#v, %v", instance, err)
+	}
+	output, err := client.GetSerialPortOutput(project, zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(output.Contents, hostKeysBegin) || !strings.Contains(output.Contents, "ssh-ed25519 ") {
+		t.Errorf("expected a host key on the console, got %q", output.Contents)
+	}
+}
+
+func TestOperationsCompleteImmediately(t *testing.T) {
+	_, client, done := newTestServer(t, Config{})
+	defer done()
+
+	op, err := client.InstancesInsert(project, zone, testInstance("vm", false))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Status != operationStatusDone {
+		t.Errorf("expected the operation to be done, got %s", op.Status)
+	}
+	if instance, err := client.InstancesGet(project, zone, "vm"); err != nil || instance.Status != statusRunning {
+		t.Errorf("expected the instance to be running, got %#v, %v", instance, err)
+	}
+}
+
+func TestDeleteInstance(t *testing.T) {
+	s, client, done := newTestServer(t, Config{OperationDuration: time.Hour})
+	defer done()
+	if _, err := client.InstancesInsert(project, zone, testInstance("vm", false)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	advance(s, time.Hour)
+
+	op, err := client.InstancesDelete(project, zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance, err := client.InstancesGet(project, zone, "vm"); err != nil || instance.Status != statusStopping {
+		t.Errorf("expected the instance to be stopping, got %#v, %v", instance, err)
+	}
+
+	advance(s, 2*time.Hour)
+	if op, err = client.ZoneOperationsGet(project, zone, op.Name); err != nil || op.Status != operationStatusDone {
+		t.Errorf("expected the operation to be done, got %#v, %v", op, err)
+	}
+	_, err = client.InstancesGet(project, zone, "vm")
+	expectAPIError(t, err, http.StatusNotFound, "notFound")
+	_, err = client.DisksGet(project, zone, "vm")
+	expectAPIError(t, err, http.StatusNotFound, "notFound")
+	if _, err := client.DisksGet(project, zone, "vm-1"); err != nil {
+		t.Errorf("expected the disk that is not deleted with the instance to be kept, got %v", err)
+	}
+	_, err = client.InstancesDelete(project, zone, "vm")
+	expectAPIError(t, err, http.StatusNotFound, "notFound")
+}
+
+func TestQuotaExceededZones(t *testing.T) {
+	s, client, done := newTestServer(t, Config{QuotaExceededZones: []string{zone}})
+	defer done()
+
+	_, err := client.InstancesInsert(project, zone, testInstance("vm", false))
+	expectAPIError(t, err, http.StatusForbidden, "quotaExceeded")
+	if _, err := client.InstancesInsert(project, "us-east1-c", testInstance("vm", false)); err != nil {
+		t.Errorf("expected other zones to have quota, got %v", err)
+	}
+
+	s.SetQuotaExceeded(zone, false)
+	if _, err := client.InstancesInsert(project, zone, testInstance("vm", false)); err != nil {
+		t.Errorf("expected the zone to have quota again, got %v", err)
+	}
+}
+
+func TestExhaustedZones(t *testing.T) {
+	s, client, done := newTestServer(t, Config{ExhaustedZones: []string{zone}})
+	defer done()
+
+	op, err := client.InstancesInsert(project, zone, testInstance("vm", false))
+	if err != nil {
+		t.Fatalf("expected the insertion to be accepted, got %v", err)
+	}
+	if op.Status != operationStatusDone || op.Error == nil || len(op.Error.Errors) != 1 || op.Error.Errors[0].Code != "ZONE_RESOURCE_POOL_EXHAUSTED" {
+		t.Errorf("expected the operation to fail for lack of resources, got %#v", op)
+	}
+	_, err = client.InstancesGet(project, zone, "vm")
+	expectAPIError(t, err, http.StatusNotFound, "notFound")
+	_, err = client.DisksGet(project, zone, "vm")
+	expectAPIError(t, err, http.StatusNotFound, "notFound")
+
+	s.SetExhausted(zone, false)
+	if op, err = client.InstancesInsert(project, zone, testInstance("vm", false)); err != nil || op.Error != nil {
+		t.Errorf("expected the zone to have resources again, got %#v, %v", op, err)
+	}
+}
+
+func TestFailureRate(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		failureRate float64
+		minFailures int
+		maxFailures int
+	}{
+		{
+			name:        "no failures",
+			failureRate: 0,
+		},
+		{
+			name:        "some failures",
+			failureRate: 0.5,
+			minFailures: 1,
+			maxFailures: 49,
+		},
+		{
+			name:        "all failures",
+			failureRate: 1,
+			minFailures: 50,
+			maxFailures: 50,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			_, client, done := newTestServer(t, Config{FailureRate: testCase.failureRate, Seed: 1})
+			defer done()
+			failures := 0
+			for i := 0; i < 50; i++ {
+				_, err := client.InstancesList(project, zone, "")
+				if err == nil {
+					continue
+				}
+				failures++
+				expectAPIError(t, err, http.StatusServiceUnavailable, "backendError")
+			}
+			if failures < testCase.minFailures || failures > testCase.maxFailures {
+				t.Errorf("expected between %d and %d failures, got %d", testCase.minFailures, testCase.maxFailures, failures)
+			}
+		})
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	s, client, done := newTestServer(t, Config{PreemptAfter: time.Minute})
+	defer done()
+	for _, instance := range []*compute.Instance{testInstance("preemptible", true), testInstance("regular", false)} {
+		if _, err := client.InstancesInsert(project, zone, instance); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if instance, err := client.InstancesGet(project, zone, "preemptible"); err != nil || instance.Status != statusRunning {
+		t.Errorf("expected the instance to be running until it is due, got %#v, %v", instance, err)
+	}
+
+	advance(s, 2*time.Minute)
+	if instance, err := client.InstancesGet(project, zone, "preemptible"); err != nil || instance.Status != statusTerminated {
+		t.Errorf("expected the preemptible instance to be preempted, got %#v, %v", instance, err)
+	}
+	if output, err := client.GetSerialPortOutput(project, zone, "preemptible"); err != nil || !strings.Contains(output.Contents, "preempted") {
+		t.Errorf("expected the preemption on the console, got %#v, %v", output, err)
+	}
+	if instance, err := client.InstancesGet(project, zone, "regular"); err != nil || instance.Status != statusRunning {
+		t.Errorf("expected the regular instance to keep running, got %#v, %v", instance, err)
+	}
+
+	if err := s.Preempt(project, zone, "regular"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance, err := client.InstancesGet(project, zone, "regular"); err != nil || instance.Status != statusTerminated {
+		t.Errorf("expected the instance to be preempted on demand, got %#v, %v", instance, err)
+	}
+	if err := s.Preempt(project, zone, "missing"); err == nil {
+		t.Error("expected an error preempting a missing instance, got none")
+	}
+}
+
+func TestSetMetadataAndLabels(t *testing.T) {
+	_, client, done := newTestServer(t, Config{})
+	defer done()
+	if _, err := client.InstancesInsert(project, zone, testInstance("vm", false)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	instance, err := client.InstancesGet(project, zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	value := "cloud-user:ssh-ed25519 AAAA"
+	stale := &compute.Metadata{Fingerprint: "stale", Items: []*compute.MetadataItems{{Key: "ssh-keys", Value: &value}}}
+	_, err = client.SetMetadata(project, zone, "vm", stale)
+	expectAPIError(t, err, http.StatusPreconditionFailed, "conditionNotMet")
+	current := &compute.Metadata{Fingerprint: instance.Metadata.Fingerprint, Items: stale.Items}
+	if _, err := client.SetMetadata(project, zone, "vm", current); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = client.SetLabels(project, zone, "vm", &compute.InstancesSetLabelsRequest{LabelFingerprint: "stale", Labels: map[string]string{"owner": "ci"}})
+	expectAPIError(t, err, http.StatusPreconditionFailed, "conditionNotMet")
+	if _, err := client.SetLabels(project, zone, "vm", &compute.InstancesSetLabelsRequest{LabelFingerprint: instance.LabelFingerprint, Labels: map[string]string{"owner": "ci"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	updated, err := client.InstancesGet(project, zone, "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(updated.Metadata.Items) != 1 || *updated.Metadata.Items[0].Value != value || updated.Metadata.Fingerprint == instance.Metadata.Fingerprint {
+		t.Errorf("expected the metadata to be replaced, got %#v", updated.Metadata)
+	}
+	if updated.Labels["owner"] != "ci" || updated.LabelFingerprint == instance.LabelFingerprint {
+		t.Errorf("expected the labels to be replaced, got %v", updated.Labels)
+	}
+}
+
+func TestListInstances(t *testing.T) {
+	_, client, done := newTestServer(t, Config{})
+	defer done()
+	for _, name := range []string{"first", "second"} {
+		if _, err := client.InstancesInsert(project, zone, testInstance(name, false)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := client.InstancesInsert(project, "us-east1-c", testInstance("elsewhere", false)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	instances, err := client.InstancesList(project, zone, "")
+	if err != nil || len(instances) != 2 || instances[0].Name != "first" || instances[1].Name != "second" {
+		t.Errorf("expected the instances of the zone, got %v, %v", instances, err)
+	}
+	instances, err = client.InstancesList(project, zone, `(labels.ci-vm-name = "second")`)
+	if err != nil || len(instances) != 1 || instances[0].Name != "second" {
+		t.Errorf("expected only the matching instance, got %v, %v", instances, err)
+	}
+	_, err = client.InstancesList(project, zone, `name eq "first"`)
+	expectAPIError(t, err, http.StatusBadRequest, "invalid")
+}
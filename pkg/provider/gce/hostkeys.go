@@ -0,0 +1,19 @@
+package gce
+
+import (
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider/cloudinit"
+)
+
+// HostKeys reads the host keys the instance has printed on its serial
+// console, if it has done so yet.
+func (p *gceProvider) HostKeys(zone, name string) ([]ssh.PublicKey, error) {
+	output, err := p.client.GetSerialPortOutput(p.project, zone, name)
+	if err != nil {
+		return nil, fmt.Errorf("could not get serial port output: %v", translateError(err))
+	}
+	return cloudinit.ParseHostKeys(output.Contents), nil
+}
@@ -0,0 +1,201 @@
+package gce
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/api/compute/v1"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	defaultNetwork = "default"
+
+	// instanceStatusTerminated is the status of a stopped instance
+	instanceStatusTerminated = "TERMINATED"
+)
+
+// instanceFor builds the GCE instance to insert for the spec.
+func (p *gceProvider) instanceFor(spec *provider.InstanceSpec) *compute.Instance {
+	zone := spec.Zone
+	disks := []*compute.AttachedDisk{
+		{
+			AutoDelete: true,
+			Boot:       true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				Labels:      spec.Labels,
+				SourceImage: spec.Spec.BootDisk.ImageFamily,
+				DiskSizeGb:  spec.Spec.BootDisk.SizeGB,
+				DiskType:    fmt.Sprintf("projects/%s/zones/%s/diskTypes/%s", p.project, zone, spec.Spec.BootDisk.Type),
+			},
+		},
+	}
+	for _, disk := range spec.Spec.Disks {
+		disks = append(disks, &compute.AttachedDisk{
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				Labels:     spec.Labels,
+				DiskSizeGb: disk.SizeGB,
+				DiskType:   string(disk.Type),
+			},
+		})
+	}
+	return &compute.Instance{
+		Name:        spec.Name,
+		Labels:      spec.Labels,
+		Tags:        &compute.Tags{Items: spec.Spec.NetworkTags},
+		Scheduling:  schedulingFor(spec.Spec.Scheduling),
+		MachineType: fmt.Sprintf("zones/%s/machineTypes/%s", zone, spec.Spec.MachineType),
+		Metadata: &compute.Metadata{
+			Items: metadataItems(spec),
+		},
+		CanIpForward:      true,
+		NetworkInterfaces: networkInterfacesFor(spec.Spec.Network, zone),
+		Disks:             disks,
+	}
+}
+
+// instanceFrom describes the GCE instance in the terms of the provider
+// contract.
+func instanceFrom(zone string, instance *compute.Instance, image string) *provider.Instance {
+	described := &provider.Instance{
+		Name:           instance.Name,
+		Zone:           zone,
+		SelfLink:       instance.SelfLink,
+		MachineType:    instance.MachineType,
+		Image:          image,
+		Labels:         instance.Labels,
+		Terminated:     instance.Status == instanceStatusTerminated,
+		AuthorizedKeys: authorizedKeys(instance.Metadata),
+	}
+	if instance.Id != 0 {
+		described.ID = fmt.Sprintf("%d", instance.Id)
+	}
+	if len(instance.NetworkInterfaces) > 0 {
+		networkInterface := instance.NetworkInterfaces[0]
+		described.InternalIP = networkInterface.NetworkIP
+		for _, accessConfig := range networkInterface.AccessConfigs {
+			if accessConfig.NatIP != "" {
+				described.ExternalIP = accessConfig.NatIP
+				break
+			}
+		}
+	}
+	if created, err := time.Parse(time.RFC3339, instance.CreationTimestamp); err == nil {
+		described.Created = created
+	}
+	return described
+}
+
+// bootImage is the image the boot disk of an instance was created from.
+type bootImage struct {
+	instanceID uint64
+	image      string
+}
+
+// bootImageFor determines the image the boot disk of the instance was
+// created from. The instance itself only references its disks, so the
+// boot disk is looked up unless the image of this instance is already
+// known; failing to do so is not fatal as the image is only informational.
+func (p *gceProvider) bootImageFor(zone string, instance *compute.Instance) string {
+	key := path.Join(zone, instance.Name)
+	p.lock.Lock()
+	known, ok := p.images[key]
+	p.lock.Unlock()
+	if ok && known.instanceID == instance.Id {
+		return known.image
+	}
+
+	for _, disk := range instance.Disks {
+		if !disk.Boot || disk.Source == "" {
+			continue
+		}
+		bootDisk, err := p.client.DisksGet(p.project, zone, path.Base(disk.Source))
+		if err != nil {
+			return ""
+		}
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		p.images[key] = bootImage{instanceID: instance.Id, image: bootDisk.SourceImage}
+		return bootDisk.SourceImage
+	}
+	return ""
+}
+
+// forgetBootImage drops the image of a deleted instance.
+func (p *gceProvider) forgetBootImage(zone, name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.images, path.Join(zone, name))
+}
+
+// networkInterfacesFor determines the network interface of the instance
+// in the zone. Unless asked otherwise, the instance is attached to the
+// default network with an ephemeral external address.
+func networkInterfacesFor(spec *vmapi.VirtualMachineNetworkSpec, zone string) []*compute.NetworkInterface {
+	if spec == nil {
+		spec = &vmapi.VirtualMachineNetworkSpec{}
+	}
+
+	network := spec.Network
+	if network == "" {
+		network = defaultNetwork
+	}
+	networkInterface := &compute.NetworkInterface{
+		Network: resourcePath(network, "global/networks"),
+	}
+	if spec.Subnetwork != "" {
+		region := GCPZone(zone).Region()
+		networkInterface.Subnetwork = resourcePath(spec.Subnetwork, fmt.Sprintf("regions/%s/subnetworks", region))
+	}
+
+	switch spec.ExternalAccess {
+	case vmapi.VirtualMachineExternalAccessNone:
+	case vmapi.VirtualMachineExternalAccessStatic:
+		networkInterface.AccessConfigs = []*compute.AccessConfig{{
+			Type:  "ONE_TO_ONE_NAT",
+			Name:  "External NAT",
+			NatIP: spec.StaticAddress,
+		}}
+	default:
+		networkInterface.AccessConfigs = []*compute.AccessConfig{{
+			Type: "ONE_TO_ONE_NAT",
+			Name: "External NAT",
+		}}
+	}
+	return []*compute.NetworkInterface{networkInterface}
+}
+
+// resourcePath qualifies the name of a GCE resource with its collection,
+// leaving partial or full URLs untouched.
+func resourcePath(name, collection string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return fmt.Sprintf("%s/%s", collection, name)
+}
+
+// schedulingFor determines the GCE scheduling options for the instance.
+// Preemptible instances must terminate on host maintenance and may
+// not be restarted automatically.
+func schedulingFor(spec *vmapi.VirtualMachineScheduling) *compute.Scheduling {
+	if spec == nil {
+		return nil
+	}
+
+	scheduling := &compute.Scheduling{
+		Preemptible:       spec.Preemptible,
+		OnHostMaintenance: string(spec.OnHostMaintenance),
+		AutomaticRestart:  spec.AutomaticRestart,
+	}
+	if spec.Preemptible {
+		automaticRestart := false
+		scheduling.OnHostMaintenance = string(vmapi.VirtualMachineMaintenancePolicyTerminate)
+		scheduling.AutomaticRestart = &automaticRestart
+	}
+	return scheduling
+}
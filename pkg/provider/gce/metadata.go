@@ -0,0 +1,123 @@
+package gce
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/compute/v1"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// maxMetadataConflicts is the number of times we retry setting
+	// metadata when it changes underneath us
+	maxMetadataConflicts = 5
+
+	metadataKeySSHKeys       = "ssh-keys"
+	metadataKeyStartupScript = "startup-script"
+	metadataKeyUserData      = "user-data"
+)
+
+// sshKey formats the SSH key of the spec as GCE expects it in the
+// ssh-keys metadata item.
+func sshKey(spec *provider.InstanceSpec) string {
+	return fmt.Sprintf("%s:%s %s", spec.User, strings.TrimSpace(spec.PublicKey), spec.User)
+}
+
+// authorizedKeys extracts the keys from the ssh-keys metadata item,
+// dropping the user and comment of each.
+func authorizedKeys(metadata *compute.Metadata) []string {
+	if metadata == nil {
+		return nil
+	}
+	var keys []string
+	for _, item := range metadata.Items {
+		if item.Key != metadataKeySSHKeys || item.Value == nil {
+			continue
+		}
+		for _, line := range strings.Split(*item.Value, "\n") {
+			if index := strings.Index(line, ":"); index >= 0 {
+				line = line[index+1:]
+			}
+			fields := strings.Fields(line)
+			if len(fields) >= 2 {
+				keys = append(keys, fmt.Sprintf("%s %s", fields[0], fields[1]))
+			}
+		}
+	}
+	return keys
+}
+
+// metadataItems builds the metadata items the operator manages for
+// the instance, in a stable order: the SSH key, any extra items from
+// the spec, and then the startup script and user data if requested.
+func metadataItems(spec *provider.InstanceSpec) []*compute.MetadataItems {
+	key := sshKey(spec)
+	items := []*compute.MetadataItems{{
+		Key:   metadataKeySSHKeys,
+		Value: &key,
+	}}
+	keys := make([]string, 0, len(spec.Spec.Metadata))
+	for key := range spec.Spec.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := spec.Spec.Metadata[key]
+		items = append(items, &compute.MetadataItems{Key: key, Value: &value})
+	}
+	if spec.StartupScript != "" {
+		value := spec.StartupScript
+		items = append(items, &compute.MetadataItems{Key: metadataKeyStartupScript, Value: &value})
+	}
+	if spec.UserData != "" {
+		value := spec.UserData
+		items = append(items, &compute.MetadataItems{Key: metadataKeyUserData, Value: &value})
+	}
+	return items
+}
+
+// mergeMetadata overlays the items onto the current metadata of an
+// instance, keeping the fingerprint of the current metadata so that
+// GCE rejects the update if the metadata changed in the meantime.
+func mergeMetadata(current *compute.Metadata, items []*compute.MetadataItems) *compute.Metadata {
+	merged := &compute.Metadata{}
+	overlaid := map[string]*compute.MetadataItems{}
+	for _, item := range items {
+		overlaid[item.Key] = item
+	}
+	if current != nil {
+		merged.Fingerprint = current.Fingerprint
+		for _, item := range current.Items {
+			if _, replaced := overlaid[item.Key]; !replaced {
+				merged.Items = append(merged.Items, item)
+			}
+		}
+	}
+	merged.Items = append(merged.Items, items...)
+	return merged
+}
+
+// SetSSHKey merges the SSH key and metadata of the spec into the metadata
+// of the instance, leaving metadata the operator does not manage untouched.
+// Should the metadata change between reading and writing it, the update is
+// retried.
+func (p *gceProvider) SetSSHKey(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	items := metadataItems(spec)
+	for conflicts := 0; ; conflicts++ {
+		instance, err := p.client.InstancesGet(p.project, spec.Zone, spec.Name)
+		if err != nil {
+			return nil, translateError(err)
+		}
+		op, err := p.client.SetMetadata(p.project, spec.Zone, spec.Name, mergeMetadata(instance.Metadata, items))
+		if isConflict(err) && conflicts < maxMetadataConflicts {
+			continue
+		}
+		if err != nil {
+			return nil, translateError(err)
+		}
+		return operationFor(spec.Zone, provider.OperationSetSSHKey, op), nil
+	}
+}
@@ -0,0 +1,145 @@
+// Package gce implements the provider contract for Google Compute Engine.
+package gce
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/api/compute/v1"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// Name identifies the provider in the configuration
+	Name = "gce"
+
+	operationStatusDone = "DONE"
+)
+
+// New returns a provider that manages instances in the GCE project.
+func New(project string, client Client) provider.Provider {
+	return &gceProvider{
+		project: project,
+		client:  client,
+		images:  map[string]bootImage{},
+	}
+}
+
+type gceProvider struct {
+	project string
+	client  Client
+
+	// images caches the boot images of instances, which
+	// can only be determined by looking up their disks
+	lock   sync.Mutex
+	images map[string]bootImage
+}
+
+var _ provider.Provider = &gceProvider{}
+
+func (p *gceProvider) Create(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	op, err := p.client.InstancesInsert(p.project, spec.Zone, p.instanceFor(spec))
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(spec.Zone, provider.OperationCreate, op), nil
+}
+
+func (p *gceProvider) Get(zone, name string) (*provider.Instance, error) {
+	instance, err := p.client.InstancesGet(p.project, zone, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return instanceFrom(zone, instance, p.bootImageFor(zone, instance)), nil
+}
+
+func (p *gceProvider) Delete(zone, name string) (*provider.Operation, error) {
+	op, err := p.client.InstancesDelete(p.project, zone, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	p.forgetBootImage(zone, name)
+	return operationFor(zone, provider.OperationDelete, op), nil
+}
+
+// SetLabels adds the labels to those of the instance, using the label
+// fingerprint so that GCE rejects the update if the labels changed in
+// the meantime.
+func (p *gceProvider) SetLabels(zone, name string, labels map[string]string) (*provider.Operation, error) {
+	instance, err := p.client.InstancesGet(p.project, zone, name)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	merged := map[string]string{}
+	for key, value := range instance.Labels {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	op, err := p.client.SetLabels(p.project, zone, name, &compute.InstancesSetLabelsRequest{
+		LabelFingerprint: instance.LabelFingerprint,
+		Labels:           merged,
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(zone, provider.OperationSetLabels, op), nil
+}
+
+// Poll checks on the zone operation. Operations are garbage collected
+// some time after they complete, so an operation that no longer exists
+// is reported as done, leaving its outcome to be observed on the instance.
+func (p *gceProvider) Poll(op *provider.Operation) (*provider.OperationStatus, error) {
+	gceOp, err := p.client.ZoneOperationsGet(p.project, op.Zone, op.Name)
+	if err != nil {
+		if isNotFound(err) {
+			return &provider.OperationStatus{Done: true, Message: "operation no longer exists"}, nil
+		}
+		return nil, err
+	}
+	status := &provider.OperationStatus{
+		Done:    gceOp.Status == operationStatusDone,
+		Message: fmt.Sprintf("%v (%d%%): %v", gceOp.Status, gceOp.Progress, gceOp.StatusMessage),
+	}
+	if status.Done && gceOp.Error != nil && len(gceOp.Error.Errors) > 0 {
+		status.Error = translateError(&operationError{errors: gceOp.Error.Errors})
+	}
+	return status, nil
+}
+
+// List lists the instances in the zone that carry all of the labels.
+func (p *gceProvider) List(zone string, labels map[string]string) ([]*provider.Instance, error) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var filters []string
+	for _, key := range keys {
+		filters = append(filters, fmt.Sprintf("(labels.%s = %q)", key, labels[key]))
+	}
+
+	instances, err := p.client.InstancesList(p.project, zone, strings.Join(filters, " "))
+	if err != nil {
+		return nil, translateError(err)
+	}
+	var described []*provider.Instance
+	for _, instance := range instances {
+		described = append(described, instanceFrom(zone, instance, ""))
+	}
+	return described, nil
+}
+
+// operationFor identifies the GCE operation in the terms of the provider
+// contract.
+func operationFor(zone, operationType string, op *compute.Operation) *provider.Operation {
+	return &provider.Operation{
+		Name: op.Name,
+		Zone: zone,
+		Type: operationType,
+	}
+}
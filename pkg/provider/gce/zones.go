@@ -0,0 +1,62 @@
+package gce
+
+import (
+	"strings"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+type GCPZone string
+
+const (
+	GCPZoneUSEast1b    GCPZone = "us-east1-b"
+	GCPZoneUSEast1c            = "us-east1-c"
+	GCPZoneUSEast1d            = "us-east1-d"
+	GCPZoneUSEast4c            = "us-east4-c"
+	GCPZoneUSEast4b            = "us-east4-b"
+	GCPZoneUSEast4a            = "us-east4-a"
+	GCPZoneUSCentral1c         = "us-central1-c"
+	GCPZoneUSCentral1a         = "us-central1-a"
+	GCPZoneUSCentral1f         = "us-central1-f"
+	GCPZoneUSCentral1b         = "us-central1-b"
+	GCPZoneUSWest1b            = "us-west1-b"
+	GCPZoneUSWest1c            = "us-west1-c"
+	GCPZoneUSWest1a            = "us-west1-a"
+)
+
+// gcpZones are the zones that virtual machines may be provisioned in.
+var gcpZones = []GCPZone{
+	GCPZoneUSEast1b,
+	GCPZoneUSEast1c,
+	GCPZoneUSEast1d,
+	GCPZoneUSEast4c,
+	GCPZoneUSEast4b,
+	GCPZoneUSEast4a,
+	GCPZoneUSCentral1c,
+	GCPZoneUSCentral1a,
+	GCPZoneUSCentral1f,
+	GCPZoneUSCentral1b,
+	GCPZoneUSWest1b,
+	GCPZoneUSWest1c,
+	GCPZoneUSWest1a,
+}
+
+// Region is the region the zone is in.
+func (z GCPZone) Region() string {
+	return string(z[:strings.LastIndex(string(z), "-")])
+}
+
+// Zones lists the zones that virtual machines may be provisioned in, so
+// that specs can be validated without a provider.
+func Zones() []provider.Zone {
+	var zones []provider.Zone
+	for _, zone := range gcpZones {
+		zones = append(zones, provider.Zone{Name: string(zone), Region: zone.Region()})
+	}
+	return zones
+}
+
+// Zones lists the zones that virtual machines may be provisioned in.
+func (p *gceProvider) Zones() []provider.Zone {
+	return Zones()
+}
@@ -0,0 +1,33 @@
+package kubevirt
+
+import (
+	"fmt"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+)
+
+// virtualMachineInstances is the resource the provider manages instances
+// through, as served by the dynamic client for the KubeVirt API.
+var virtualMachineInstances = &meta.APIResource{
+	Name:       "virtualmachineinstances",
+	Kind:       "VirtualMachineInstance",
+	Namespaced: true,
+}
+
+// NewClient returns a dynamic client for the configured version of the
+// KubeVirt API of the cluster. The KubeVirt API types are not vendored,
+// so instances are handled as unstructured objects.
+func NewClient(config *rest.Config, kubevirtConfig Config) (dynamic.Interface, error) {
+	kubevirtConfig = kubevirtConfig.defaulted()
+	groupVersion, err := schema.ParseGroupVersion(kubevirtConfig.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse API version: %v", err)
+	}
+	config = rest.CopyConfig(config)
+	config.APIPath = "/apis"
+	config.GroupVersion = &groupVersion
+	return dynamic.NewClient(config)
+}
@@ -0,0 +1,366 @@
+// Package kubevirt implements the provider contract with KubeVirt
+// VirtualMachineInstances in the cluster the operator runs in. Instances
+// boot from a container disk and are given their SSH key and host keys by
+// cloud-init, so that the host keys are known without reading the console
+// of the instance. The user data holding the private host key is kept in
+// a Secret owned by the instance rather than in its spec.
+package kubevirt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/cloudinit"
+)
+
+const (
+	// Name identifies the provider in the configuration
+	Name = "kubevirt"
+
+	defaultAPIVersion = "kubevirt.io/v1"
+	defaultZone       = "kubevirt"
+
+	// the provider records what KubeVirt does not know
+	// about an instance in its annotations
+	annotationMachineType    = "virtualmachines.ci.openshift.io/machine-type"
+	annotationAuthorizedKeys = "virtualmachines.ci.openshift.io/authorized-keys"
+	annotationHostKeys       = "virtualmachines.ci.openshift.io/host-keys"
+
+	// userDataKey is the key of the user data in the Secret
+	// of an instance, as KubeVirt reads it
+	userDataKey = "userdata"
+
+	phaseRunning   = "Running"
+	phaseSucceeded = "Succeeded"
+	phaseFailed    = "Failed"
+)
+
+// Config configures the VirtualMachineInstances the provider creates.
+type Config struct {
+	// Namespace is the namespace instances are created in
+	Namespace string `json:"namespace"`
+	// APIVersion is the version of the KubeVirt API to use;
+	// kubevirt.io/v1 is used if unset
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Zone is the name of the only zone of the provider, which
+	// VirtualMachines are provisioned in; kubevirt is used if unset
+	Zone string `json:"zone,omitempty"`
+	// Images maps the image family of the boot disk of a
+	// VirtualMachine to the container disk image to boot from
+	Images map[string]string `json:"images"`
+	// MachineTypes maps the machine type of a VirtualMachine
+	// to the resources of the instance; the resources of standard
+	// GCE machine types are used for types not listed
+	MachineTypes map[string]MachineType `json:"machineTypes,omitempty"`
+}
+
+// MachineType holds the resources of an instance.
+type MachineType struct {
+	CPUs int `json:"cpus"`
+	// Memory is a quantity, as in 4Gi
+	Memory string `json:"memory"`
+}
+
+// defaulted fills in the defaults for unset fields.
+func (c Config) defaulted() Config {
+	if c.APIVersion == "" {
+		c.APIVersion = defaultAPIVersion
+	}
+	if c.Zone == "" {
+		c.Zone = defaultZone
+	}
+	return c
+}
+
+// New returns a provider that manages VirtualMachineInstances with the
+// dynamic client, as returned by NewClient for the configuration, and
+// their Secrets with the Kubernetes client.
+func New(config Config, client dynamic.Interface, kubeClient kubernetes.Interface) provider.Provider {
+	config = config.defaulted()
+	return &kubevirtProvider{
+		config:    config,
+		instances: client.Resource(virtualMachineInstances, config.Namespace),
+		secrets:   kubeClient.CoreV1().Secrets(config.Namespace),
+	}
+}
+
+type kubevirtProvider struct {
+	config    Config
+	instances dynamic.ResourceInterface
+	secrets   corev1client.SecretInterface
+}
+
+var _ provider.Provider = &kubevirtProvider{}
+
+func (p *kubevirtProvider) Zones() []provider.Zone {
+	return []provider.Zone{{Name: p.config.Zone, Region: p.config.Zone}}
+}
+
+// Create creates the instance and then the Secret holding its user data,
+// so that the Secret is owned by the instance and collected along with
+// it. The pod of the instance does not start until the Secret exists.
+func (p *kubevirtProvider) Create(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	if err := p.checkZone(spec.Zone); err != nil {
+		return nil, err
+	}
+	image, ok := p.config.Images[spec.Spec.BootDisk.ImageFamily]
+	if !ok {
+		return nil, fmt.Errorf("no image is configured for image family %q", spec.Spec.BootDisk.ImageFamily)
+	}
+	machineType, err := p.machineTypeFor(string(spec.Spec.MachineType))
+	if err != nil {
+		return nil, err
+	}
+	userData, hostKey, err := cloudinit.UserData(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	vmi := virtualMachineInstanceFor(p.config.APIVersion, spec, image, machineType, userDataSecret(spec.Name))
+	vmi.SetAnnotations(map[string]string{
+		annotationMachineType:    string(spec.Spec.MachineType),
+		annotationAuthorizedKeys: normalizeKey(spec.PublicKey),
+		annotationHostKeys:       hostKey,
+	})
+	created, err := p.instances.Create(vmi)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if err := p.storeUserData(created, userData); err != nil {
+		// the instance would never start without its user data
+		if deleteErr := p.instances.Delete(created.GetName(), &meta.DeleteOptions{Preconditions: &meta.Preconditions{UID: uidOf(created)}}); deleteErr != nil && !kerrors.IsNotFound(deleteErr) {
+			return nil, fmt.Errorf("%v; could not delete VirtualMachineInstance: %v", err, deleteErr)
+		}
+		return nil, err
+	}
+	return operationFor(spec.Zone, spec.Name, provider.OperationCreate), nil
+}
+
+func (p *kubevirtProvider) Get(zone, name string) (*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	vmi, err := p.instances.Get(name, meta.GetOptions{})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return instanceFrom(zone, vmi), nil
+}
+
+// Delete deletes the instance, whose Secret is collected along with it.
+func (p *kubevirtProvider) Delete(zone, name string) (*provider.Operation, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	if err := p.instances.Delete(name, &meta.DeleteOptions{}); err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(zone, name, provider.OperationDelete), nil
+}
+
+// SetSSHKey fails, as cloud-init only installs keys when the instance
+// is created and the spec of an instance cannot be changed.
+func (p *kubevirtProvider) SetSSHKey(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	return nil, provider.ErrUnsupported
+}
+
+// SetLabels adds the labels to those of the instance.
+func (p *kubevirtProvider) SetLabels(zone, name string, labels map[string]string) (*provider.Operation, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"labels": labels},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.instances.Patch(name, types.MergePatchType, patch); err != nil {
+		return nil, translateError(err)
+	}
+	return operationFor(zone, name, provider.OperationSetLabels), nil
+}
+
+// Poll checks on the instance the operation changed. An instance is
+// created once it is running with an address, and deleted once it no
+// longer exists.
+func (p *kubevirtProvider) Poll(op *provider.Operation) (*provider.OperationStatus, error) {
+	vmi, err := p.instances.Get(nameOf(op), meta.GetOptions{})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return nil, err
+	}
+	exists := err == nil
+
+	switch op.Type {
+	case provider.OperationCreate:
+		if !exists {
+			return &provider.OperationStatus{Done: true, Error: errors.New("the VirtualMachineInstance no longer exists")}, nil
+		}
+		phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+		switch {
+		case phase == phaseFailed || phase == phaseSucceeded:
+			return &provider.OperationStatus{Done: true, Error: fmt.Errorf("the VirtualMachineInstance stopped in phase %s", phase)}, nil
+		case phase == phaseRunning && addressOf(vmi) != "":
+			return &provider.OperationStatus{Done: true, Message: phase}, nil
+		case phase == phaseRunning:
+			return &provider.OperationStatus{Message: "waiting for an address"}, nil
+		default:
+			return &provider.OperationStatus{Message: fmt.Sprintf("phase %q", phase)}, nil
+		}
+	case provider.OperationDelete:
+		if exists {
+			return &provider.OperationStatus{Message: "waiting for the VirtualMachineInstance to be deleted"}, nil
+		}
+		return &provider.OperationStatus{Done: true, Message: "deleted"}, nil
+	default:
+		return &provider.OperationStatus{Done: true, Message: "completed"}, nil
+	}
+}
+
+// List lists the instances that carry all of the labels.
+func (p *kubevirtProvider) List(zone string, selector map[string]string) ([]*provider.Instance, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	raw, err := p.instances.List(meta.ListOptions{LabelSelector: labels.SelectorFromSet(selector).String()})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	list, ok := raw.(*unstructured.UnstructuredList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected list type %T", raw)
+	}
+	var instances []*provider.Instance
+	for i := range list.Items {
+		instances = append(instances, instanceFrom(zone, &list.Items[i]))
+	}
+	return instances, nil
+}
+
+// HostKeys returns the host keys the provider gave the instance.
+func (p *kubevirtProvider) HostKeys(zone, name string) ([]ssh.PublicKey, error) {
+	if err := p.checkZone(zone); err != nil {
+		return nil, err
+	}
+	vmi, err := p.instances.Get(name, meta.GetOptions{})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(vmi.GetAnnotations()[annotationHostKeys], "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse host key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// storeUserData creates the Secret holding the user data of the instance,
+// replacing one left behind by an earlier instance of the same name that
+// has not been collected yet.
+func (p *kubevirtProvider) storeUserData(vmi *unstructured.Unstructured, userData []byte) error {
+	secret := &coreapi.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            userDataSecret(vmi.GetName()),
+			Labels:          vmi.GetLabels(),
+			OwnerReferences: []meta.OwnerReference{*meta.NewControllerRef(vmi, schema.FromAPIVersionAndKind(vmi.GetAPIVersion(), vmi.GetKind()))},
+		},
+		Data: map[string][]byte{userDataKey: userData},
+	}
+	_, err := p.secrets.Create(secret)
+	if kerrors.IsAlreadyExists(err) {
+		existing, getErr := p.secrets.Get(secret.Name, meta.GetOptions{})
+		if getErr != nil {
+			return fmt.Errorf("could not get existing user data Secret: %v", getErr)
+		}
+		existing.Labels = secret.Labels
+		existing.OwnerReferences = secret.OwnerReferences
+		existing.Data = secret.Data
+		_, err = p.secrets.Update(existing)
+	}
+	if err != nil {
+		return fmt.Errorf("could not store user data: %v", err)
+	}
+	return nil
+}
+
+// userDataSecret names the Secret holding the user data of the instance.
+func userDataSecret(name string) string {
+	return name + "-user-data"
+}
+
+// uidOf returns a pointer to the UID of the object, for preconditions.
+func uidOf(object meta.Object) *types.UID {
+	uid := object.GetUID()
+	return &uid
+}
+
+// machineTypeFor determines the resources of an instance of the machine
+// type, falling back to those of the standard GCE machine type of the
+// same name.
+func (p *kubevirtProvider) machineTypeFor(name string) (MachineType, error) {
+	if machineType, ok := p.config.MachineTypes[name]; ok {
+		return machineType, nil
+	}
+	var cpus int
+	if _, err := fmt.Sscanf(name, "n1-standard-%d", &cpus); err == nil && cpus > 0 {
+		return MachineType{CPUs: cpus, Memory: fmt.Sprintf("%dMi", cpus*3840)}, nil
+	}
+	return MachineType{}, fmt.Errorf("machine type %q is not supported", name)
+}
+
+// checkZone ensures that the zone is the one the provider manages.
+func (p *kubevirtProvider) checkZone(zone string) error {
+	if zone != p.config.Zone {
+		return fmt.Errorf("zone %q is not supported", zone)
+	}
+	return nil
+}
+
+// translateError maps errors from the API server to those of the
+// provider contract.
+func translateError(err error) error {
+	switch {
+	case kerrors.IsNotFound(err):
+		return provider.ErrNotFound
+	case kerrors.IsAlreadyExists(err):
+		return provider.ErrAlreadyExists
+	}
+	return err
+}
+
+// operationFor identifies a change to the instance. Changes are polled
+// for by looking at the instance, so the operation is named after it.
+func operationFor(zone, name, operationType string) *provider.Operation {
+	return &provider.Operation{
+		Name: fmt.Sprintf("%s/%s", operationType, name),
+		Zone: zone,
+		Type: operationType,
+	}
+}
+
+// nameOf determines the name of the instance the operation changes.
+func nameOf(op *provider.Operation) string {
+	return op.Name[strings.Index(op.Name, "/")+1:]
+}
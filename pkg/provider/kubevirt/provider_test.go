@@ -0,0 +1,346 @@
+package kubevirt
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	coreapi "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	clientgotesting "k8s.io/client-go/testing"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	namespace = "ci-vms"
+	publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILyxEa9JZiX0xiJFKnergptOnVslKGOwFvZLDzgddBuI"
+)
+
+var groupVersion = schema.GroupVersion{Group: "kubevirt.io", Version: "v1"}
+
+// newFakeProvider returns a provider against fake clients. The dynamic
+// client keeps instances in a tracker and, as the API server does, gives
+// them a UID and applies merge patches to them.
+func newFakeProvider(t *testing.T) (*kubevirtProvider, *clientgotesting.Fake, *fake.Clientset) {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypeWithName(groupVersion.WithKind("VirtualMachineInstance"), &unstructured.Unstructured{})
+	scheme.AddKnownTypeWithName(groupVersion.WithKind("VirtualMachineInstanceList"), &unstructured.UnstructuredList{})
+	tracker := clientgotesting.NewObjectTracker(scheme, unstructured.UnstructuredJSONScheme)
+
+	dynamicClient := &dynamicfake.FakeClient{GroupVersion: groupVersion, Fake: &clientgotesting.Fake{}}
+	created := 0
+	dynamicClient.AddReactor("create", "*", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		created++
+		object := action.(clientgotesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		object.SetUID(types.UID(fmt.Sprintf("uid-%d", created)))
+		return false, nil, nil
+	})
+	dynamicClient.AddReactor("patch", "*", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clientgotesting.PatchAction)
+		existing, err := tracker.Get(patch.GetResource(), patch.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		object := existing.(*unstructured.Unstructured)
+		changes := map[string]interface{}{}
+		if err := json.Unmarshal(patch.GetPatch(), &changes); err != nil {
+			return true, nil, err
+		}
+		mergePatch(object.Object, changes)
+		if err := tracker.Update(patch.GetResource(), object, patch.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, object, nil
+	})
+	dynamicClient.AddReactor("*", "*", clientgotesting.ObjectReaction(tracker))
+
+	kubeClient := fake.NewSimpleClientset()
+	p := New(Config{
+		Namespace: namespace,
+		Images: map[string]string{
+			"centos-7": "quay.io/containerdisks/centos:7",
+		},
+	}, dynamicClient, kubeClient).(*kubevirtProvider)
+	return p, dynamicClient.Fake, kubeClient
+}
+
+// mergePatch applies a JSON merge patch to the object.
+func mergePatch(object, patch map[string]interface{}) {
+	for key, value := range patch {
+		nested, isMap := value.(map[string]interface{})
+		existing, wasMap := object[key].(map[string]interface{})
+		switch {
+		case value == nil:
+			delete(object, key)
+		case isMap && wasMap:
+			mergePatch(existing, nested)
+		default:
+			object[key] = value
+		}
+	}
+}
+
+func instanceSpec() *provider.InstanceSpec {
+	return &provider.InstanceSpec{
+		Name:          "vm",
+		Zone:          "kubevirt",
+		Labels:        map[string]string{"ci-vm-uid": "uid"},
+		User:          "cloud-user",
+		PublicKey:     publicKey + " cloud-user@operator\n",
+		StartupScript: "#!/bin/sh\necho hello\n",
+		Spec: vmapi.VirtualMachineSpec{
+			MachineType: vmapi.VirtualMachineTypeStandard2,
+			BootDisk:    vmapi.VirtualMachineBootDiskSpec{ImageFamily: "centos-7"},
+		},
+	}
+}
+
+// run moves the instance to the phase, giving it the address.
+func run(t *testing.T, p *kubevirtProvider, phase, address string) {
+	vmi, err := p.instances.Get("vm", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get instance: %v", err)
+	}
+	unstructured.SetNestedField(vmi.Object, phase, "status", "phase")
+	if address != "" {
+		unstructured.SetNestedSlice(vmi.Object, []interface{}{map[string]interface{}{"ipAddress": address + "/32"}}, "status", "interfaces")
+	}
+	if _, err := p.instances.Update(vmi); err != nil {
+		t.Fatalf("could not update instance: %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	p, _, kubeClient := newFakeProvider(t)
+	op, err := p.Create(instanceSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vmi, err := p.instances.Get("vm", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get instance: %v", err)
+	}
+	raw, err := vmi.MarshalJSON()
+	if err != nil {
+		t.Fatalf("could not encode instance: %v", err)
+	}
+	if strings.Contains(string(raw), "PRIVATE KEY") || strings.Contains(string(raw), "userData\"") {
+		t.Errorf("expected no user data in the instance, got %s", raw)
+	}
+	volumes, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "volumes")
+	secretName, _, _ := unstructured.NestedString(volumes[1].(map[string]interface{}), "cloudInitNoCloud", "userDataSecretRef", "name")
+	if secretName != "vm-user-data" {
+		t.Errorf("expected the instance to refer to its user data Secret, got %q", secretName)
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get("vm-user-data", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get user data Secret: %v", err)
+	}
+	userData := string(secret.Data[userDataKey])
+	if !strings.Contains(userData, "PRIVATE KEY") || !strings.Contains(userData, publicKey) {
+		t.Errorf("expected the Secret to hold the user data, got %q", userData)
+	}
+	expectedOwners := []meta.OwnerReference{{
+		APIVersion:         "kubevirt.io/v1",
+		Kind:               "VirtualMachineInstance",
+		Name:               "vm",
+		UID:                vmi.GetUID(),
+		Controller:         boolPtr(true),
+		BlockOwnerDeletion: boolPtr(true),
+	}}
+	if !reflect.DeepEqual(expectedOwners, secret.OwnerReferences) {
+		t.Errorf("expected owner references %v, got %v", expectedOwners, secret.OwnerReferences)
+	}
+
+	if status, err := p.Poll(op); err != nil || status.Done {
+		t.Errorf("expected the operation to be pending, got %#v, %v", status, err)
+	}
+	run(t, p, phaseRunning, "")
+	if status, err := p.Poll(op); err != nil || status.Done {
+		t.Errorf("expected the operation to wait for an address, got %#v, %v", status, err)
+	}
+	run(t, p, phaseRunning, "10.128.0.5")
+	if status, err := p.Poll(op); err != nil || !status.Done || status.Error != nil {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+
+	instance, err := p.Get("kubevirt", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance.InternalIP != "10.128.0.5" || instance.Image != "quay.io/containerdisks/centos:7" || instance.MachineType != string(vmapi.VirtualMachineTypeStandard2) {
+		t.Errorf("unexpected instance: %#v", instance)
+	}
+	if !reflect.DeepEqual([]string{publicKey}, instance.AuthorizedKeys) {
+		t.Errorf("expected authorized keys %v, got %v", []string{publicKey}, instance.AuthorizedKeys)
+	}
+	hostKeys, err := p.HostKeys("kubevirt", "vm")
+	if err != nil || len(hostKeys) != 1 {
+		t.Errorf("expected a host key, got %v, %v", hostKeys, err)
+	}
+
+	if _, err := p.Create(instanceSpec()); err != provider.ErrAlreadyExists {
+		t.Errorf("expected %v creating the instance again, got %v", provider.ErrAlreadyExists, err)
+	}
+	if secret, err := kubeClient.CoreV1().Secrets(namespace).Get("vm-user-data", meta.GetOptions{}); err != nil || string(secret.Data[userDataKey]) != userData {
+		t.Errorf("expected the user data of the existing instance to be kept, got %v", err)
+	}
+}
+
+func TestCreateReplacesStaleSecret(t *testing.T) {
+	p, _, kubeClient := newFakeProvider(t)
+	if _, err := kubeClient.CoreV1().Secrets(namespace).Create(&coreapi.Secret{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            "vm-user-data",
+			OwnerReferences: []meta.OwnerReference{{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachineInstance", Name: "vm", UID: "stale"}},
+		},
+		Data: map[string][]byte{userDataKey: []byte("stale")},
+	}); err != nil {
+		t.Fatalf("could not create Secret: %v", err)
+	}
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret, err := kubeClient.CoreV1().Secrets(namespace).Get("vm-user-data", meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("could not get user data Secret: %v", err)
+	}
+	if string(secret.Data[userDataKey]) == "stale" || len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID == "stale" {
+		t.Errorf("expected the stale Secret to be replaced, got %#v", secret)
+	}
+}
+
+func TestCreateDeletesInstanceWithoutUserData(t *testing.T) {
+	p, _, kubeClient := newFakeProvider(t)
+	kubeClient.PrependReactor("create", "secrets", func(action clientgotesting.Action) (bool, runtime.Object, error) {
+		return true, nil, kerrors.NewForbidden(coreapi.Resource("secrets"), "vm-user-data", fmt.Errorf("denied"))
+	})
+	if _, err := p.Create(instanceSpec()); err == nil {
+		t.Fatal("expected an error, got none")
+	}
+	if _, err := p.instances.Get("vm", meta.GetOptions{}); !kerrors.IsNotFound(err) {
+		t.Errorf("expected the instance to be deleted, got %v", err)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		mutate func(spec *provider.InstanceSpec)
+	}{
+		{
+			name:   "unknown zone",
+			mutate: func(spec *provider.InstanceSpec) { spec.Zone = "us-east1-b" },
+		},
+		{
+			name:   "unknown image family",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.BootDisk.ImageFamily = "rhel-7" },
+		},
+		{
+			name:   "unknown machine type",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.MachineType = "n1-highmem-2" },
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p, fake, _ := newFakeProvider(t)
+			spec := instanceSpec()
+			testCase.mutate(spec)
+			if _, err := p.Create(spec); err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if actions := fake.Actions(); len(actions) != 0 {
+				t.Errorf("expected no requests, got %v", actions)
+			}
+		})
+	}
+}
+
+func TestPollStoppedInstance(t *testing.T) {
+	p, _, _ := newFakeProvider(t)
+	op, err := p.Create(instanceSpec())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	run(t, p, phaseFailed, "")
+	if status, err := p.Poll(op); err != nil || !status.Done || status.Error == nil {
+		t.Errorf("expected the operation to fail, got %#v, %v", status, err)
+	}
+	if instance, err := p.Get("kubevirt", "vm"); err != nil || !instance.Terminated {
+		t.Errorf("expected the instance to be terminated, got %#v, %v", instance, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p, _, _ := newFakeProvider(t)
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	op, err := p.Delete("kubevirt", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if status, err := p.Poll(op); err != nil || !status.Done {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+	if _, err := p.Get("kubevirt", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v after deletion, got %v", provider.ErrNotFound, err)
+	}
+	if _, err := p.Delete("kubevirt", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v deleting again, got %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestListAndSetLabels(t *testing.T) {
+	p, _, _ := newFakeProvider(t)
+	for _, name := range []string{"first", "second"} {
+		spec := instanceSpec()
+		spec.Name = name
+		if _, err := p.Create(spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := p.SetLabels("kubevirt", "second", map[string]string{"ci-vm-namespace": "ci"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	instances, err := p.List("kubevirt", map[string]string{"ci-vm-namespace": "ci"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].Name != "second" {
+		t.Fatalf("expected only the relabeled instance, got %#v", instances)
+	}
+	expected := map[string]string{"ci-vm-uid": "uid", "ci-vm-namespace": "ci"}
+	if !reflect.DeepEqual(expected, instances[0].Labels) {
+		t.Errorf("expected labels %v, got %v", expected, instances[0].Labels)
+	}
+	if instances, err := p.List("kubevirt", map[string]string{"ci-vm-uid": "uid"}); err != nil || len(instances) != 2 {
+		t.Errorf("expected both instances, got %#v, %v", instances, err)
+	}
+}
+
+func TestSetSSHKeyIsUnsupported(t *testing.T) {
+	p, _, _ := newFakeProvider(t)
+	if _, err := p.SetSSHKey(instanceSpec()); err != provider.ErrUnsupported {
+		t.Errorf("expected %v, got %v", provider.ErrUnsupported, err)
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
@@ -0,0 +1,126 @@
+package kubevirt
+
+import (
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// virtualMachineInstanceFor builds the VirtualMachineInstance for the
+// spec. It boots from the container disk, reads its user data from the
+// Secret and is connected to the pod network, on which the operator
+// reaches it.
+func virtualMachineInstanceFor(apiVersion string, spec *provider.InstanceSpec, image string, machineType MachineType, userDataSecret string) *unstructured.Unstructured {
+	labels := map[string]interface{}{}
+	for key, value := range spec.Labels {
+		labels[key] = value
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "VirtualMachineInstance",
+		"metadata": map[string]interface{}{
+			"name":   spec.Name,
+			"labels": labels,
+		},
+		"spec": map[string]interface{}{
+			"domain": map[string]interface{}{
+				"cpu": map[string]interface{}{
+					"cores": int64(machineType.CPUs),
+				},
+				"resources": map[string]interface{}{
+					"requests": map[string]interface{}{
+						"memory": machineType.Memory,
+					},
+				},
+				"devices": map[string]interface{}{
+					"disks": []interface{}{
+						map[string]interface{}{"name": "boot", "disk": map[string]interface{}{"bus": "virtio"}},
+						map[string]interface{}{"name": "cloudinit", "disk": map[string]interface{}{"bus": "virtio"}},
+					},
+					"interfaces": []interface{}{
+						map[string]interface{}{"name": "default", "masquerade": map[string]interface{}{}},
+					},
+				},
+			},
+			"networks": []interface{}{
+				map[string]interface{}{"name": "default", "pod": map[string]interface{}{}},
+			},
+			"volumes": []interface{}{
+				map[string]interface{}{"name": "boot", "containerDisk": map[string]interface{}{"image": image}},
+				map[string]interface{}{"name": "cloudinit", "cloudInitNoCloud": map[string]interface{}{
+					"userDataSecretRef": map[string]interface{}{"name": userDataSecret},
+				}},
+			},
+		},
+	}}
+}
+
+// instanceFrom describes the VirtualMachineInstance in the terms of the
+// provider contract. Instances are only stopped when their guest shuts
+// down or fails, so a stopped instance is reported as terminated. The
+// address on the pod network is both the internal and the external one,
+// as consumers in the cluster reach the instance on it.
+func instanceFrom(zone string, vmi *unstructured.Unstructured) *provider.Instance {
+	annotations := vmi.GetAnnotations()
+	phase, _, _ := unstructured.NestedString(vmi.Object, "status", "phase")
+	address := addressOf(vmi)
+	instance := &provider.Instance{
+		Name:        vmi.GetName(),
+		Zone:        zone,
+		ID:          string(vmi.GetUID()),
+		SelfLink:    vmi.GetSelfLink(),
+		MachineType: annotations[annotationMachineType],
+		Image:       imageOf(vmi),
+		InternalIP:  address,
+		ExternalIP:  address,
+		Created:     vmi.GetCreationTimestamp().Time,
+		Labels:      vmi.GetLabels(),
+		Terminated:  phase == phaseFailed || phase == phaseSucceeded,
+	}
+	for _, key := range strings.Split(annotations[annotationAuthorizedKeys], "\n") {
+		if key != "" {
+			instance.AuthorizedKeys = append(instance.AuthorizedKeys, key)
+		}
+	}
+	return instance
+}
+
+// addressOf determines the address of the first interface of the
+// instance, if it has one yet.
+func addressOf(vmi *unstructured.Unstructured) string {
+	interfaces, _, _ := unstructured.NestedSlice(vmi.Object, "status", "interfaces")
+	for _, raw := range interfaces {
+		if iface, ok := raw.(map[string]interface{}); ok {
+			if address, ok := iface["ipAddress"].(string); ok && address != "" {
+				return strings.SplitN(address, "/", 2)[0]
+			}
+		}
+	}
+	return ""
+}
+
+// imageOf determines the container disk the instance boots from.
+func imageOf(vmi *unstructured.Unstructured) string {
+	volumes, _, _ := unstructured.NestedSlice(vmi.Object, "spec", "volumes")
+	for _, raw := range volumes {
+		if volume, ok := raw.(map[string]interface{}); ok {
+			if image, _, _ := unstructured.NestedString(volume, "containerDisk", "image"); image != "" {
+				return image
+			}
+		}
+	}
+	return ""
+}
+
+// normalizeKey drops the comment of an authorized key.
+func normalizeKey(authorizedKey string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return strings.TrimSpace(authorizedKey)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
@@ -0,0 +1,241 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// metadataNamespace qualifies the metadata the provider keeps
+	// in the definition of each domain
+	metadataNamespace = "https://github.com/openshift/ci-vm-operator"
+	metadataKey       = "ci"
+)
+
+// domainSpec holds the parameters of a domain definition.
+type domainSpec struct {
+	Type      string
+	Name      string
+	CPUs      int
+	MemoryMiB int
+	BootPath  string
+	SeedPath  string
+	DiskPaths []string
+	Network   string
+}
+
+// maxDisks is how many additional disks a domain may have, as
+// they are attached as vdb through vdz.
+const maxDisks = 25
+
+var domainTemplate = template.Must(template.New("domain").Funcs(template.FuncMap{"escape": escape, "diskTarget": diskTarget}).Parse(`<domain type='{{ escape .Type }}'>
+  <name>{{ escape .Name }}</name>
+  <memory unit='MiB'>{{ .MemoryMiB }}</memory>
+  <vcpu>{{ .CPUs }}</vcpu>
+  <os>
+    <type arch='x86_64'>hvm</type>
+    <boot dev='hd'/>
+  </os>
+  <features>
+    <acpi/>
+    <apic/>
+  </features>
+  <devices>
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='{{ escape .BootPath }}'/>
+      <target dev='vda' bus='virtio'/>
+    </disk>
+{{- range $index, $path := .DiskPaths }}
+    <disk type='file' device='disk'>
+      <driver name='qemu' type='qcow2'/>
+      <source file='{{ escape $path }}'/>
+      <target dev='{{ diskTarget $index }}' bus='virtio'/>
+    </disk>
+{{- end }}
+    <disk type='file' device='cdrom'>
+      <driver name='qemu' type='raw'/>
+      <source file='{{ escape .SeedPath }}'/>
+      <target dev='sda' bus='sata'/>
+      <readonly/>
+    </disk>
+    <interface type='network'>
+      <source network='{{ escape .Network }}'/>
+      <model type='virtio'/>
+    </interface>
+    <serial type='pty'/>
+    <console type='pty'/>
+  </devices>
+</domain>
+`))
+
+// domainXML renders the definition of the domain.
+func domainXML(spec *domainSpec) ([]byte, error) {
+	definition := bytes.Buffer{}
+	if err := domainTemplate.Execute(&definition, spec); err != nil {
+		return nil, fmt.Errorf("could not render domain: %v", err)
+	}
+	return definition.Bytes(), nil
+}
+
+// diskTarget names the device of an additional disk, which follow
+// the boot disk.
+func diskTarget(index int) string {
+	return fmt.Sprintf("vd%c", 'b'+index)
+}
+
+func escape(value string) string {
+	escaped := bytes.Buffer{}
+	xml.EscapeText(&escaped, []byte(value))
+	return escaped.String()
+}
+
+// domain holds the fields of a domain definition that the provider uses.
+type domain struct {
+	Name     string `xml:"name"`
+	UUID     string `xml:"uuid"`
+	Metadata struct {
+		Instance *instanceMetadata `xml:"https://github.com/openshift/ci-vm-operator instance"`
+	} `xml:"metadata"`
+}
+
+// metadata returns the metadata of the domain, which is empty for
+// domains the provider did not create.
+func (d *domain) metadata() *instanceMetadata {
+	if d.Metadata.Instance == nil {
+		return &instanceMetadata{}
+	}
+	return d.Metadata.Instance
+}
+
+// instanceMetadata records what the provider knows about the domain
+// that libvirt does not.
+type instanceMetadata struct {
+	XMLName        xml.Name `xml:"instance"`
+	Created        string   `xml:"created,omitempty"`
+	MachineType    string   `xml:"machineType,omitempty"`
+	Image          string   `xml:"image,omitempty"`
+	Labels         []label  `xml:"label"`
+	AuthorizedKeys []string `xml:"authorizedKey"`
+	HostKeys       []string `xml:"hostKey"`
+}
+
+type label struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (m *instanceMetadata) labels() map[string]string {
+	labels := map[string]string{}
+	for _, label := range m.Labels {
+		labels[label.Key] = label.Value
+	}
+	return labels
+}
+
+// labelsFrom orders the labels by key, so that the metadata of a domain
+// does not change unless its labels do.
+func labelsFrom(labels map[string]string) []label {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var ordered []label
+	for _, key := range keys {
+		ordered = append(ordered, label{Key: key, Value: labels[key]})
+	}
+	return ordered
+}
+
+// hasLabels determines if the labels include all of the selector.
+func hasLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// domain looks up the persistent definition of the domain.
+func (p *libvirtProvider) domain(host *Host, name string) (*domain, error) {
+	output, err := p.virsh(host, "dumpxml", "--inactive", name)
+	if err != nil {
+		return nil, err
+	}
+	parsed := &domain{}
+	if err := xml.Unmarshal([]byte(output), parsed); err != nil {
+		return nil, fmt.Errorf("could not parse domain: %v", err)
+	}
+	return parsed, nil
+}
+
+// setMetadata replaces the metadata in the persistent definition of the
+// domain.
+func (p *libvirtProvider) setMetadata(host *Host, name string, metadata *instanceMetadata) error {
+	raw, err := xml.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("could not render metadata: %v", err)
+	}
+	if _, err := p.virsh(host, "metadata", name, "--uri", metadataNamespace, "--key", metadataKey, "--set", string(raw), "--config"); err != nil {
+		return fmt.Errorf("could not set metadata: %v", err)
+	}
+	return nil
+}
+
+// addressOf reads the first IPv4 address of the domain, if it has
+// one yet.
+func (p *libvirtProvider) addressOf(host *Host, name string) (string, error) {
+	output, err := p.virsh(host, "domifaddr", name, "--source", p.config.AddressSource)
+	if err != nil {
+		return "", fmt.Errorf("could not determine address: %v", err)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 4 && fields[2] == "ipv4" {
+			return strings.SplitN(fields[3], "/", 2)[0], nil
+		}
+	}
+	return "", nil
+}
+
+// instanceFrom describes the domain in the terms of the provider
+// contract. Domains are stopped by libvirt only when they crash or shut
+// themselves down, so a domain that is not running is reported as
+// terminated.
+func instanceFrom(host *Host, domain *domain, state string) *provider.Instance {
+	metadata := domain.metadata()
+	instance := &provider.Instance{
+		Name:           domain.Name,
+		Zone:           host.Zone,
+		ID:             domain.UUID,
+		MachineType:    metadata.MachineType,
+		Image:          metadata.Image,
+		Labels:         metadata.labels(),
+		Terminated:     state == "shut off" || state == "crashed",
+		AuthorizedKeys: metadata.AuthorizedKeys,
+	}
+	if created, err := time.Parse(time.RFC3339, metadata.Created); err == nil {
+		instance.Created = created
+	}
+	return instance
+}
+
+// normalizeKey drops the comment of an authorized key.
+func normalizeKey(authorizedKey string) string {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return strings.TrimSpace(authorizedKey)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
@@ -0,0 +1,158 @@
+package libvirt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// isoSectorSize is the size of the logical blocks of the image.
+const isoSectorSize = 2048
+
+// isoFile is a file in the root directory of an image.
+type isoFile struct {
+	name     string
+	contents []byte
+}
+
+// isoImage writes a minimal ISO 9660 image holding the files in its root
+// directory, as cloud-init reads a NoCloud seed from. The names of the
+// files are recorded verbatim, which Linux reads them back as.
+//
+// The image is laid out as the system area, the primary volume
+// descriptor, the terminator, the little and big endian path tables,
+// the root directory and then the contents of the files.
+func isoImage(volumeID string, files []isoFile) ([]byte, error) {
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	const (
+		descriptorSector = 16
+		terminatorSector = 17
+		lPathSector      = 18
+		mPathSector      = 19
+		rootSector       = 20
+		firstFileSector  = 21
+	)
+
+	totalSectors := firstFileSector
+	extents := make([]int, len(files))
+	for i, file := range files {
+		if len(file.name) > 30 {
+			return nil, fmt.Errorf("file name %q is too long", file.name)
+		}
+		extents[i] = totalSectors
+		totalSectors += sectorsFor(len(file.contents))
+	}
+
+	// the root directory holds itself and its parent, which
+	// for the root is itself again, followed by the files
+	records := [][]byte{
+		directoryRecord([]byte{0}, rootSector, isoSectorSize, true),
+		directoryRecord([]byte{1}, rootSector, isoSectorSize, true),
+	}
+	size := 2 * len(records[0])
+	for i, file := range files {
+		record := directoryRecord([]byte(file.name), extents[i], len(file.contents), false)
+		records = append(records, record)
+		size += len(record)
+	}
+	if size > isoSectorSize {
+		return nil, fmt.Errorf("too many files for the root directory")
+	}
+
+	image := make([]byte, totalSectors*isoSectorSize)
+
+	descriptor := image[descriptorSector*isoSectorSize:]
+	descriptor[0] = 1
+	copy(descriptor[1:6], "CD001")
+	descriptor[6] = 1
+	copy(descriptor[8:40], padded("", 32))
+	copy(descriptor[40:72], padded(strings.ToUpper(volumeID), 32))
+	putBothEndian32(descriptor[80:88], uint32(totalSectors))
+	putBothEndian16(descriptor[120:124], 1)
+	putBothEndian16(descriptor[124:128], 1)
+	putBothEndian16(descriptor[128:132], isoSectorSize)
+	pathTable := pathTableRecord(rootSector, binary.LittleEndian)
+	putBothEndian32(descriptor[132:140], uint32(len(pathTable)))
+	binary.LittleEndian.PutUint32(descriptor[140:144], lPathSector)
+	binary.BigEndian.PutUint32(descriptor[148:152], mPathSector)
+	copy(descriptor[156:190], records[0])
+	copy(descriptor[190:813], padded("", 623))
+	for _, offset := range []int{813, 830, 847, 864} {
+		// dates are unspecified
+		copy(descriptor[offset:offset+16], strings.Repeat("0", 16))
+	}
+	descriptor[881] = 1
+
+	terminator := image[terminatorSector*isoSectorSize:]
+	terminator[0] = 255
+	copy(terminator[1:6], "CD001")
+	terminator[6] = 1
+
+	copy(image[lPathSector*isoSectorSize:], pathTable)
+	copy(image[mPathSector*isoSectorSize:], pathTableRecord(rootSector, binary.BigEndian))
+
+	offset := rootSector * isoSectorSize
+	for _, record := range records {
+		copy(image[offset:], record)
+		offset += len(record)
+	}
+
+	for i, file := range files {
+		copy(image[extents[i]*isoSectorSize:], file.contents)
+	}
+	return image, nil
+}
+
+// directoryRecord describes a file or directory in its parent directory.
+func directoryRecord(name []byte, extent, size int, directory bool) []byte {
+	length := 33 + len(name)
+	if length%2 != 0 {
+		length++
+	}
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothEndian32(record[2:10], uint32(extent))
+	putBothEndian32(record[10:18], uint32(size))
+	// the recording date is left at the epoch of the format
+	if directory {
+		record[25] = 2
+	}
+	putBothEndian16(record[28:32], 1)
+	record[32] = byte(len(name))
+	copy(record[33:], name)
+	return record
+}
+
+// pathTableRecord describes the root directory, the only directory of
+// the image, in a path table.
+func pathTableRecord(extent int, order binary.ByteOrder) []byte {
+	record := make([]byte, 10)
+	record[0] = 1
+	order.PutUint32(record[2:6], uint32(extent))
+	order.PutUint16(record[6:8], 1)
+	return record
+}
+
+func sectorsFor(size int) int {
+	sectors := (size + isoSectorSize - 1) / isoSectorSize
+	if sectors == 0 {
+		return 1
+	}
+	return sectors
+}
+
+func padded(value string, length int) string {
+	return value + strings.Repeat(" ", length-len(value))
+}
+
+func putBothEndian16(b []byte, value uint16) {
+	binary.LittleEndian.PutUint16(b[0:2], value)
+	binary.BigEndian.PutUint16(b[2:4], value)
+}
+
+func putBothEndian32(b []byte, value uint32) {
+	binary.LittleEndian.PutUint32(b[0:4], value)
+	binary.BigEndian.PutUint32(b[4:8], value)
+}
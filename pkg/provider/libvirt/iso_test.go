@@ -0,0 +1,109 @@
+package libvirt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readISO reads the files in the root directory of the image back the
+// way a reader of ISO 9660 does, checking the layout as it goes.
+func readISO(t *testing.T, image []byte) (string, map[string][]byte) {
+	if len(image)%isoSectorSize != 0 {
+		t.Fatalf("image of %d bytes is not made up of whole sectors", len(image))
+	}
+	sector := func(index int) []byte {
+		if (index+1)*isoSectorSize > len(image) {
+			t.Fatalf("sector %d is beyond the end of the image", index)
+		}
+		return image[index*isoSectorSize : (index+1)*isoSectorSize]
+	}
+	bothEndian32 := func(b []byte) int {
+		little, big := binary.LittleEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8])
+		if little != big {
+			t.Fatalf("both-endian field holds %d and %d", little, big)
+		}
+		return int(little)
+	}
+
+	descriptor := sector(16)
+	if descriptor[0] != 1 || string(descriptor[1:6]) != "CD001" || descriptor[6] != 1 {
+		t.Fatalf("sector 16 is not a primary volume descriptor: %q", descriptor[:7])
+	}
+	if terminator := sector(17); terminator[0] != 255 || string(terminator[1:6]) != "CD001" {
+		t.Fatalf("sector 17 is not a descriptor set terminator: %q", terminator[:7])
+	}
+	if volumeSize := bothEndian32(descriptor[80:88]); volumeSize*isoSectorSize != len(image) {
+		t.Errorf("volume size of %d sectors does not match image of %d bytes", volumeSize, len(image))
+	}
+	if blockSize := binary.LittleEndian.Uint16(descriptor[128:130]); blockSize != isoSectorSize {
+		t.Errorf("expected logical block size %d, got %d", isoSectorSize, blockSize)
+	}
+	volumeID := strings.TrimRight(string(descriptor[40:72]), " ")
+
+	rootRecord := descriptor[156:190]
+	rootExtent, rootSize := bothEndian32(rootRecord[2:10]), bothEndian32(rootRecord[10:18])
+	if rootRecord[25]&2 == 0 {
+		t.Error("root directory record is not flagged as a directory")
+	}
+	if lPath := sector(int(binary.LittleEndian.Uint32(descriptor[140:144]))); int(binary.LittleEndian.Uint32(lPath[2:6])) != rootExtent {
+		t.Errorf("little endian path table does not point at the root directory")
+	}
+	if mPath := sector(int(binary.BigEndian.Uint32(descriptor[148:152]))); int(binary.BigEndian.Uint32(mPath[2:6])) != rootExtent {
+		t.Errorf("big endian path table does not point at the root directory")
+	}
+
+	files := map[string][]byte{}
+	directory := image[rootExtent*isoSectorSize : rootExtent*isoSectorSize+rootSize]
+	for offset, index := 0, 0; offset < len(directory) && directory[offset] != 0; index++ {
+		record := directory[offset : offset+int(directory[offset])]
+		offset += len(record)
+		name := record[33 : 33+int(record[32])]
+		extent, size := bothEndian32(record[2:10]), bothEndian32(record[10:18])
+		switch index {
+		case 0, 1:
+			// the directory itself and its parent come first
+			if !bytes.Equal(name, []byte{byte(index)}) || extent != rootExtent || record[25]&2 == 0 {
+				t.Errorf("record %d does not describe the root directory: %q at %d", index, name, extent)
+			}
+			continue
+		}
+		if record[25]&2 != 0 {
+			t.Errorf("file %q is flagged as a directory", name)
+		}
+		files[string(name)] = image[extent*isoSectorSize : extent*isoSectorSize+size]
+	}
+	return volumeID, files
+}
+
+func TestISOImage(t *testing.T) {
+	files := map[string][]byte{
+		"user-data": []byte("#cloud-config\n" + strings.Repeat("a", 3*isoSectorSize+1)),
+		"meta-data": []byte("instance-id: vm\n"),
+		"empty":     {},
+	}
+	var input []isoFile
+	for name, contents := range files {
+		input = append(input, isoFile{name: name, contents: contents})
+	}
+
+	image, err := isoImage("cidata", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	volumeID, read := readISO(t, image)
+	if volumeID != "CIDATA" {
+		t.Errorf("expected volume ID CIDATA, got %q", volumeID)
+	}
+	if !reflect.DeepEqual(files, read) {
+		t.Errorf("expected files %q, got %q", files, read)
+	}
+}
+
+func TestISOImageRejectsLongNames(t *testing.T) {
+	if _, err := isoImage("cidata", []isoFile{{name: strings.Repeat("a", 31)}}); err == nil {
+		t.Error("expected an error for a long file name, got none")
+	}
+}
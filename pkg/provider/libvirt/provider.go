@@ -0,0 +1,481 @@
+// Package libvirt implements the provider contract with libvirt domains on
+// hypervisors managed with the virsh CLI. Domains boot from a copy-on-write
+// overlay of a base qcow2 image and are given their SSH key and host keys
+// by cloud-init from a NoCloud seed, so that the host keys are known
+// without reading the console of the domain.
+package libvirt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const (
+	// Name identifies the provider in the configuration
+	Name = "libvirt"
+
+	defaultZone       = "local"
+	defaultURI        = "qemu:///system"
+	defaultPool       = "default"
+	defaultNetwork    = "default"
+	defaultDomainType = "kvm"
+
+	// addresses are read from the DHCP leases of the network
+	// unless configured otherwise
+	defaultAddressSource = "lease"
+
+	// seedCapacity is the size of the seed volume, which is large
+	// enough for the largest startup script and user data so that
+	// the seed can be replaced in place
+	seedCapacity = 2 << 20
+)
+
+// Config configures the hypervisors domains are created on.
+type Config struct {
+	// Hosts are the hypervisors, each making up a zone; a single
+	// zone on the local hypervisor is used if unset
+	Hosts []Host `json:"hosts,omitempty"`
+	// Images maps the image family of the boot disk of a
+	// VirtualMachine to the path of the qcow2 image on the
+	// hypervisor that its boot disk is an overlay of
+	Images map[string]string `json:"images"`
+	// MachineTypes maps the machine type of a VirtualMachine
+	// to the resources of the domain; the resources of standard
+	// GCE machine types are used for types not listed
+	MachineTypes map[string]MachineType `json:"machineTypes,omitempty"`
+	// DomainType is the type of the domains, as in kvm or qemu
+	// on real hypervisors and test on the test driver; kvm is
+	// used if unset
+	DomainType string `json:"domainType,omitempty"`
+	// AddressSource is where domain addresses are read from, as
+	// in lease, agent or arp; lease is used if unset
+	AddressSource string `json:"addressSource,omitempty"`
+}
+
+// Host is a hypervisor that makes up a zone.
+type Host struct {
+	// Zone is the name of the zone
+	Zone string `json:"zone"`
+	// Region is the region of the zone; the zone is used
+	// if unset
+	Region string `json:"region,omitempty"`
+	// URI is the libvirt connection URI of the hypervisor
+	URI string `json:"uri"`
+	// Pool is the storage pool disks are created in
+	Pool string `json:"pool,omitempty"`
+	// Network is the network domains are attached to
+	Network string `json:"network,omitempty"`
+}
+
+// MachineType holds the resources of a domain.
+type MachineType struct {
+	CPUs      int `json:"cpus"`
+	MemoryMiB int `json:"memoryMiB"`
+}
+
+// New returns a provider that manages domains with virsh.
+func New(config Config) provider.Provider {
+	if len(config.Hosts) == 0 {
+		config.Hosts = []Host{{Zone: defaultZone, URI: defaultURI}}
+	}
+	for i := range config.Hosts {
+		host := &config.Hosts[i]
+		if host.Region == "" {
+			host.Region = host.Zone
+		}
+		if host.Pool == "" {
+			host.Pool = defaultPool
+		}
+		if host.Network == "" {
+			host.Network = defaultNetwork
+		}
+	}
+	if config.DomainType == "" {
+		config.DomainType = defaultDomainType
+	}
+	if config.AddressSource == "" {
+		config.AddressSource = defaultAddressSource
+	}
+	return &libvirtProvider{config: config, run: runCommand}
+}
+
+type libvirtProvider struct {
+	config Config
+	// run runs virsh with the arguments
+	run func(command string, args ...string) (string, error)
+}
+
+var _ provider.Provider = &libvirtProvider{}
+
+func (p *libvirtProvider) Zones() []provider.Zone {
+	var zones []provider.Zone
+	for _, host := range p.config.Hosts {
+		zones = append(zones, provider.Zone{Name: host.Zone, Region: host.Region})
+	}
+	return zones
+}
+
+// Create creates the disks of the domain and then defines and starts it.
+// virsh waits for each step to complete, so the returned operation is
+// done.
+func (p *libvirtProvider) Create(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	host, err := p.hostFor(spec.Zone)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.Get(spec.Zone, spec.Name); err != provider.ErrNotFound {
+		if err == nil {
+			return nil, provider.ErrAlreadyExists
+		}
+		return nil, err
+	}
+	image, ok := p.config.Images[spec.Spec.BootDisk.ImageFamily]
+	if !ok {
+		return nil, fmt.Errorf("no image is configured for image family %q", spec.Spec.BootDisk.ImageFamily)
+	}
+	machineType, err := p.machineTypeFor(string(spec.Spec.MachineType))
+	if err != nil {
+		return nil, err
+	}
+	if len(spec.Spec.Disks) > maxDisks {
+		return nil, fmt.Errorf("at most %d additional disks are supported", maxDisks)
+	}
+
+	// an earlier attempt may have failed after creating the disks
+	if err := p.deleteVolumes(host, spec.Name); err != nil {
+		return nil, err
+	}
+	if _, err := p.virsh(host, "vol-create-as", host.Pool, bootVolume(spec.Name), fmt.Sprintf("%dG", spec.Spec.BootDisk.SizeGB), "--format", "qcow2", "--backing-vol", image, "--backing-vol-format", "qcow2"); err != nil {
+		return nil, fmt.Errorf("could not create boot disk: %v", err)
+	}
+	bootPath, err := p.virsh(host, "vol-path", "--pool", host.Pool, bootVolume(spec.Name))
+	if err != nil {
+		return nil, fmt.Errorf("could not locate boot disk: %v", err)
+	}
+	if _, err := p.virsh(host, "vol-create-as", host.Pool, seedVolume(spec.Name), fmt.Sprintf("%d", seedCapacity), "--format", "raw"); err != nil {
+		return nil, fmt.Errorf("could not create seed disk: %v", err)
+	}
+	seedPath, err := p.virsh(host, "vol-path", "--pool", host.Pool, seedVolume(spec.Name))
+	if err != nil {
+		return nil, fmt.Errorf("could not locate seed disk: %v", err)
+	}
+	var diskPaths []string
+	for index, disk := range spec.Spec.Disks {
+		if _, err := p.virsh(host, "vol-create-as", host.Pool, diskVolume(spec.Name, index), fmt.Sprintf("%dG", disk.SizeGB), "--format", "qcow2"); err != nil {
+			return nil, fmt.Errorf("could not create disk %d: %v", index, err)
+		}
+		diskPath, err := p.virsh(host, "vol-path", "--pool", host.Pool, diskVolume(spec.Name, index))
+		if err != nil {
+			return nil, fmt.Errorf("could not locate disk %d: %v", index, err)
+		}
+		diskPaths = append(diskPaths, strings.TrimSpace(diskPath))
+	}
+	hostKey, err := p.writeSeed(host, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	definition, err := domainXML(&domainSpec{
+		Type:      p.config.DomainType,
+		Name:      spec.Name,
+		CPUs:      machineType.CPUs,
+		MemoryMiB: machineType.MemoryMiB,
+		BootPath:  strings.TrimSpace(bootPath),
+		SeedPath:  strings.TrimSpace(seedPath),
+		DiskPaths: diskPaths,
+		Network:   host.Network,
+	})
+	if err != nil {
+		return nil, err
+	}
+	file, err := writeTemp("domain", definition)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file)
+	if _, err := p.virsh(host, "define", file); err != nil {
+		return nil, fmt.Errorf("could not define domain: %v", err)
+	}
+	if err := p.setMetadata(host, spec.Name, &instanceMetadata{
+		Created:        time.Now().UTC().Format(time.RFC3339),
+		MachineType:    string(spec.Spec.MachineType),
+		Image:          image,
+		Labels:         labelsFrom(spec.Labels),
+		AuthorizedKeys: []string{normalizeKey(spec.PublicKey)},
+		HostKeys:       []string{hostKey},
+	}); err != nil {
+		// without its labels, the domain would not be
+		// recognized as ours on the next attempt
+		if _, undefineErr := p.virsh(host, "undefine", spec.Name); undefineErr != nil {
+			return nil, fmt.Errorf("%v; could not undefine domain: %v", err, undefineErr)
+		}
+		return nil, err
+	}
+	if _, err := p.virsh(host, "start", spec.Name); err != nil {
+		return nil, fmt.Errorf("could not start domain: %v", err)
+	}
+	return operationFor(spec.Zone, spec.Name, provider.OperationCreate), nil
+}
+
+func (p *libvirtProvider) Get(zone, name string) (*provider.Instance, error) {
+	host, err := p.hostFor(zone)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := p.domain(host, name)
+	if err != nil {
+		return nil, err
+	}
+	state, err := p.virsh(host, "domstate", name)
+	if err != nil {
+		return nil, err
+	}
+	instance := instanceFrom(host, domain, strings.TrimSpace(state))
+	if !instance.Terminated {
+		address, err := p.addressOf(host, name)
+		if err != nil {
+			return nil, err
+		}
+		instance.InternalIP = address
+		instance.ExternalIP = address
+	}
+	return instance, nil
+}
+
+// Delete stops and undefines the domain and deletes its disks.
+func (p *libvirtProvider) Delete(zone, name string) (*provider.Operation, error) {
+	host, err := p.hostFor(zone)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.virsh(host, "destroy", name); err != nil && !isNotRunning(err) {
+		return nil, err
+	}
+	if _, err := p.virsh(host, "undefine", name); err != nil {
+		return nil, err
+	}
+	if err := p.deleteVolumes(host, name); err != nil {
+		return nil, err
+	}
+	return operationFor(zone, name, provider.OperationDelete), nil
+}
+
+// SetSSHKey replaces the seed of the domain with one for a new instance
+// of cloud-init, which installs the key and new host keys, and reboots
+// the domain so that cloud-init picks it up.
+func (p *libvirtProvider) SetSSHKey(spec *provider.InstanceSpec) (*provider.Operation, error) {
+	host, err := p.hostFor(spec.Zone)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := p.domain(host, spec.Name)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := p.writeSeed(host, spec)
+	if err != nil {
+		return nil, err
+	}
+	metadata := domain.metadata()
+	metadata.AuthorizedKeys = []string{normalizeKey(spec.PublicKey)}
+	metadata.HostKeys = []string{hostKey}
+	if err := p.setMetadata(host, spec.Name, metadata); err != nil {
+		return nil, err
+	}
+	if _, err := p.virsh(host, "reboot", spec.Name); err != nil {
+		return nil, fmt.Errorf("could not reboot domain: %v", err)
+	}
+	return operationFor(spec.Zone, spec.Name, provider.OperationSetSSHKey), nil
+}
+
+// SetLabels adds the labels to those recorded in the metadata of the
+// domain.
+func (p *libvirtProvider) SetLabels(zone, name string, labels map[string]string) (*provider.Operation, error) {
+	host, err := p.hostFor(zone)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := p.domain(host, name)
+	if err != nil {
+		return nil, err
+	}
+	metadata := domain.metadata()
+	merged := metadata.labels()
+	for key, value := range labels {
+		merged[key] = value
+	}
+	metadata.Labels = labelsFrom(merged)
+	if err := p.setMetadata(host, name, metadata); err != nil {
+		return nil, err
+	}
+	return operationFor(zone, name, provider.OperationSetLabels), nil
+}
+
+// Poll reports every operation as done, as virsh waits for changes to
+// domains to complete.
+func (p *libvirtProvider) Poll(op *provider.Operation) (*provider.OperationStatus, error) {
+	return &provider.OperationStatus{Done: true, Message: "completed"}, nil
+}
+
+// List lists the domains on the hypervisor whose metadata carries all
+// of the labels. Addresses are not looked up.
+func (p *libvirtProvider) List(zone string, labels map[string]string) ([]*provider.Instance, error) {
+	host, err := p.hostFor(zone)
+	if err != nil {
+		return nil, err
+	}
+	output, err := p.virsh(host, "list", "--all", "--name")
+	if err != nil {
+		return nil, err
+	}
+	var instances []*provider.Instance
+	for _, name := range strings.Fields(output) {
+		domain, err := p.domain(host, name)
+		if err == provider.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !hasLabels(domain.metadata().labels(), labels) {
+			continue
+		}
+		instances = append(instances, instanceFrom(host, domain, ""))
+	}
+	return instances, nil
+}
+
+// HostKeys returns the host keys the provider seeded the domain with.
+func (p *libvirtProvider) HostKeys(zone, name string) ([]ssh.PublicKey, error) {
+	host, err := p.hostFor(zone)
+	if err != nil {
+		return nil, err
+	}
+	domain, err := p.domain(host, name)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for _, line := range domain.metadata().HostKeys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("could not parse host key: %v", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// writeSeed generates a host key for the domain and replaces the
+// contents of its seed volume, returning the public host key.
+func (p *libvirtProvider) writeSeed(host *Host, spec *provider.InstanceSpec) (string, error) {
+	seed, hostKey, err := seedFor(spec)
+	if err != nil {
+		return "", err
+	}
+	if len(seed) > seedCapacity {
+		return "", errors.New("the startup script and user data do not fit on the seed disk")
+	}
+	file, err := writeTemp("seed", seed)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file)
+	if _, err := p.virsh(host, "vol-upload", "--pool", host.Pool, seedVolume(spec.Name), file); err != nil {
+		return "", fmt.Errorf("could not upload seed disk: %v", err)
+	}
+	return hostKey, nil
+}
+
+// deleteVolumes deletes the disks of the domain, if they exist.
+// Additional disks are created in order, so they are deleted until
+// one does not exist.
+func (p *libvirtProvider) deleteVolumes(host *Host, name string) error {
+	for _, volume := range []string{bootVolume(name), seedVolume(name)} {
+		if _, err := p.virsh(host, "vol-delete", "--pool", host.Pool, volume); err != nil && err != provider.ErrNotFound {
+			return fmt.Errorf("could not delete volume %s: %v", volume, err)
+		}
+	}
+	for index := 0; index < maxDisks; index++ {
+		volume := diskVolume(name, index)
+		_, err := p.virsh(host, "vol-delete", "--pool", host.Pool, volume)
+		if err == provider.ErrNotFound {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("could not delete volume %s: %v", volume, err)
+		}
+	}
+	return nil
+}
+
+// machineTypeFor determines the resources of a domain of the machine
+// type, falling back to those of the standard GCE machine type of the
+// same name.
+func (p *libvirtProvider) machineTypeFor(name string) (MachineType, error) {
+	if machineType, ok := p.config.MachineTypes[name]; ok {
+		return machineType, nil
+	}
+	var cpus int
+	if _, err := fmt.Sscanf(name, "n1-standard-%d", &cpus); err == nil && cpus > 0 {
+		return MachineType{CPUs: cpus, MemoryMiB: cpus * 3840}, nil
+	}
+	return MachineType{}, fmt.Errorf("machine type %q is not supported", name)
+}
+
+// hostFor looks up the hypervisor that makes up the zone.
+func (p *libvirtProvider) hostFor(zone string) (*Host, error) {
+	for i := range p.config.Hosts {
+		if p.config.Hosts[i].Zone == zone {
+			return &p.config.Hosts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("zone %q is not supported", zone)
+}
+
+// bootVolume names the overlay the domain boots from.
+func bootVolume(name string) string {
+	return name + ".qcow2"
+}
+
+// diskVolume names an additional disk of the domain.
+func diskVolume(name string, index int) string {
+	return fmt.Sprintf("%s-disk-%d.qcow2", name, index)
+}
+
+// seedVolume names the NoCloud seed of the domain.
+func seedVolume(name string) string {
+	return name + "-seed.iso"
+}
+
+// writeTemp writes the contents to a temporary file for virsh to read.
+func writeTemp(prefix string, contents []byte) (string, error) {
+	file, err := ioutil.TempFile("", "ci-vm-operator-"+prefix)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(contents); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// operationFor identifies a change to the domain. virsh waits for
+// changes to complete, so the name only serves to tell them apart.
+func operationFor(zone, name, operationType string) *provider.Operation {
+	return &provider.Operation{
+		Name: fmt.Sprintf("%s-%s-%d", operationType, name, time.Now().UnixNano()),
+		Zone: zone,
+		Type: operationType,
+	}
+}
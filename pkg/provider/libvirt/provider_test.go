@@ -0,0 +1,304 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+const publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILyxEa9JZiX0xiJFKnergptOnVslKGOwFvZLDzgddBuI"
+
+func newFakeProvider(t *testing.T) (*libvirtProvider, *fakeVirsh) {
+	virsh := newFakeVirsh(t)
+	p := New(Config{
+		DomainType: "test",
+		Hosts:      []Host{{Zone: "test", URI: virsh.uri, Pool: virsh.pool}},
+		Images: map[string]string{
+			"centos-7": "/var/lib/libvirt/images/centos-7.qcow2",
+		},
+	}).(*libvirtProvider)
+	p.run = virsh.run
+	return p, virsh
+}
+
+func instanceSpec() *provider.InstanceSpec {
+	return &provider.InstanceSpec{
+		Name:          "vm",
+		Zone:          "test",
+		Labels:        map[string]string{"ci-vm-uid": "uid"},
+		User:          "cloud-user",
+		PublicKey:     publicKey + " cloud-user@operator\n",
+		StartupScript: "#!/bin/sh\necho hello\n",
+		Spec: vmapi.VirtualMachineSpec{
+			MachineType: vmapi.VirtualMachineTypeStandard2,
+			BootDisk: vmapi.VirtualMachineBootDiskSpec{
+				ImageFamily:            "centos-7",
+				VirtualMachineDiskSpec: vmapi.VirtualMachineDiskSpec{SizeGB: 20},
+			},
+			Disks: []vmapi.VirtualMachineDiskSpec{{SizeGB: 100}, {SizeGB: 200}},
+		},
+	}
+}
+
+func TestCreate(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	spec := instanceSpec()
+	op, err := p.Create(spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Type != provider.OperationCreate || op.Zone != "test" {
+		t.Errorf("unexpected operation: %#v", op)
+	}
+	if status, err := p.Poll(op); err != nil || !status.Done {
+		t.Errorf("expected the operation to be done, got %#v, %v", status, err)
+	}
+
+	var volumes []string
+	for volume := range virsh.volumes {
+		volumes = append(volumes, volume)
+	}
+	for _, volume := range []string{"vm.qcow2", "vm-seed.iso", "vm-disk-0.qcow2", "vm-disk-1.qcow2"} {
+		if _, exists := virsh.volumes[volume]; !exists {
+			t.Errorf("expected volume %s to be created, got %v", volume, volumes)
+		}
+	}
+
+	definition := struct {
+		Disks []struct {
+			Device string `xml:"device,attr"`
+			Source struct {
+				File string `xml:"file,attr"`
+			} `xml:"source"`
+			Target struct {
+				Dev string `xml:"dev,attr"`
+			} `xml:"target"`
+		} `xml:"devices>disk"`
+	}{}
+	if err := xml.Unmarshal([]byte(virsh.domains["vm"].definition), &definition); err != nil {
+		t.Fatalf("could not parse definition: %v", err)
+	}
+	var disks []string
+	for _, disk := range definition.Disks {
+		disks = append(disks, disk.Target.Dev+"="+disk.Source.File)
+	}
+	expectedDisks := []string{
+		"vda=/var/lib/libvirt/images/vm.qcow2",
+		"vdb=/var/lib/libvirt/images/vm-disk-0.qcow2",
+		"vdc=/var/lib/libvirt/images/vm-disk-1.qcow2",
+		"sda=/var/lib/libvirt/images/vm-seed.iso",
+	}
+	if !reflect.DeepEqual(expectedDisks, disks) {
+		t.Errorf("expected disks %v, got %v", expectedDisks, disks)
+	}
+
+	_, seed := readISO(t, virsh.volumes["vm-seed.iso"])
+	if !strings.Contains(string(seed["user-data"]), publicKey) {
+		t.Errorf("expected the user data on the seed to hold the SSH key, got %q", seed["user-data"])
+	}
+	if !strings.Contains(string(seed["meta-data"]), "local-hostname: vm") {
+		t.Errorf("expected the meta data on the seed to hold the hostname, got %q", seed["meta-data"])
+	}
+
+	instance, err := p.Get("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if instance.Terminated || instance.InternalIP != "192.168.122.10" || instance.MachineType != string(vmapi.VirtualMachineTypeStandard2) {
+		t.Errorf("unexpected instance: %#v", instance)
+	}
+	if !reflect.DeepEqual(spec.Labels, instance.Labels) {
+		t.Errorf("expected labels %v, got %v", spec.Labels, instance.Labels)
+	}
+	if !reflect.DeepEqual([]string{publicKey}, instance.AuthorizedKeys) {
+		t.Errorf("expected authorized keys %v, got %v", []string{publicKey}, instance.AuthorizedKeys)
+	}
+
+	hostKeys, err := p.HostKeys("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(hostKeys) != 1 || !strings.Contains(string(seed["user-data"]), strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKeys[0])))) {
+		t.Errorf("expected the host key on the seed to be reported, got %v", hostKeys)
+	}
+
+	if _, err := p.Create(spec); err != provider.ErrAlreadyExists {
+		t.Errorf("expected %v creating the domain again, got %v", provider.ErrAlreadyExists, err)
+	}
+}
+
+func TestCreateErrors(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		mutate func(spec *provider.InstanceSpec)
+	}{
+		{
+			name:   "unknown zone",
+			mutate: func(spec *provider.InstanceSpec) { spec.Zone = "us-east1-b" },
+		},
+		{
+			name:   "unknown image family",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.BootDisk.ImageFamily = "rhel-7" },
+		},
+		{
+			name:   "unknown machine type",
+			mutate: func(spec *provider.InstanceSpec) { spec.Spec.MachineType = "n1-highmem-2" },
+		},
+		{
+			name: "too many disks",
+			mutate: func(spec *provider.InstanceSpec) {
+				spec.Spec.Disks = make([]vmapi.VirtualMachineDiskSpec, maxDisks+1)
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			p, virsh := newFakeProvider(t)
+			spec := instanceSpec()
+			testCase.mutate(spec)
+			if _, err := p.Create(spec); err == nil {
+				t.Fatal("expected an error, got none")
+			}
+			if len(virsh.volumes) != 0 || len(virsh.domains) != 0 {
+				t.Errorf("expected nothing to be created, got volumes %v and domains %v", virsh.volumes, virsh.domains)
+			}
+		})
+	}
+}
+
+func TestCreateCleansUpEarlierAttempt(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	virsh.fail["define"] = "Failed to define domain\nerror: internal error: connection closed"
+	if _, err := p.Create(instanceSpec()); err == nil {
+		t.Fatal("expected an error, got none")
+	}
+	delete(virsh.fail, "define")
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("expected the disks of the earlier attempt to be replaced, got %v", err)
+	}
+}
+
+func TestGetMissingNetworkIsNotNotFound(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	virsh.fail["domifaddr"] = "Failed to query for interfaces addresses\nerror: Network not found: no network with matching name 'default'"
+	if _, err := p.Get("test", "vm"); err == nil || err == provider.ErrNotFound {
+		t.Errorf("expected the missing network to be reported, got %v", err)
+	}
+	if _, err := p.Get("test", "other"); err != provider.ErrNotFound {
+		t.Errorf("expected %v for a missing domain, got %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	op, err := p.Delete("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if op.Type != provider.OperationDelete {
+		t.Errorf("unexpected operation: %#v", op)
+	}
+	if len(virsh.volumes) != 0 || len(virsh.domains) != 0 {
+		t.Errorf("expected everything to be deleted, got volumes %v and domains %v", virsh.volumes, virsh.domains)
+	}
+	if _, err := p.Get("test", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v after deletion, got %v", provider.ErrNotFound, err)
+	}
+	if _, err := p.Delete("test", "vm"); err != provider.ErrNotFound {
+		t.Errorf("expected %v deleting again, got %v", provider.ErrNotFound, err)
+	}
+}
+
+func TestDeleteStoppedDomain(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	virsh.domains["vm"].running = false
+	if instance, err := p.Get("test", "vm"); err != nil || !instance.Terminated {
+		t.Errorf("expected a stopped domain to be terminated, got %#v, %v", instance, err)
+	}
+	if _, err := p.Delete("test", "vm"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(virsh.domains) != 0 {
+		t.Errorf("expected the domain to be undefined, got %v", virsh.domains)
+	}
+}
+
+func TestListAndSetLabels(t *testing.T) {
+	p, _ := newFakeProvider(t)
+	for _, name := range []string{"first", "second"} {
+		spec := instanceSpec()
+		spec.Name = name
+		if _, err := p.Create(spec); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := p.SetLabels("test", "second", map[string]string{"ci-vm-namespace": "ci"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	instances, err := p.List("test", map[string]string{"ci-vm-namespace": "ci"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(instances) != 1 || instances[0].Name != "second" {
+		t.Fatalf("expected only the relabeled domain, got %#v", instances)
+	}
+	expected := map[string]string{"ci-vm-uid": "uid", "ci-vm-namespace": "ci"}
+	if !reflect.DeepEqual(expected, instances[0].Labels) {
+		t.Errorf("expected labels %v, got %v", expected, instances[0].Labels)
+	}
+
+	if instances, err := p.List("test", map[string]string{"ci-vm-uid": "uid"}); err != nil || len(instances) != 2 {
+		t.Errorf("expected both domains, got %#v, %v", instances, err)
+	}
+}
+
+func TestSetSSHKey(t *testing.T) {
+	p, virsh := newFakeProvider(t)
+	if _, err := p.Create(instanceSpec()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	original, err := p.HostKeys("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := instanceSpec()
+	spec.PublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIIg+kVde4NoOxJuSImLUa/rQ0rHV+yLE3Oq4xoFbPB6H"
+	if _, err := p.SetSSHKey(spec); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if commands := virsh.commands; commands[len(commands)-1] != "reboot" {
+		t.Errorf("expected the domain to be rebooted, got %v", commands)
+	}
+	instance, err := p.Get("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual([]string{spec.PublicKey}, instance.AuthorizedKeys) {
+		t.Errorf("expected authorized keys %v, got %v", []string{spec.PublicKey}, instance.AuthorizedKeys)
+	}
+	replaced, err := p.HostKeys("test", "vm")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(replaced) != 1 || reflect.DeepEqual(original, replaced) {
+		t.Errorf("expected the host key to be replaced, got %v", replaced)
+	}
+}
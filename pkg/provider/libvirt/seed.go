@@ -0,0 +1,31 @@
+package libvirt
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+	"github.com/openshift/ci-vm-operator/pkg/provider/cloudinit"
+)
+
+// seedFor builds the NoCloud seed for the domain, returning the image of
+// the seed disk and the public host key that cloud-init installs.
+func seedFor(spec *provider.InstanceSpec) ([]byte, string, error) {
+	userData, hostKey, err := cloudinit.UserData(spec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// a new instance ID makes cloud-init apply the seed even
+	// if it has already been applied to the domain
+	metaData := fmt.Sprintf("instance-id: %s-%d\nlocal-hostname: %s\n", spec.Name, time.Now().UnixNano(), spec.Name)
+
+	image, err := isoImage("CIDATA", []isoFile{
+		{name: "meta-data", contents: []byte(metaData)},
+		{name: "user-data", contents: userData},
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return image, hostKey, nil
+}
@@ -0,0 +1,113 @@
+package libvirt
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// virsh runs virsh with the arguments against the hypervisor.
+func (p *libvirtProvider) virsh(host *Host, args ...string) (string, error) {
+	output, err := p.run("virsh", append([]string{"--quiet", "--connect", host.URI}, args...)...)
+	return output, translateError(err)
+}
+
+// runCommand runs the command, returning its output or an error that
+// carries what it printed on stderr.
+func runCommand(command string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(command, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", &commandError{command: command, err: err, stderr: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.String(), nil
+}
+
+// commandError is returned when virsh fails.
+type commandError struct {
+	command string
+	err     error
+	stderr  string
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s failed: %v: %s", e.command, e.err, e.stderr)
+}
+
+// libvirt error codes the provider tells apart, from virErrorNumber.
+const (
+	errDomainExists        = 28 // VIR_ERR_DOM_EXIST
+	errNoDomain            = 42 // VIR_ERR_NO_DOMAIN
+	errNoNetwork           = 43 // VIR_ERR_NO_NETWORK
+	errNoStoragePool       = 49 // VIR_ERR_NO_STORAGE_POOL
+	errNoStorageVolume     = 50 // VIR_ERR_NO_STORAGE_VOL
+	errOperationInvalid    = 55 // VIR_ERR_OPERATION_INVALID
+	errStorageVolumeExists = 90 // VIR_ERR_STORAGE_VOL_EXIST
+)
+
+// errorMessages match the message libvirt formats for each error code.
+// virsh prints the message of an error, but not its code.
+var errorMessages = []struct {
+	code    int
+	message *regexp.Regexp
+}{
+	{code: errDomainExists, message: regexp.MustCompile(`^(this domain exists already|domain .* exists already)`)},
+	{code: errNoDomain, message: regexp.MustCompile(`^Domain not found\b`)},
+	{code: errNoNetwork, message: regexp.MustCompile(`^Network not found\b`)},
+	{code: errNoStoragePool, message: regexp.MustCompile(`^Storage pool not found\b`)},
+	{code: errNoStorageVolume, message: regexp.MustCompile(`^Storage volume not found\b`)},
+	{code: errOperationInvalid, message: regexp.MustCompile(`^Requested operation is not valid\b`)},
+	{code: errStorageVolumeExists, message: regexp.MustCompile(`^(this storage volume exists already|storage volume .* exists already)`)},
+}
+
+// errorCode determines the libvirt error code of the error virsh printed,
+// returning zero if it is not one the provider tells apart. virsh prints
+// the error of the failed call last, after those of the steps leading
+// up to it.
+func errorCode(err error) int {
+	cmdErr, ok := err.(*commandError)
+	if !ok {
+		return 0
+	}
+	lines := strings.Split(cmdErr.stderr, "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, "error: ") {
+			continue
+		}
+		message := strings.TrimPrefix(line, "error: ")
+		for _, candidate := range errorMessages {
+			if candidate.message.MatchString(message) {
+				return candidate.code
+			}
+		}
+	}
+	return 0
+}
+
+// translateError maps the errors virsh prints to those of the provider
+// contract. Only missing domains and volumes are reported as not found,
+// as a missing pool or network is a problem with the configuration
+// rather than a sign that the instance is gone.
+func translateError(err error) error {
+	switch errorCode(err) {
+	case errNoDomain, errNoStorageVolume:
+		return provider.ErrNotFound
+	case errDomainExists, errStorageVolumeExists:
+		return provider.ErrAlreadyExists
+	}
+	return err
+}
+
+// isNotRunning determines if virsh failed because the domain
+// was not running.
+func isNotRunning(err error) bool {
+	cmdErr, ok := err.(*commandError)
+	return ok && errorCode(err) == errOperationInvalid && strings.Contains(cmdErr.stderr, "domain is not running")
+}
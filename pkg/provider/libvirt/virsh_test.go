@@ -0,0 +1,225 @@
+package libvirt
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/openshift/ci-vm-operator/pkg/provider"
+)
+
+// fakeDomain is a domain defined on the fake hypervisor.
+type fakeDomain struct {
+	definition string
+	uuid       string
+	metadata   string
+	running    bool
+}
+
+// fakeVirsh stands in for virsh against a single hypervisor, keeping
+// domains and volumes in memory and failing as virsh does.
+type fakeVirsh struct {
+	t       *testing.T
+	uri     string
+	pool    string
+	domains map[string]*fakeDomain
+	volumes map[string][]byte
+	// fail makes the subcommand fail with the message
+	fail     map[string]string
+	commands []string
+}
+
+func newFakeVirsh(t *testing.T) *fakeVirsh {
+	return &fakeVirsh{
+		t:       t,
+		uri:     "test:///default",
+		pool:    "default-pool",
+		domains: map[string]*fakeDomain{},
+		volumes: map[string][]byte{},
+		fail:    map[string]string{},
+	}
+}
+
+func (f *fakeVirsh) run(command string, args ...string) (string, error) {
+	if command != "virsh" {
+		f.t.Fatalf("expected virsh to be run, got %s", command)
+	}
+	if len(args) < 3 || args[0] != "--quiet" || args[1] != "--connect" || args[2] != f.uri {
+		f.t.Fatalf("expected virsh to connect to %s, got %v", f.uri, args)
+	}
+	args = args[3:]
+	f.commands = append(f.commands, args[0])
+	if message, ok := f.fail[args[0]]; ok {
+		return "", virshError(message)
+	}
+
+	switch args[0] {
+	case "vol-create-as":
+		if args[1] != f.pool {
+			return "", virshError(fmt.Sprintf("failed to get pool '%s'\nerror: Storage pool not found: no storage pool with matching name '%s'", args[1], args[1]))
+		}
+		if _, exists := f.volumes[args[2]]; exists {
+			return "", virshError(fmt.Sprintf("Failed to create vol %s\nerror: storage volume '%s' exists already", args[2], args[2]))
+		}
+		f.volumes[args[2]] = nil
+		return fmt.Sprintf("Vol %s created\n", args[2]), nil
+	case "vol-path", "vol-upload", "vol-delete":
+		if args[1] != "--pool" || args[2] != f.pool {
+			f.t.Fatalf("expected %s to use pool %s, got %v", args[0], f.pool, args)
+		}
+		volume := args[3]
+		if _, exists := f.volumes[volume]; !exists {
+			return "", virshError(fmt.Sprintf("failed to get vol '%s'\nerror: Storage volume not found: no storage vol with matching path '%s'", volume, volume))
+		}
+		switch args[0] {
+		case "vol-path":
+			return "/var/lib/libvirt/images/" + volume + "\n", nil
+		case "vol-upload":
+			contents, err := ioutil.ReadFile(args[4])
+			if err != nil {
+				f.t.Fatalf("could not read upload: %v", err)
+			}
+			f.volumes[volume] = contents
+			return "", nil
+		default:
+			delete(f.volumes, volume)
+			return fmt.Sprintf("Vol %s deleted\n", volume), nil
+		}
+	case "define":
+		definition, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			f.t.Fatalf("could not read definition: %v", err)
+		}
+		parsed := &domain{}
+		if err := xml.Unmarshal(definition, parsed); err != nil {
+			return "", virshError(fmt.Sprintf("Failed to define domain from %s\nerror: XML error: %v", args[1], err))
+		}
+		f.domains[parsed.Name] = &fakeDomain{
+			definition: string(definition),
+			uuid:       fmt.Sprintf("00000000-0000-0000-0000-%012d", len(f.domains)+1),
+		}
+		return fmt.Sprintf("Domain %s defined from %s\n", parsed.Name, args[1]), nil
+	case "list":
+		var names []string
+		for name := range f.domains {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return strings.Join(names, "\n") + "\n", nil
+	}
+
+	name := args[1]
+	if args[0] == "dumpxml" && name == "--inactive" {
+		name = args[2]
+	}
+	domain, exists := f.domains[name]
+	if !exists {
+		return "", virshError(fmt.Sprintf("failed to get domain '%s'\nerror: Domain not found: no domain with matching name '%s'", name, name))
+	}
+	switch args[0] {
+	case "metadata":
+		if args[2] != "--uri" || args[3] != metadataNamespace || args[4] != "--key" || args[5] != metadataKey || args[6] != "--set" {
+			f.t.Fatalf("unexpected metadata arguments: %v", args)
+		}
+		domain.metadata = strings.Replace(args[7], "<instance>", fmt.Sprintf("<instance xmlns=%q>", metadataNamespace), 1)
+		return "Metadata modified\n", nil
+	case "dumpxml":
+		header := fmt.Sprintf("<name>%s</name>\n  <uuid>%s</uuid>\n  <metadata>%s</metadata>", name, domain.uuid, domain.metadata)
+		return strings.Replace(domain.definition, fmt.Sprintf("<name>%s</name>", name), header, 1), nil
+	case "start", "reboot":
+		domain.running = true
+		return "", nil
+	case "destroy":
+		if !domain.running {
+			return "", virshError(fmt.Sprintf("Failed to destroy domain %s\nerror: Requested operation is not valid: domain is not running", name))
+		}
+		domain.running = false
+		return "", nil
+	case "undefine":
+		delete(f.domains, name)
+		return fmt.Sprintf("Domain %s has been undefined\n", name), nil
+	case "domstate":
+		if domain.running {
+			return "running\n", nil
+		}
+		return "shut off\n", nil
+	case "domifaddr":
+		if !domain.running {
+			return "", nil
+		}
+		return " vnet0      52:54:00:12:34:56    ipv4         192.168.122.10/24\n", nil
+	}
+	f.t.Fatalf("unexpected invocation: %v", args)
+	return "", nil
+}
+
+func virshError(message string) error {
+	return &commandError{command: "virsh", err: errors.New("exit status 1"), stderr: "error: " + message}
+}
+
+func TestTranslateError(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		stderr   string
+		expected error
+	}{
+		{
+			name:     "missing domain",
+			stderr:   "error: failed to get domain 'vm'\nerror: Domain not found: no domain with matching name 'vm'",
+			expected: provider.ErrNotFound,
+		},
+		{
+			name:     "missing volume",
+			stderr:   "error: failed to get vol 'vm.qcow2'\nerror: Storage volume not found: no storage vol with matching path 'vm.qcow2'",
+			expected: provider.ErrNotFound,
+		},
+		{
+			name:     "existing volume",
+			stderr:   "error: Failed to create vol vm.qcow2\nerror: storage volume 'vm.qcow2' exists already",
+			expected: provider.ErrAlreadyExists,
+		},
+		{
+			name:     "existing domain",
+			stderr:   "error: Failed to define domain from /tmp/domain\nerror: domain 'vm' exists already",
+			expected: provider.ErrAlreadyExists,
+		},
+		{
+			name:   "missing pool is not a missing instance",
+			stderr: "error: failed to get pool 'default'\nerror: Storage pool not found: no storage pool with matching name 'default'",
+		},
+		{
+			name:   "missing network is not a missing instance",
+			stderr: "error: Failed to start domain vm\nerror: Network not found: no network with matching name 'default'",
+		},
+		{
+			name:   "other errors mentioning not found are kept",
+			stderr: "error: Failed to start domain vm\nerror: Cannot access storage file '/var/lib/libvirt/images/centos.qcow2': No such file or directory: not found",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			original := &commandError{command: "virsh", err: errors.New("exit status 1"), stderr: testCase.stderr}
+			translated := translateError(original)
+			if testCase.expected == nil && translated != original {
+				t.Errorf("expected the error to be kept, got %v", translated)
+			}
+			if testCase.expected != nil && translated != testCase.expected {
+				t.Errorf("expected %v, got %v", testCase.expected, translated)
+			}
+		})
+	}
+}
+
+func TestIsNotRunning(t *testing.T) {
+	if !isNotRunning(virshError("Failed to destroy domain vm\nerror: Requested operation is not valid: domain is not running")) {
+		t.Error("expected a domain that is not running to be recognized")
+	}
+	if isNotRunning(virshError("Failed to destroy domain vm\nerror: Requested operation is not valid: domain has active block job")) {
+		t.Error("expected other invalid operations not to be recognized")
+	}
+}
@@ -0,0 +1,145 @@
+// Package provider defines the contract between the controller and the
+// cloud providers that back VirtualMachines with instances.
+package provider
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	vmapi "github.com/openshift/ci-vm-operator/pkg/apis/virtualmachines/v1alpha1"
+)
+
+// Types of operations that providers run on instances.
+const (
+	OperationCreate    = "create"
+	OperationDelete    = "delete"
+	OperationSetSSHKey = "setSSHKey"
+	OperationSetLabels = "setLabels"
+)
+
+var (
+	// ErrNotFound is returned when an instance does not exist.
+	ErrNotFound = errors.New("instance not found")
+	// ErrAlreadyExists is returned when an instance to be created
+	// already exists.
+	ErrAlreadyExists = errors.New("instance already exists")
+	// ErrUnsupported is returned when the provider cannot change
+	// an instance as asked.
+	ErrUnsupported = errors.New("not supported by the provider")
+)
+
+// CapacityError is returned when a zone cannot currently fit an instance,
+// so that another zone should be tried.
+type CapacityError struct {
+	// Codes are the codes the provider reported the error with
+	Codes []string
+	// Message describes the error
+	Message string
+}
+
+func (e *CapacityError) Error() string {
+	return e.Message
+}
+
+// IsCapacityError determines if the error signals that the zone could
+// not fit the instance.
+func IsCapacityError(err error) bool {
+	_, ok := err.(*CapacityError)
+	return ok
+}
+
+// Provider launches and manages instances in a cloud provider. Calls that
+// change an instance start an operation and return without waiting for
+// it to complete; the caller polls the operation until it has.
+type Provider interface {
+	// Zones lists the zones instances may be created in.
+	Zones() []Zone
+	// Create starts creating an instance.
+	Create(spec *InstanceSpec) (*Operation, error)
+	// Get looks up an instance, returning ErrNotFound if it
+	// does not exist.
+	Get(zone, name string) (*Instance, error)
+	// Delete starts deleting an instance.
+	Delete(zone, name string) (*Operation, error)
+	// SetSSHKey starts installing the SSH key and metadata of
+	// the spec on the existing instance it names, returning
+	// ErrUnsupported if keys cannot be replaced.
+	SetSSHKey(spec *InstanceSpec) (*Operation, error)
+	// SetLabels starts adding the labels to an instance.
+	SetLabels(zone, name string, labels map[string]string) (*Operation, error)
+	// Poll checks on an operation without waiting for it.
+	Poll(op *Operation) (*OperationStatus, error)
+	// List lists the instances in the zone that carry all of
+	// the labels.
+	List(zone string, labels map[string]string) ([]*Instance, error)
+	// HostKeys returns the SSH host keys the instance reported
+	// out of band, or none if it has not reported them yet.
+	HostKeys(zone, name string) ([]ssh.PublicKey, error)
+}
+
+// Zone is a location instances may be created in.
+type Zone struct {
+	Name   string
+	Region string
+}
+
+// Operation identifies an operation that runs on an instance.
+type Operation struct {
+	Name string
+	Zone string
+	Type string
+}
+
+// OperationStatus describes the progress of an operation.
+type OperationStatus struct {
+	// Done is true once the operation has completed
+	Done bool
+	// Error is the error the operation failed with, if any
+	Error error
+	// Message describes the progress of the operation
+	Message string
+}
+
+// InstanceSpec describes an instance to create or to install an SSH key
+// on. It is serialized while the instance is being created, so that an
+// interrupted creation is resumed with the same parameters.
+type InstanceSpec struct {
+	Name   string            `json:"name"`
+	Zone   string            `json:"zone"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// User is the user the SSH key is installed for
+	User string `json:"user"`
+	// PublicKey is the SSH key in authorized_keys format
+	PublicKey string `json:"publicKey"`
+
+	StartupScript string `json:"startupScript,omitempty"`
+	UserData      string `json:"userData,omitempty"`
+
+	// Spec is the spec of the VirtualMachine the instance is
+	// created for
+	Spec vmapi.VirtualMachineSpec `json:"spec"`
+}
+
+// Instance describes an instance as it exists in the provider.
+type Instance struct {
+	Name        string
+	Zone        string
+	ID          string
+	SelfLink    string
+	MachineType string
+	Image       string
+	InternalIP  string
+	ExternalIP  string
+	Created     time.Time
+	Labels      map[string]string
+
+	// Terminated is true when the instance was stopped by
+	// the provider rather than at our request
+	Terminated bool
+	// AuthorizedKeys are the SSH keys installed on the instance,
+	// in authorized_keys format without comments
+	AuthorizedKeys []string
+}